@@ -1,32 +1,325 @@
 package connectors
 
 import (
-	"strings"
+	"context"
+	"time"
 
 	"github.com/fightdou/os-brick-rbd/iscsi"
 	"github.com/fightdou/os-brick-rbd/local"
+	"github.com/fightdou/os-brick-rbd/pkg/lock"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/fightdou/os-brick-rbd/rbd"
 )
 
-// ConnProperties is base class interface
+// ConnProperties is base class interface, every method takes a context
+// which bounds the external commands and retry loops it runs
 type ConnProperties interface {
-	ConnectVolume() (map[string]string, error)
-	DisConnectVolume() error
-	ExtendVolume() (int64, error)
-	GetDevicePath() string
-}
-
-// NewConnector Build a Connector object based upon protocol and architecture
-func NewConnector(protocol string, connInfo map[string]interface{}) ConnProperties {
-	switch strings.ToUpper(protocol) {
-	case "RBD":
-		// Only supported local attach volume
-		connInfo["do_local_attach"] = true
-		return rbd.NewRBDConnector(connInfo)
-	case "LOCAL":
-		return local.NewLocalConnector(connInfo)
-	case "ISCSI":
-		return iscsi.NewISCSIConnector(connInfo)
-	}
-	return nil
+	ConnectVolume(ctx context.Context) (map[string]string, error)
+	DisConnectVolume(ctx context.Context) error
+	ExtendVolume(ctx context.Context) (int64, error)
+	GetDevicePath(ctx context.Context) string
+}
+
+// Options configures the connectors built by NewConnector
+type Options struct {
+	// Executor runs the external commands of the connector, they run
+	// directly as the current user when it is nil
+	Executor utils.Executor
+	// Store records the attachments of the connector, nothing is recorded
+	// when it is nil
+	Store state.Store
+	// Locker serializes attach and detach operations between processes,
+	// NewConnector uses a locker in lock.DefaultDir unless it is overridden
+	Locker *lock.Locker
+	// Root is where the host sysfs, devfs and procfs are mounted, for example
+	// /host in a container, the current host is used when it is empty
+	Root sysfs.Root
+	// RBDDeviceType is how rbd images are mapped when the connection info
+	// does not choose, krbd when it is empty
+	RBDDeviceType rbd.DeviceType
+	// RBDMapOptions are the default rbd map options of the deployment, for
+	// example queue_depth=128,exclusive
+	RBDMapOptions string
+	// RBDMsMode is the messenger v2 mode rbd images are mapped with
+	RBDMsMode rbd.MsMode
+	// RBDUnmapRetries is how many times a busy rbd unmap is retried, waiting
+	// RBDUnmapRetryInterval before the first retry. The defaults of the rbd
+	// package are used for a zero interval and for zero retries unless
+	// WithRBDUnmapRetries set them
+	RBDUnmapRetries       int
+	RBDUnmapRetryInterval time.Duration
+	// RBDForceUnmap unmaps rbd devices which are still in use
+	RBDForceUnmap bool
+	// RBDFeatureRemediation is what is done when the kernel does not support
+	// features of an rbd image, the attach fails when it is empty
+	RBDFeatureRemediation rbd.FeatureRemediation
+	// RBDUdevTimeout is how long connect waits for udev to link a krbd
+	// device, rbd.DefaultUdevTimeout when it is zero
+	RBDUdevTimeout time.Duration
+	// ISCSIMinPaths is how many paths a multipath iscsi attach needs, the
+	// attach succeeds with a single path when it is zero
+	ISCSIMinPaths int
+	// ISCSIMultipathTimeout is how long a multipath iscsi attach waits for
+	// the dm device, iscsi.DefaultMultipathTimeout when it is zero
+	ISCSIMultipathTimeout time.Duration
+	// ISCSIIface is the iscsiadm iface the iscsi and iser sessions are bound
+	// to, the builtin iface of the transport is used when it is empty
+	ISCSIIface string
+
+	// rbdUnmapRetriesSet tells WithRBDUnmapRetries set the retries, zero
+	// then disables retrying
+	rbdUnmapRetriesSet bool
+}
+
+// defaultLocker is shared by the connectors so that goroutines of the process use a single locker
+var defaultLocker = lock.NewLocker(lock.DefaultDir)
+
+// Option sets a field of Options
+type Option func(*Options)
+
+// WithExecutor Run the external commands of the connector through e, for
+// example utils.NewSudoExecutor() when the caller is not root
+func WithExecutor(e utils.Executor) Option {
+	return func(o *Options) {
+		o.Executor = e
+	}
+}
+
+// WithStateStore Record the attachments of the connector in s, repeated
+// ConnectVolume calls then return the recorded device and Reconcile can
+// check the records after a restart
+func WithStateStore(s state.Store) Option {
+	return func(o *Options) {
+		o.Store = s
+	}
+}
+
+// WithLockDir Keep the lock files in dir, every process attaching volumes
+// on the host must use the same directory
+func WithLockDir(dir string) Option {
+	return func(o *Options) {
+		o.Locker = lock.NewLocker(dir)
+	}
+}
+
+// WithLocker Serialize the operations of the connector with l, a nil
+// locker disables locking
+func WithLocker(l *lock.Locker) Option {
+	return func(o *Options) {
+		o.Locker = l
+	}
+}
+
+// WithRoot Resolve the sysfs, devfs and procfs paths of the host under root,
+// the device paths returned by the connector are still host paths
+func WithRoot(root sysfs.Root) Option {
+	return func(o *Options) {
+		o.Root = root
+	}
+}
+
+// WithRBDDeviceType Map rbd images with krbd, nbd or krbd falling back to nbd
+func WithRBDDeviceType(t rbd.DeviceType) Option {
+	return func(o *Options) {
+		o.RBDDeviceType = t
+	}
+}
+
+// WithRBDMapOptions Map rbd images with the comma separated options opts in
+// addition to the ones the connection info asks for
+func WithRBDMapOptions(opts string) Option {
+	return func(o *Options) {
+		o.RBDMapOptions = opts
+	}
+}
+
+// WithRBDMsMode Connect to the ceph monitors and osds in messenger v2 mode,
+// crc, secure, prefer-crc or prefer-secure, or with messenger v1 for legacy
+func WithRBDMsMode(mode rbd.MsMode) Option {
+	return func(o *Options) {
+		o.RBDMsMode = mode
+	}
+}
+
+// WithRBDUnmapRetries Retry an rbd unmap failing with EBUSY up to retries
+// times, waiting interval before the first retry and doubling it every time.
+// Zero retries disables retrying, a zero interval keeps the default one
+func WithRBDUnmapRetries(retries int, interval time.Duration) Option {
+	return func(o *Options) {
+		o.RBDUnmapRetries = retries
+		o.RBDUnmapRetryInterval = interval
+		o.rbdUnmapRetriesSet = true
+	}
+}
+
+// WithRBDForceUnmap Unmap rbd devices which are still held or mounted, and
+// force the unmap of krbd devices which stay busy, the data not yet written
+// to the cluster is lost
+func WithRBDForceUnmap(force bool) Option {
+	return func(o *Options) {
+		o.RBDForceUnmap = force
+	}
+}
+
+// WithRBDFeatureRemediation Disable the image features the kernel does not
+// support, or map such images with rbd-nbd, instead of failing the attach
+func WithRBDFeatureRemediation(r rbd.FeatureRemediation) Option {
+	return func(o *Options) {
+		o.RBDFeatureRemediation = r
+	}
+}
+
+// WithRBDUdevTimeout Wait up to timeout for udev to create the
+// /dev/rbd/<pool>/<image> link of a mapped krbd device
+func WithRBDUdevTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.RBDUdevTimeout = timeout
+	}
+}
+
+// WithISCSIMinPaths Fail a multipath iscsi attach which connects fewer than
+// n paths, the portals which fail beyond that are reported in the
+// failed_portals result of ConnectVolume
+func WithISCSIMinPaths(n int) Option {
+	return func(o *Options) {
+		o.ISCSIMinPaths = n
+	}
+}
+
+// WithISCSIMultipathTimeout Wait up to timeout for multipathd to build the
+// dm device of a multipath iscsi attach
+func WithISCSIMultipathTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.ISCSIMultipathTimeout = timeout
+	}
+}
+
+// WithISCSIIface Bind the iscsi and iser sessions to the iscsiadm iface
+// name, for example one created with iscsiadm -m iface -o new and bound to a
+// storage NIC with iface.net_ifacename. The transport_name of the iface must
+// match the transport of the volumes
+func WithISCSIIface(name string) Option {
+	return func(o *Options) {
+		o.ISCSIIface = name
+	}
+}
+
+func init() {
+	MustRegister(newRBDConnector, Capabilities{Extend: true, ReadOnly: true}, "RBD", "CEPH")
+	MustRegister(newLocalConnector, Capabilities{Extend: true}, "LOCAL")
+	MustRegister(newISCSIConnector, Capabilities{Extend: true, Multipath: true}, "ISCSI")
+	MustRegister(newISERConnector, Capabilities{Extend: true, Multipath: true}, "ISER")
+}
+
+// NewConnector Build a Connector object based upon protocol and architecture,
+// an *UnsupportedProtocolError is returned when no connector is registered for protocol
+func NewConnector(protocol string, connInfo map[string]interface{}, opts ...Option) (ConnProperties, error) {
+	reg, err := lookup(protocol)
+	if err != nil {
+		return nil, err
+	}
+	options := Options{Locker: defaultLocker}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return reg.factory(connInfo, options)
+}
+
+// newRBDConnector Build the builtin rbd connector, images are mapped on the
+// host unless the connection info sets do_local_attach to false. The default
+// is set on a copy, the caller's connection info is left untouched
+func newRBDConnector(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+	info := make(map[string]interface{}, len(connInfo)+1)
+	for k, v := range connInfo {
+		info[k] = v
+	}
+	if _, ok := info["do_local_attach"]; !ok {
+		info["do_local_attach"] = true
+	}
+	conn, err := rbd.NewRBDConnector(info)
+	if err != nil {
+		return nil, err
+	}
+	if conn.DeviceType == "" {
+		if err := opts.RBDDeviceType.Validate(); err != nil {
+			return nil, err
+		}
+		conn.DeviceType = opts.RBDDeviceType
+	}
+	if _, err := rbd.ParseMapOptions(opts.RBDMapOptions); err != nil {
+		return nil, err
+	}
+	conn.MapOptions = opts.RBDMapOptions
+	if err := opts.RBDMsMode.Validate(); err != nil {
+		return nil, err
+	}
+	conn.MsMode = opts.RBDMsMode
+	if opts.RBDUnmapRetries > 0 || opts.rbdUnmapRetriesSet {
+		conn.UnmapRetries = opts.RBDUnmapRetries
+	}
+	if opts.RBDUnmapRetryInterval > 0 {
+		conn.UnmapRetryInterval = opts.RBDUnmapRetryInterval
+	}
+	conn.ForceUnmap = opts.RBDForceUnmap
+	if err := opts.RBDFeatureRemediation.Validate(); err != nil {
+		return nil, err
+	}
+	conn.FeatureRemediation = opts.RBDFeatureRemediation
+	if opts.RBDUdevTimeout > 0 {
+		conn.UdevTimeout = opts.RBDUdevTimeout
+	}
+	conn.Executor = opts.Executor
+	conn.Store = opts.Store
+	conn.Locker = opts.Locker
+	conn.Root = opts.Root
+	return conn, nil
+}
+
+// newLocalConnector Build the builtin local connector
+func newLocalConnector(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+	conn, err := local.NewLocalConnector(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	conn.Executor = opts.Executor
+	conn.Store = opts.Store
+	conn.Locker = opts.Locker
+	conn.Root = opts.Root
+	return conn, nil
+}
+
+// newISCSIConnector Build the builtin iscsi connector
+func newISCSIConnector(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+	conn, err := iscsi.NewISCSIConnector(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	return configureISCSI(conn, opts), nil
+}
+
+// newISERConnector Build the builtin iscsi connector logging in with the iser transport
+func newISERConnector(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+	conn, err := iscsi.NewISERConnector(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	return configureISCSI(conn, opts), nil
+}
+
+// configureISCSI Apply the options to an iscsi connector
+func configureISCSI(conn *iscsi.ConnISCSI, opts Options) *iscsi.ConnISCSI {
+	if opts.ISCSIMinPaths > 0 {
+		conn.MinPaths = opts.ISCSIMinPaths
+	}
+	if opts.ISCSIMultipathTimeout > 0 {
+		conn.MultipathTimeout = opts.ISCSIMultipathTimeout
+	}
+	conn.Iface = opts.ISCSIIface
+	conn.Executor = opts.Executor
+	conn.Store = opts.Store
+	conn.Locker = opts.Locker
+	conn.Root = opts.Root
+	return conn
 }
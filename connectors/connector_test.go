@@ -1,8 +1,18 @@
 package connectors
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/fightdou/os-brick-rbd/rbd"
 )
 
@@ -10,7 +20,7 @@ func TestNewConnector(t *testing.T) {
 	t.Parallel()
 	connInfo := make(map[string]interface{})
 	data := make(map[string]interface{})
-	data["name"] = "fake"
+	data["name"] = "fake_pool/fake"
 	data["hosts"] = []interface{}{"host1", "host2"}
 	data["ports"] = []interface{}{"1", "2"}
 	data["cluster_name"] = "fake_cluster"
@@ -22,13 +32,281 @@ func TestNewConnector(t *testing.T) {
 	data["access_mode"] = "rw"
 	data["encrypted"] = "1"
 	connInfo["data"] = data
-	conn := NewConnector("RBD", connInfo)
+	conn, err := NewConnector("RBD", connInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
 	_, ok := conn.(*rbd.ConnRbd)
 	if !ok {
 		t.Error("Expected a *rbd.ConnRbd value.")
 	}
-	conn = NewConnector("FakeProcotol", connInfo)
-	if conn != nil {
-		t.Error("Expected nil value for not supported protocol.")
+	if !conn.(*rbd.ConnRbd).DoLocalAttach {
+		t.Error("Expected RBD volumes to be attached locally by default.")
+	}
+	if _, ok := connInfo["do_local_attach"]; ok {
+		t.Error("The caller's connection info should not be modified.")
+	}
+	connInfo["do_local_attach"] = false
+	conn, err = NewConnector("RBD", connInfo)
+	if rbdConn, ok := conn.(*rbd.ConnRbd); !ok || err != nil || rbdConn.DoLocalAttach {
+		t.Errorf("Expected do_local_attach=false to be kept, got %v %v", conn, err)
+	}
+	delete(connInfo, "do_local_attach")
+	conn, err = NewConnector("ceph", connInfo)
+	if _, ok := conn.(*rbd.ConnRbd); !ok || err != nil {
+		t.Error("Expected the ceph alias to build a *rbd.ConnRbd value.")
+	}
+	conn, err = NewConnector("FakeProcotol", connInfo)
+	if conn != nil || err == nil {
+		t.Error("Expected nil value and an error for not supported protocol.")
+	}
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("Expected ErrUnsupportedProtocol, got %v", err)
+	}
+	var protoErr *UnsupportedProtocolError
+	if !errors.As(err, &protoErr) || protoErr.Protocol != "FakeProcotol" {
+		t.Errorf("Expected an *UnsupportedProtocolError, got %v", err)
+	}
+}
+
+func TestRBDUnmapRetries(t *testing.T) {
+	t.Parallel()
+	connInfo := map[string]interface{}{"data": map[string]interface{}{"name": "volumes/volume-1"}}
+	cases := []struct {
+		opts     []Option
+		retries  int
+		interval time.Duration
+	}{
+		{nil, rbd.DefaultUnmapRetries, rbd.DefaultUnmapRetryInterval},
+		{[]Option{WithRBDUnmapRetries(0, 0)}, 0, rbd.DefaultUnmapRetryInterval},
+		{[]Option{WithRBDUnmapRetries(2, 0)}, 2, rbd.DefaultUnmapRetryInterval},
+		{[]Option{WithRBDUnmapRetries(0, time.Second)}, 0, time.Second},
+	}
+	for i, c := range cases {
+		conn, err := NewConnector("RBD", connInfo, c.opts...)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		rbdConn := conn.(*rbd.ConnRbd)
+		if rbdConn.UnmapRetries != c.retries || rbdConn.UnmapRetryInterval != c.interval {
+			t.Errorf("%d: expected %d retries every %s, got %d every %s", i, c.retries, c.interval, rbdConn.UnmapRetries, rbdConn.UnmapRetryInterval)
+		}
+	}
+}
+
+type testConnector struct {
+	connInfo map[string]interface{}
+}
+
+func (c *testConnector) ConnectVolume(ctx context.Context) (map[string]string, error) {
+	return map[string]string{"path": "/dev/test"}, nil
+}
+
+func (c *testConnector) DisConnectVolume(ctx context.Context) error { return nil }
+
+func (c *testConnector) ExtendVolume(ctx context.Context) (int64, error) { return 0, nil }
+
+func (c *testConnector) GetDevicePath(ctx context.Context) string { return "/dev/test" }
+
+func TestRegister(t *testing.T) {
+	t.Parallel()
+	factory := func(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+		return &testConnector{connInfo: connInfo}, nil
+	}
+	caps := Capabilities{Extend: true, ReadOnly: true}
+	if err := Register(factory, caps, "TestProto", "test-alias"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer Unregister("TestProto")
+	defer Unregister("test-alias")
+
+	for _, protocol := range []string{"testproto", "TEST-ALIAS"} {
+		conn, err := NewConnector(protocol, map[string]interface{}{})
+		if _, ok := conn.(*testConnector); !ok || err != nil {
+			t.Errorf("Expected a *testConnector for %s, got %v %v", protocol, conn, err)
+		}
+		res, err := GetCapabilities(protocol)
+		if err != nil || !reflect.DeepEqual(res, caps) {
+			t.Errorf("Unexpected capabilities for %s: %+v %v", protocol, res, err)
+		}
+	}
+	if err := Register(factory, caps, "other-proto", "TESTPROTO"); err == nil {
+		t.Error("Expected an error registering a protocol twice.")
+	}
+	if _, err := GetCapabilities("other-proto"); err == nil {
+		t.Error("A failed registration should not register any protocol.")
+	}
+	if err := Register(nil, caps, "nil-factory"); err == nil {
+		t.Error("Expected an error registering a nil factory.")
+	}
+	if _, err := GetCapabilities("unknown"); !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("Expected ErrUnsupportedProtocol, got %v", err)
+	}
+}
+
+func TestProtocols(t *testing.T) {
+	t.Parallel()
+	protocols := Protocols()
+	for _, expected := range []string{"CEPH", "ISCSI", "ISER", "LOCAL", "RBD"} {
+		found := false
+		for _, p := range protocols {
+			if p == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected builtin protocol %s in %v", expected, protocols)
+		}
+	}
+}
+
+func TestNewConnectorInvalidConnInfo(t *testing.T) {
+	t.Parallel()
+	cases := []map[string]interface{}{
+		nil,
+		{},
+		{"data": "not a map"},
+		{"data": map[string]interface{}{"name": "no_separator"}},
+		{"data": map[string]interface{}{"name": "pool/image", "hosts": []interface{}{"h1"}, "ports": []interface{}{}}},
+		{"data": map[string]interface{}{"name": "pool/image", "auth_enabled": "maybe"}},
+	}
+	for _, connInfo := range cases {
+		conn, err := NewConnector("RBD", connInfo)
+		if conn != nil || !errors.Is(err, exception.ErrInvalidConnInfo) {
+			t.Errorf("Expected an invalid connection info error for %v, got %v", connInfo, err)
+		}
+	}
+}
+
+type failingExecutor struct{}
+
+func (failingExecutor) Run(ctx context.Context, cmd utils.Command) (utils.Result, error) {
+	return utils.Result{ExitCode: 1}, exception.NewCommandError(cmd.Argv(), "", "multipathd not running", nil)
+}
+
+func TestGetConnectorProperties(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	props, err := GetConnectorProperties(ctx, PropertiesOptions{
+		Executor:  failingExecutor{},
+		MyIP:      "192.0.2.10",
+		Host:      "compute-1",
+		Multipath: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if props.IP != "192.0.2.10" || props.Host != "compute-1" || props.OSType != "linux2" || props.Multipath {
+		t.Errorf("Unexpected properties %+v", props)
+	}
+	m := props.ToMap()
+	if m["host"] != "compute-1" || m["multipath"] != false {
+		t.Errorf("Unexpected connector dict %v", m)
+	}
+	_, err = GetConnectorProperties(ctx, PropertiesOptions{
+		Executor:         failingExecutor{},
+		Multipath:        true,
+		EnforceMultipath: true,
+	})
+	if !errors.Is(err, exception.ErrCommandFailed) {
+		t.Errorf("Expected enforced multipath to fail, got %v", err)
+	}
+}
+
+func TestReadHostIdentifiers(t *testing.T) {
+	t.Parallel()
+	root := sysfs.Root(t.TempDir())
+	files := map[string]string{
+		initiatorNameFile:              "## DO NOT EDIT\nInitiatorName=iqn.1993-08.org.debian:01:abcdef\n",
+		nvmeHostNQNFile:                "nqn.2014-08.org.nvmexpress:uuid:0001\n",
+		fcHostDir + "/host0/port_name": "0x21000024ff000001\n",
+		fcHostDir + "/host0/node_name": "0x20000024ff000000\n",
+		fcHostDir + "/host1/port_name": "0x21000024ff000002\n",
+		fcHostDir + "/host1/node_name": "0x20000024ff000001\n",
+	}
+	for name, content := range files {
+		path := root.Path(name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	props, err := GetConnectorProperties(context.Background(), PropertiesOptions{Root: root, MyIP: "192.0.2.10", Host: "compute-1"})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if props.Initiator != "iqn.1993-08.org.debian:01:abcdef" || props.NQN != "nqn.2014-08.org.nvmexpress:uuid:0001" {
+		t.Errorf("Unexpected host identifiers %+v", props)
+	}
+	if props.NVMeHostID != "" || props.SystemUUID != "" {
+		t.Errorf("Expected missing files to be left empty, got %+v", props)
+	}
+	if !reflect.DeepEqual(props.Wwpns, []string{"21000024ff000001", "21000024ff000002"}) ||
+		!reflect.DeepEqual(props.Wwnns, []string{"20000024ff000000", "20000024ff000001"}) {
+		t.Errorf("Unexpected wwns %v %v", props.Wwpns, props.Wwnns)
+	}
+}
+
+// pathConnector reports the device path of its connection info
+type pathConnector struct {
+	testConnector
+}
+
+func (c *pathConnector) GetDevicePath(ctx context.Context) string {
+	path, _ := c.connInfo["path"].(string)
+	return path
+}
+
+func TestReconcile(t *testing.T) {
+	t.Parallel()
+	factory := func(connInfo map[string]interface{}, opts Options) (ConnProperties, error) {
+		return &pathConnector{testConnector{connInfo: connInfo}}, nil
+	}
+	if err := Register(factory, Capabilities{}, "reconcile-test"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer Unregister("reconcile-test")
+
+	device := filepath.Join(t.TempDir(), "sda")
+	if err := os.WriteFile(device, nil, 0600); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	link := filepath.Join(t.TempDir(), "disk-1")
+	if err := os.Symlink(device, link); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	store := state.NewMemoryStore()
+	records := []*state.Attachment{
+		{ID: "attached", Protocol: "reconcile-test", ConnInfo: map[string]interface{}{"path": device}, DevicePath: "/dev/old"},
+		{ID: "link", Protocol: "reconcile-test", ConnInfo: map[string]interface{}{"path": device}, DevicePath: link},
+		{ID: "stale", Protocol: "reconcile-test", ConnInfo: map[string]interface{}{"path": "/nonexistent/sdb"}},
+		{ID: "unknown", Protocol: "no-such-protocol"},
+	}
+	for _, a := range records {
+		if err := state.Save(store, a); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	report, err := Reconcile(context.Background(), store, true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(report.Attached) != 2 || report.Attached[0].ID != "attached" || report.Attached[0].DevicePath != device {
+		t.Errorf("Unexpected attached records %+v", report.Attached)
+	}
+	if len(report.Attached) == 2 && report.Attached[1].DevicePath != link {
+		t.Errorf("Expected the recorded link to the device to be kept, got %s", report.Attached[1].DevicePath)
+	}
+	if len(report.Stale) != 1 || report.Stale[0].ID != "stale" {
+		t.Errorf("Unexpected stale records %+v", report.Stale)
+	}
+	if !errors.Is(report.Failed["unknown"], ErrUnsupportedProtocol) {
+		t.Errorf("Unexpected failed records %v", report.Failed)
+	}
+	remaining, _ := store.List()
+	if len(remaining) != 3 || remaining[0].ID != "attached" || remaining[0].DevicePath != device {
+		t.Errorf("Unexpected records after pruning %+v", remaining)
 	}
 }
@@ -0,0 +1,213 @@
+package connectors
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+const (
+	initiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	nvmeHostNQNFile   = "/etc/nvme/hostnqn"
+	nvmeHostIDFile    = "/etc/nvme/hostid"
+	systemUUIDFile    = "/sys/class/dmi/id/product_uuid"
+	fcHostDir         = "/sys/class/fc_host"
+	// osTypeLinux is the os_type os-brick reports for linux hosts
+	osTypeLinux = "linux2"
+)
+
+// PropertiesOptions configures GetConnectorProperties
+type PropertiesOptions struct {
+	// Executor runs multipathd, it runs directly when nil
+	Executor utils.Executor
+	// MyIP is the ip reported to cinder, the first global address of the host is used when empty
+	MyIP string
+	// Host is the host name reported to cinder, os.Hostname is used when empty
+	Host string
+	// Multipath requests multipath attachments, it is only reported when multipathd is running
+	Multipath bool
+	// EnforceMultipath fails GetConnectorProperties when multipath is requested but multipathd is not running
+	EnforceMultipath bool
+	// Root is where the host filesystem is mounted, the current host is used when it is empty
+	Root sysfs.Root
+}
+
+// ConnectorProperties is the host connector cinder initialize_connection expects,
+// the json names match the dict python os-brick get_connector_properties returns
+type ConnectorProperties struct {
+	Platform   string   `json:"platform"`
+	OSType     string   `json:"os_type"`
+	IP         string   `json:"ip"`
+	Host       string   `json:"host"`
+	Multipath  bool     `json:"multipath"`
+	Initiator  string   `json:"initiator,omitempty"`
+	NQN        string   `json:"nqn,omitempty"`
+	NVMeHostID string   `json:"nvme_hostid,omitempty"`
+	SystemUUID string   `json:"system uuid,omitempty"`
+	Wwpns      []string `json:"wwpns,omitempty"`
+	Wwnns      []string `json:"wwnns,omitempty"`
+}
+
+// ToMap Return the properties as the connector dict of the initialize_connection request body
+func (p *ConnectorProperties) ToMap() map[string]interface{} {
+	res := map[string]interface{}{
+		"platform":  p.Platform,
+		"os_type":   p.OSType,
+		"ip":        p.IP,
+		"host":      p.Host,
+		"multipath": p.Multipath,
+	}
+	if p.Initiator != "" {
+		res["initiator"] = p.Initiator
+	}
+	if p.NQN != "" {
+		res["nqn"] = p.NQN
+	}
+	if p.NVMeHostID != "" {
+		res["nvme_hostid"] = p.NVMeHostID
+	}
+	if p.SystemUUID != "" {
+		res["system uuid"] = p.SystemUUID
+	}
+	if len(p.Wwpns) > 0 {
+		res["wwpns"] = p.Wwpns
+	}
+	if len(p.Wwnns) > 0 {
+		res["wwnns"] = p.Wwnns
+	}
+	return res
+}
+
+// GetConnectorProperties Collect the host side connector properties cinder
+// needs before initialize_connection, identifiers of transports which are
+// not configured on the host are left empty
+func GetConnectorProperties(ctx context.Context, opts PropertiesOptions) (*ConnectorProperties, error) {
+	props := &ConnectorProperties{
+		Platform: platform(),
+		OSType:   osTypeLinux,
+		IP:       opts.MyIP,
+		Host:     opts.Host,
+	}
+	if props.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, exception.Wrap(exception.ErrIO, err, "get hostname")
+		}
+		props.Host = host
+	}
+	if props.IP == "" {
+		props.IP = defaultIP()
+	}
+	if opts.Multipath {
+		_, err := utils.Exec(ctx, opts.Executor, "multipathd", "show", "status")
+		if err != nil {
+			if opts.EnforceMultipath {
+				logger.Error("multipathd is not running", err)
+				return nil, err
+			}
+			logger.Warn("multipathd is not running, multipath is disabled: %v", err)
+		}
+		props.Multipath = err == nil
+	}
+	root := opts.Root
+	props.Initiator = readInitiatorName(root, initiatorNameFile)
+	props.NQN = readFirstLine(root, nvmeHostNQNFile)
+	props.NVMeHostID = readFirstLine(root, nvmeHostIDFile)
+	props.SystemUUID = readFirstLine(root, systemUUIDFile)
+	props.Wwpns, props.Wwnns = readFCNames(root, fcHostDir)
+	return props, nil
+}
+
+// platform Return the machine name python platform.machine() reports
+func platform() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	}
+	return runtime.GOARCH
+}
+
+// defaultIP Return the first global unicast address of the host, IPv4 preferred
+func defaultIP() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Warn("failed to list interface addresses: %v", err)
+		return ""
+	}
+	var v6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+		if v6 == "" {
+			v6 = ipNet.IP.String()
+		}
+	}
+	return v6
+}
+
+// readFirstLine Return the first line of a file, empty when it can not be read
+func readFirstLine(root sysfs.Root, path string) string {
+	content, err := root.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("failed to read %s: %v", path, err)
+		}
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+}
+
+// readInitiatorName Return the InitiatorName of the open-iscsi initiator file
+func readInitiatorName(root sysfs.Root, path string) string {
+	content, err := root.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("failed to read %s: %v", path, err)
+		}
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "InitiatorName="))
+		}
+	}
+	return ""
+}
+
+// readFCNames Return the port and node world wide names of the fibre channel HBAs
+func readFCNames(root sysfs.Root, dir string) ([]string, []string) {
+	hosts, err := root.Glob(filepath.Join(dir, "host*"))
+	if err != nil || len(hosts) == 0 {
+		return nil, nil
+	}
+	sort.Strings(hosts)
+	var wwpns, wwnns []string
+	for _, host := range hosts {
+		if wwpn := strings.TrimPrefix(readFirstLine(root, filepath.Join(host, "port_name")), "0x"); wwpn != "" {
+			wwpns = append(wwpns, wwpn)
+		}
+		if wwnn := strings.TrimPrefix(readFirstLine(root, filepath.Join(host, "node_name")), "0x"); wwnn != "" {
+			wwnns = append(wwnns, wwnn)
+		}
+	}
+	return wwpns, wwnns
+}
@@ -0,0 +1,81 @@
+package connectors
+
+import (
+	"context"
+
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/wonderivan/logger"
+)
+
+// ReconcileReport is the outcome of comparing the attachment records with the host
+type ReconcileReport struct {
+	// Attached are the records whose device is present on the host
+	Attached []*state.Attachment
+	// Stale are the records whose device is gone
+	Stale []*state.Attachment
+	// Failed are the records which could not be checked, by attachment id
+	Failed map[string]error
+}
+
+// Reconcile Compare the attachments recorded in store with the devices
+// present on the host, it is meant to run when the agent starts. The device
+// path of attached records is refreshed and stale records are removed when
+// prune is set. opts configures the connectors used to look up the devices,
+// a state store among them is ignored
+func Reconcile(ctx context.Context, store state.Store, prune bool, opts ...Option) (*ReconcileReport, error) {
+	attachments, err := store.List()
+	if err != nil {
+		logger.Error("List attachment records failed", err)
+		return nil, err
+	}
+	report := &ReconcileReport{Failed: map[string]error{}}
+	opts = append(opts[:len(opts):len(opts)], WithStateStore(nil))
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	for _, a := range attachments {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		conn, err := NewConnector(a.Protocol, a.ConnInfo, opts...)
+		if err != nil {
+			logger.Warn("Can not check attachment %s: %v", a.ID, err)
+			report.Failed[a.ID] = err
+			continue
+		}
+		path := conn.GetDevicePath(ctx)
+		if path == "" || !options.Root.Exists(path) {
+			logger.Warn("Device %s of attachment %s is gone", a.DevicePath, a.ID)
+			report.Stale = append(report.Stale, a)
+			if prune {
+				if err := store.Delete(a.ID); err != nil {
+					report.Failed[a.ID] = err
+				}
+			}
+			continue
+		}
+		if path != a.DevicePath && !sameDevice(options.Root, path, a.DevicePath) {
+			logger.Info("Device of attachment %s moved from %s to %s", a.ID, a.DevicePath, path)
+			a.DevicePath = path
+			if err := state.Save(store, a); err != nil {
+				report.Failed[a.ID] = err
+				continue
+			}
+		}
+		report.Attached = append(report.Attached, a)
+	}
+	return report, nil
+}
+
+// sameDevice Check two device paths resolve to the same device, a recorded
+// link is kept rather than replaced by another link to its device
+func sameDevice(root sysfs.Root, path, other string) bool {
+	resolved, err := root.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	otherResolved, err := root.EvalSymlinks(other)
+	return err == nil && resolved == otherResolved
+}
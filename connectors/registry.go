@@ -0,0 +1,128 @@
+package connectors
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnsupportedProtocol is matched by the error NewConnector returns for
+// a protocol no connector is registered under
+var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
+// UnsupportedProtocolError is returned when no connector is registered for a protocol
+type UnsupportedProtocolError struct {
+	Protocol string
+}
+
+func (e *UnsupportedProtocolError) Error() string {
+	return fmt.Sprintf("protocol %s is not supported", e.Protocol)
+}
+
+// Is makes errors.Is(err, ErrUnsupportedProtocol) report true
+func (e *UnsupportedProtocolError) Is(target error) bool {
+	return target == ErrUnsupportedProtocol
+}
+
+// Capabilities describes the optional features a connector supports
+type Capabilities struct {
+	// Extend is set when ExtendVolume refreshes the local view of a resized volume
+	Extend bool
+	// Multipath is set when the connector can attach a volume over several paths
+	Multipath bool
+	// ReadOnly is set when the connector honors the read-only access mode
+	ReadOnly bool
+	// Encryption is set when the connector handles encrypted volumes itself
+	Encryption bool
+}
+
+// Factory builds a connector from a cinder connection info map and the
+// options given to NewConnector
+type Factory func(connInfo map[string]interface{}, opts Options) (ConnProperties, error)
+
+// registration is a factory and its capabilities
+type registration struct {
+	factory      Factory
+	capabilities Capabilities
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]registration{}
+)
+
+// Register makes a connector factory available under one or more protocol
+// names, names are matched case insensitively. It fails when a name is empty
+// or already registered, nothing is registered in that case
+func Register(factory Factory, capabilities Capabilities, protocols ...string) error {
+	if factory == nil {
+		return errors.New("connector factory is nil")
+	}
+	if len(protocols) == 0 {
+		return errors.New("no protocol given for connector")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, protocol := range protocols {
+		name := strings.ToUpper(strings.TrimSpace(protocol))
+		if name == "" {
+			return errors.New("connector protocol name is empty")
+		}
+		if _, ok := registry[name]; ok {
+			return fmt.Errorf("connector for protocol %s is already registered", name)
+		}
+	}
+	for _, protocol := range protocols {
+		name := strings.ToUpper(strings.TrimSpace(protocol))
+		registry[name] = registration{factory: factory, capabilities: capabilities}
+	}
+	return nil
+}
+
+// MustRegister is like Register but panics on error, it is meant for init functions
+func MustRegister(factory Factory, capabilities Capabilities, protocols ...string) {
+	if err := Register(factory, capabilities, protocols...); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the connector registered under a protocol name
+func Unregister(protocol string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, strings.ToUpper(strings.TrimSpace(protocol)))
+}
+
+// GetCapabilities Return the capabilities of the connector registered for a protocol
+func GetCapabilities(protocol string) (Capabilities, error) {
+	reg, err := lookup(protocol)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	return reg.capabilities, nil
+}
+
+// Protocols Return the sorted list of registered protocol names
+func Protocols() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup Find the registration for a protocol name
+func lookup(protocol string) (registration, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	reg, ok := registry[strings.ToUpper(strings.TrimSpace(protocol))]
+	if !ok {
+		return registration{}, &UnsupportedProtocolError{Protocol: protocol}
+	}
+	return reg, nil
+}
@@ -0,0 +1,240 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/fightdou/os-brick-rbd/connectors"
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/lock"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+// Protocol is the protocol of the fake connector in the connectors registry
+const Protocol = "FAKE"
+
+// defaultVolumeSize is the size of a volume whose connection info has none
+const defaultVolumeSize = 1 << 30
+
+func init() {
+	connectors.MustRegister(newConnector, connectors.Capabilities{Extend: true}, Protocol)
+}
+
+// volume is a volume attached through the fake connector
+type volume struct {
+	size   int64
+	device string
+}
+
+// Options Return the connectors options running the connectors on the host
+func (h *Host) Options() []connectors.Option {
+	return []connectors.Option{
+		connectors.WithExecutor(h),
+		connectors.WithRoot(h.Root()),
+		connectors.WithLocker(lock.NewLocker(h.Root().Path("/run/lock/os-brick"))),
+	}
+}
+
+// ResizeVolume Change the size of a volume of the fake connector
+func (h *Host) ResizeVolume(volumeID string, size int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.volumes[volumeID]
+	if !ok {
+		return fmt.Errorf("volume %s is not attached", volumeID)
+	}
+	v.size = size
+	return h.tree.SetSize(v.device, size)
+}
+
+// attach Simulate fake-attach <volume id> <size>, it prints the device of the volume
+func (h *Host) attach(args []string) (string, string, int) {
+	if len(args) != 2 {
+		return "", "fake-attach: expected a volume id and a size", 1
+	}
+	if v, ok := h.volumes[args[0]]; ok {
+		return "/dev/" + v.device + "\n", "", 0
+	}
+	var size int64
+	if _, err := fmt.Sscan(args[1], &size); err != nil {
+		return "", "fake-attach: invalid size " + args[1], 1
+	}
+	n := h.allocate("vd", func(n int) bool {
+		for _, v := range h.volumes {
+			if v.device == "vd"+letters(n) {
+				return true
+			}
+		}
+		return false
+	})
+	v := &volume{size: size, device: "vd" + letters(n)}
+	if err := h.tree.WriteFile("/dev/"+v.device, ""); err != nil {
+		return "", err.Error(), 1
+	}
+	if err := h.tree.SetSize(v.device, size); err != nil {
+		return "", err.Error(), 1
+	}
+	h.volumes[args[0]] = v
+	return "/dev/" + v.device + "\n", "", 0
+}
+
+// detach Simulate fake-detach <volume id>
+func (h *Host) detach(args []string) (string, string, int) {
+	if len(args) != 1 {
+		return "", "fake-detach: expected a volume id", 1
+	}
+	v, ok := h.volumes[args[0]]
+	if !ok {
+		return "", "", 0
+	}
+	for _, p := range []string{"/dev/" + v.device, "/sys/block/" + v.device} {
+		if err := os.RemoveAll(h.tree.Root.Path(p)); err != nil {
+			return "", err.Error(), 1
+		}
+	}
+	delete(h.volumes, args[0])
+	return "", "", 0
+}
+
+// Connector attaches the volumes of the FAKE protocol to a Host, their
+// connection info is {"data": {"volume_id": "volume-1", "size": 1073741824}}
+type Connector struct {
+	VolumeID string
+	Size     int64
+	Host     *Host
+	// Store records the attachment, nothing is recorded when it is nil
+	Store state.Store
+
+	connInfo map[string]interface{}
+}
+
+// rawConnInfo is the wire form of the fake connection info
+type rawConnInfo struct {
+	VolumeID utils.String `json:"volume_id"`
+	Size     utils.Int    `json:"size"`
+}
+
+// NewConnector Build a connector attaching a volume to host
+func NewConnector(host *Host, connInfo map[string]interface{}) (*Connector, error) {
+	var raw rawConnInfo
+	if err := utils.DecodeConnInfoData(connInfo, &raw); err != nil {
+		return nil, exception.InvalidConnInfo("fake", "%v", err)
+	}
+	if raw.VolumeID == "" {
+		return nil, exception.InvalidConnInfo("fake", "volume_id is required")
+	}
+	if raw.Size < 0 {
+		return nil, exception.InvalidConnInfo("fake", "size %d is negative", raw.Size)
+	}
+	c := &Connector{VolumeID: string(raw.VolumeID), Size: int64(raw.Size), Host: host, connInfo: connInfo}
+	if c.Size == 0 {
+		c.Size = defaultVolumeSize
+	}
+	return c, nil
+}
+
+var (
+	defaultHostOnce sync.Once
+	defaultHost     *Host
+	defaultHostErr  error
+)
+
+// DefaultHost Return the host of the connectors built without a Host executor,
+// its tree is in a temporary directory
+func DefaultHost() (*Host, error) {
+	defaultHostOnce.Do(func() {
+		var dir string
+		dir, defaultHostErr = os.MkdirTemp("", "os-brick-fake-")
+		if defaultHostErr == nil {
+			defaultHost, defaultHostErr = NewHostAt(dir)
+		}
+	})
+	return defaultHost, defaultHostErr
+}
+
+// newConnector Build the fake connector of the connectors registry
+func newConnector(connInfo map[string]interface{}, opts connectors.Options) (connectors.ConnProperties, error) {
+	host, ok := opts.Executor.(*Host)
+	if !ok {
+		var err error
+		if host, err = DefaultHost(); err != nil {
+			return nil, err
+		}
+	}
+	c, err := NewConnector(host, connInfo)
+	if err != nil {
+		return nil, err
+	}
+	c.Store = opts.Store
+	return c, nil
+}
+
+// ConnectVolume implements connectors.ConnProperties
+func (c *Connector) ConnectVolume(ctx context.Context) (map[string]string, error) {
+	out, err := utils.Exec(ctx, c.Host, "fake-attach", c.VolumeID, fmt.Sprint(c.Size))
+	if err != nil {
+		logger.Error("Attach fake volume failed", err)
+		return nil, err
+	}
+	path := strings.TrimSpace(out)
+	err = state.Save(c.Store, &state.Attachment{
+		ID:         c.AttachmentID(),
+		Protocol:   Protocol,
+		VolumeID:   c.VolumeID,
+		ConnInfo:   c.connInfo,
+		DevicePath: path,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"path": path, "type": "block"}, nil
+}
+
+// DisConnectVolume implements connectors.ConnProperties
+func (c *Connector) DisConnectVolume(ctx context.Context) error {
+	if _, err := utils.Exec(ctx, c.Host, "fake-detach", c.VolumeID); err != nil {
+		logger.Error("Detach fake volume failed", err)
+		return err
+	}
+	return state.Forget(c.Store, c.AttachmentID())
+}
+
+// ExtendVolume implements connectors.ConnProperties
+func (c *Connector) ExtendVolume(ctx context.Context) (int64, error) {
+	c.Host.mu.Lock()
+	var size int64 = -1
+	if v, ok := c.Host.volumes[c.VolumeID]; ok {
+		size = v.size
+	}
+	c.Host.mu.Unlock()
+	if size < 0 {
+		return -1, exception.Wrap(exception.ErrDeviceNotFound, nil, "volume %s is not attached", c.VolumeID)
+	}
+	err := state.Update(c.Store, c.AttachmentID(), func(a *state.Attachment) {
+		a.Size = size
+	})
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+// GetDevicePath implements connectors.ConnProperties
+func (c *Connector) GetDevicePath(ctx context.Context) string {
+	c.Host.mu.Lock()
+	defer c.Host.mu.Unlock()
+	if v, ok := c.Host.volumes[c.VolumeID]; ok {
+		return "/dev/" + v.device
+	}
+	return ""
+}
+
+// AttachmentID Return the id the attachment is recorded under
+func (c *Connector) AttachmentID() string {
+	return "fake:" + c.VolumeID
+}
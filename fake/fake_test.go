@@ -0,0 +1,875 @@
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/connectors"
+	"github.com/fightdou/os-brick-rbd/fake"
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/iscsi"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/rbd"
+)
+
+const (
+	gib     = int64(1 << 30)
+	iqn     = "iqn.2010-10.org.openstack:volume-1"
+	portal1 = "10.0.0.1:3260"
+	portal2 = "10.0.0.2:3260"
+)
+
+func rbdConnInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"name":          "volumes/volume-1",
+			"hosts":         []interface{}{"10.0.0.1"},
+			"ports":         []interface{}{"6789"},
+			"auth_enabled":  true,
+			"auth_username": "cinder",
+			"volume_id":     "1",
+		},
+	}
+}
+
+func iscsiConnInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"data": map[string]interface{}{
+			"target_portal":  portal1,
+			"target_iqn":     iqn,
+			"target_lun":     1,
+			"target_portals": []interface{}{portal1, portal2},
+			"target_iqns":    []interface{}{iqn, iqn},
+			"target_luns":    []interface{}{1, 1},
+			"volume_id":      "1",
+		},
+	}
+}
+
+func TestRBD(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	opts := append(host.Options(), connectors.WithRBDUnmapRetries(1, time.Millisecond))
+	conn, err := connectors.NewConnector("RBD", rbdConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/rbd/volumes/volume-1" {
+		t.Fatalf("Expected %s, got %v %v", "/dev/rbd/volumes/volume-1", res, err)
+	}
+	if !host.Root().Exists("/sys/bus/rbd/devices/0/pool") || !host.Root().Exists("/dev/rbd/volumes/volume-1") {
+		t.Error("Expected the mapping to show in sysfs and devfs")
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/rbd/volumes/volume-1" {
+		t.Errorf("Expected a repeated connect to return %s, got %v %v", "/dev/rbd/volumes/volume-1", res, err)
+	}
+	if err := host.ResizeImage("volumes", "volume-1", 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Errorf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+
+	// The first disconnect exhausts its retry, the second one succeeds on its retry
+	busy := fake.DeviceBusy()
+	busy.Count = 3
+	host.Inject(busy)
+	if err := conn.DisConnectVolume(ctx); !errors.Is(err, exception.ErrVolumeBusy) {
+		t.Errorf("Expected ErrVolumeBusy, got %v", err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 || host.Root().Exists("/dev/rbd0") {
+		t.Errorf("Expected the image to be unmapped, got %v", mapped)
+	}
+}
+
+func TestRBDTwoClusters(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	other := rbdConnInfo()
+	other["data"].(map[string]interface{})["hosts"] = []interface{}{"10.0.1.1"}
+	store := state.NewMemoryStore()
+	storeOpts := append(host.Options(), connectors.WithStateStore(store))
+
+	first, err := connectors.NewConnector("RBD", rbdConnInfo(), storeOpts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	second, err := connectors.NewConnector("RBD", other, storeOpts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res, err := first.ConnectVolume(ctx); err != nil || res["path"] != "/dev/rbd/volumes/volume-1" {
+		t.Fatalf("Expected /dev/rbd/volumes/volume-1, got %v %v", res, err)
+	}
+	// The image of the same name in the other cluster is not the one mapped,
+	// the udev link names either device so the devices are handed out
+	for i := 0; i < 2; i++ {
+		if res, err := second.ConnectVolume(ctx); err != nil || res["path"] != "/dev/rbd1" {
+			t.Fatalf("Expected /dev/rbd1, got %v %v", res, err)
+		}
+	}
+	if mapped := host.MappedImages(); len(mapped) != 2 {
+		t.Errorf("Expected the image of each cluster to be mapped, got %v", mapped)
+	}
+	if records, err := store.List(); err != nil || len(records) != 2 {
+		t.Errorf("Expected a record per cluster, got %+v %v", records, err)
+	}
+	if path := first.GetDevicePath(ctx); path != "/dev/rbd0" {
+		t.Errorf("Expected /dev/rbd0, got %q", path)
+	}
+	if err := first.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if host.Root().Exists("/dev/rbd0") || !host.Root().Exists("/dev/rbd1") {
+		t.Error("Expected only the device of the first cluster to be unmapped")
+	}
+	if records, err := store.List(); err != nil || len(records) != 1 || records[0].DevicePath != "/dev/rbd1" {
+		t.Errorf("Expected only the record of the other cluster left, got %+v %v", records, err)
+	}
+	if path := second.GetDevicePath(ctx); path != "/dev/rbd/volumes/volume-1" {
+		t.Errorf("Expected the udev link once the image is mapped once, got %q", path)
+	}
+	if err := second.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// rbd-nbd mappings are told apart by the monitors of their process
+	opts := append(host.Options(), connectors.WithRBDDeviceType(rbd.DeviceTypeNBD))
+	first, _ = connectors.NewConnector("RBD", rbdConnInfo(), opts...)
+	second, _ = connectors.NewConnector("RBD", other, opts...)
+	res, err := first.ConnectVolume(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if otherRes, err := second.ConnectVolume(ctx); err != nil || otherRes["path"] == res["path"] {
+		t.Errorf("Expected another nbd device than %s, got %v %v", res["path"], otherRes, err)
+	}
+	if err := first.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := second.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 {
+		t.Errorf("Expected the images to be unmapped, got %v", mapped)
+	}
+}
+
+func TestRBDAutoFallback(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	if err := host.SetImageFeatures("volumes", "volume-1", "layering", "journaling"); err != nil {
+		t.Fatal(err)
+	}
+	opts := append(host.Options(), connectors.WithRBDDeviceType(rbd.DeviceTypeAuto))
+	conn, err := connectors.NewConnector("RBD", rbdConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/nbd0" {
+		t.Fatalf("Expected krbd to fall back to /dev/nbd0, got %v %v", res, err)
+	}
+	calls := len(host.Commands())
+	if path := conn.GetDevicePath(ctx); path != "/dev/nbd0" {
+		t.Errorf("Expected /dev/nbd0, got %q", path)
+	}
+	if lines := host.CommandLines(); len(lines) != calls {
+		t.Errorf("Expected GetDevicePath not to run commands, got %v", lines[calls:])
+	}
+	if err := host.ResizeImage("volumes", "volume-1", 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Errorf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 || host.Root().Exists("/dev/nbd0") {
+		t.Errorf("Expected the image to be unmapped, got %v", mapped)
+	}
+
+	krbd, err := connectors.NewConnector("RBD", rbdConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, err = krbd.ConnectVolume(ctx)
+	var featureErr *rbd.UnsupportedFeaturesError
+	if !errors.As(err, &featureErr) || !errors.Is(err, exception.ErrUnsupportedFeature) || !reflect.DeepEqual(featureErr.Features, []string{"journaling"}) {
+		t.Errorf("Expected krbd to refuse journaling, got %v", err)
+	}
+
+	// Kernels older than 4.11 do not report their features, auto mode then
+	// falls back once rbd map fails
+	if err := host.Root().Remove("/sys/bus/rbd/supported_features"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || !strings.HasPrefix(res["path"], "/dev/nbd") {
+		t.Fatalf("Expected krbd to fall back to rbd-nbd, got %v %v", res, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := krbd.ConnectVolume(ctx); !errors.Is(err, exception.ErrDeviceNotFound) {
+		t.Errorf("Expected krbd to refuse the image, got %v", err)
+	}
+}
+
+func TestRBDFeatureRemediation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	if err := host.SetImageFeatures("volumes", "volume-1", "layering", "exclusive-lock", "journaling"); err != nil {
+		t.Fatal(err)
+	}
+	opts := append(host.Options(), connectors.WithRBDFeatureRemediation(rbd.FeatureRemediationNBD))
+	conn, err := connectors.NewConnector("RBD", rbdConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/nbd0" {
+		t.Fatalf("Expected the image to be mapped with rbd-nbd, got %v %v", res, err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/nbd0" {
+		t.Errorf("Expected a repeated connect to return /dev/nbd0, got %v %v", res, err)
+	}
+	if path := conn.GetDevicePath(ctx); path != "/dev/nbd0" {
+		t.Errorf("Expected /dev/nbd0, got %q", path)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 {
+		t.Errorf("Expected the nbd mapping to be removed, got %v", mapped)
+	}
+
+	// Without the remediation option the attachment record tells the image
+	// was mapped with rbd-nbd
+	store := state.NewMemoryStore()
+	conn, _ = connectors.NewConnector("RBD", rbdConnInfo(), append(opts, connectors.WithStateStore(store))...)
+	if res, err := conn.ConnectVolume(ctx); err != nil || !strings.HasPrefix(res["path"], "/dev/nbd") {
+		t.Fatalf("Expected the image to be mapped with rbd-nbd, got %v %v", res, err)
+	}
+	conn, _ = connectors.NewConnector("RBD", rbdConnInfo(), append(host.Options(), connectors.WithStateStore(store))...)
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 {
+		t.Errorf("Expected the recorded nbd mapping to be removed, got %v", mapped)
+	}
+
+	opts = append(host.Options(), connectors.WithRBDFeatureRemediation(rbd.FeatureRemediationDisable))
+	conn, err = connectors.NewConnector("RBD", rbdConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/rbd/volumes/volume-1" {
+		t.Fatalf("Expected journaling to be disabled and the image mapped, got %v %v", res, err)
+	}
+	found := false
+	for _, line := range host.CommandLines() {
+		found = found || strings.HasPrefix(line, "rbd feature disable volumes/volume-1 journaling ")
+	}
+	if !found {
+		t.Errorf("Expected journaling to be disabled, got %v", host.CommandLines())
+	}
+
+	if _, err := connectors.NewConnector("RBD", rbdConnInfo(), connectors.WithRBDFeatureRemediation("upgrade")); !errors.Is(err, exception.ErrInvalidConnInfo) {
+		t.Errorf("Expected an unknown remediation to be rejected, got %v", err)
+	}
+}
+
+func TestRBDRemote(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	connInfo := rbdConnInfo()
+	connInfo["do_local_attach"] = false
+	conn, err := connectors.NewConnector("RBD", connInfo, host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["pool"] != "volumes" || res["image"] != "volume-1" || res["hosts"] != "10.0.0.1" {
+		t.Fatalf("Unexpected descriptor %v %v", res, err)
+	}
+	if mapped := host.MappedImages(); len(mapped) != 0 {
+		t.Errorf("Expected nothing to be mapped, got %v", mapped)
+	}
+	if err := host.ResizeImage("volumes", "volume-1", 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Errorf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestRBDNamespaceAndSnapshot(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddImage("volumes", "volume-1", gib)
+	host.AddImage("volumes", "tenant/volume-1", 2*gib)
+	if err := host.AddSnapshot("volumes", "volume-1", "backup"); err != nil {
+		t.Fatal(err)
+	}
+	devices := map[string]string{}
+	for _, name := range []string{"volumes/volume-1", "volumes/tenant/volume-1", "volumes/volume-1@backup"} {
+		connInfo := rbdConnInfo()
+		connInfo["data"].(map[string]interface{})["name"] = name
+		conn, err := connectors.NewConnector("RBD", connInfo, host.Options()...)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		res, err := conn.ConnectVolume(ctx)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+		devices[name] = res["path"]
+		if path := conn.GetDevicePath(ctx); path != res["path"] {
+			t.Errorf("%s: expected %s, got %q", name, res["path"], path)
+		}
+	}
+	expected := map[string]string{
+		"volumes/volume-1":        "/dev/rbd/volumes/volume-1",
+		"volumes/tenant/volume-1": "/dev/rbd/volumes/tenant/volume-1",
+		"volumes/volume-1@backup": "/dev/rbd/volumes/volume-1@backup",
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("Unexpected devices %v", devices)
+	}
+	lines := host.CommandLines()
+	snapMap := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "rbd map volume-1 --pool volumes --snap backup") && strings.Contains(line, "-o ro ") {
+			snapMap = true
+		}
+	}
+	if !snapMap {
+		t.Errorf("Expected the snapshot to be mapped read-only, got %v", lines)
+	}
+
+	connInfo := rbdConnInfo()
+	connInfo["data"].(map[string]interface{})["name"] = "volumes/volume-1@backup"
+	conn, err := connectors.NewConnector("RBD", connInfo, host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != gib {
+		t.Errorf("Expected the snapshot size %d, got %d %v", gib, size, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	mapped := host.MappedImages()
+	if !reflect.DeepEqual(mapped, []string{"volumes/tenant/volume-1", "volumes/volume-1"}) {
+		t.Errorf("Expected only the snapshot to be unmapped, got %v", mapped)
+	}
+}
+
+func TestRBDMissingImage(t *testing.T) {
+	t.Parallel()
+	host := fake.NewHost(t)
+	conn, err := connectors.NewConnector("RBD", rbdConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := conn.ConnectVolume(context.Background()); !errors.Is(err, exception.ErrDeviceNotFound) {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+}
+
+func TestISCSIMultipath(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/dm-0" {
+		t.Fatalf("Expected /dev/dm-0, got %v %v", res, err)
+	}
+	expected := []string{portal1 + " " + iqn, portal2 + " " + iqn}
+	if sessions := host.Sessions(); !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+	if err := host.ResizeLUN(iqn, 1, 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Errorf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+	if sectors, err := host.Root().ReadString("/sys/block/dm-0/size"); err != nil || sectors != fmt.Sprint(2*gib/512) {
+		t.Errorf("Expected multipathd to resize dm-0, got %s sectors %v", sectors, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+	for _, p := range []string{"/dev/dm-0", "/dev/sda", "/dev/sdb"} {
+		if host.Root().Exists(p) {
+			t.Errorf("Expected %s to be removed", p)
+		}
+	}
+}
+
+func TestISCSIFaults(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		fault    fake.Fault
+		minPaths int
+		err      error
+	}{
+		{fake.LoginTimeout(portal1), 2, exception.ErrTargetUnreachable},
+		{fake.MissingDMHolder(), 1, exception.ErrDeviceNotFound},
+	}
+	for _, c := range cases {
+		host := fake.NewHost(t)
+		host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+		host.Inject(c.fault)
+		opts := append(host.Options(), connectors.WithISCSIMinPaths(c.minPaths), connectors.WithISCSIMultipathTimeout(time.Millisecond))
+		conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), opts...)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if _, err := conn.ConnectVolume(context.Background()); !errors.Is(err, c.err) {
+			t.Errorf("Expected %v with fault %+v, got %v", c.err, c.fault, err)
+		}
+		if sessions := host.Sessions(); len(sessions) != 0 {
+			t.Errorf("Expected the sessions to be rolled back with fault %+v, got %v", c.fault, sessions)
+		}
+	}
+}
+
+func TestISCSIExtendRetry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/dm-0" {
+		t.Fatalf("Expected /dev/dm-0, got %v %v", res, err)
+	}
+	if err := host.ResizeLUN(iqn, 1, 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	// The paths take the new size but the map cannot be resized
+	host.SetMultipathd(false)
+	if _, err := conn.ExtendVolume(ctx); err == nil {
+		t.Fatalf("Expected the extend to fail without multipathd")
+	}
+	host.SetMultipathd(true)
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Fatalf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+	lines := host.CommandLines()
+	if last := lines[len(lines)-1]; last != "multipathd resize map dm-0" {
+		t.Errorf("Expected the retry to resize the map, got %v", lines)
+	}
+	if sectors, err := host.Root().ReadString("/sys/block/dm-0/size"); err != nil || sectors != fmt.Sprint(2*gib/512) {
+		t.Errorf("Expected multipathd to resize dm-0, got %s sectors %v", sectors, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestISCSIPartialPaths(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	host.Inject(fake.LoginTimeout(portal1))
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/dm-0" || res["failed_portals"] != portal1 {
+		t.Fatalf("Expected /dev/dm-0 without %s, got %v %v", portal1, res, err)
+	}
+	if sessions := host.Sessions(); !reflect.DeepEqual(sessions, []string{portal2 + " " + iqn}) {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+}
+
+func TestISCSIHungPortal(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	host.Inject(fake.LoginHang(portal1))
+	opts := append(host.Options(), connectors.WithISCSIMultipathTimeout(100*time.Millisecond))
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/dm-0" || res["failed_portals"] != portal1 {
+		t.Fatalf("Expected /dev/dm-0 without %s, got %v %v", portal1, res, err)
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Attach waited for the hung login")
+	}
+	if sessions := host.Sessions(); !reflect.DeepEqual(sessions, []string{portal2 + " " + iqn}) {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+}
+
+func TestISCSICancelledAttach(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	host.Inject(fake.LoginHang(portal1))
+	opts := append(host.Options(), connectors.WithISCSIMinPaths(2))
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// Cancel the attach once it waits on the hung login with the other path up
+	go func() {
+		for len(host.Sessions()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	if _, err := conn.ConnectVolume(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected the opened session to be logged out, got %v", sessions)
+	}
+	logout := "iscsiadm -m node -T " + iqn + " -p " + portal2 + " --logout"
+	found := false
+	for _, line := range host.CommandLines() {
+		if strings.HasPrefix(line, logout) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected %q, got %v", logout, host.CommandLines())
+	}
+}
+
+func TestISCSIMultipathReconcile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	store := state.NewMemoryStore()
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), append(host.Options(), connectors.WithStateStore(store))...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res, err := conn.ConnectVolume(ctx); err != nil || res["path"] != "/dev/dm-0" {
+		t.Fatalf("Expected /dev/dm-0, got %v %v", res, err)
+	}
+	if path := conn.GetDevicePath(ctx); path != "/dev/dm-0" {
+		t.Errorf("Expected /dev/dm-0, got %q", path)
+	}
+	report, err := connectors.Reconcile(ctx, store, true, host.Options()...)
+	if err != nil || len(report.Attached) != 1 || report.Attached[0].DevicePath != "/dev/dm-0" {
+		t.Errorf("Unexpected reconcile report %+v %v", report, err)
+	}
+	if records, _ := store.List(); len(records) != 1 || records[0].DevicePath != "/dev/dm-0" {
+		t.Errorf("Expected the multipath device to stay recorded, got %+v", records)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestISCSICHAP(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	auth := fake.CHAP{Username: "user", Password: "secret", UsernameIn: "target", PasswordIn: "target-secret"}
+	if err := host.RequireCHAP(iqn, auth); err != nil {
+		t.Fatal(err)
+	}
+	host.RequireDiscoveryCHAP(portal1, fake.CHAP{Username: "discovery", Password: "discovery-secret"})
+
+	connInfo := iscsiConnInfo()
+	data := connInfo["data"].(map[string]interface{})
+	delete(data, "target_portals")
+	delete(data, "target_iqns")
+	delete(data, "target_luns")
+	data["auth_method"] = "CHAP"
+	data["auth_username"] = "user"
+	data["auth_password"] = "wrong"
+	data["auth_username_in"] = "target"
+	data["auth_password_in"] = "target-secret"
+	conn, err := connectors.NewConnector("ISCSI", connInfo, host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := conn.ConnectVolume(ctx); !errors.Is(err, exception.ErrAuthFailed) {
+		t.Errorf("Expected discovery to fail without discovery CHAP, got %v", err)
+	}
+
+	data["discovery_auth_method"] = "CHAP"
+	data["discovery_auth_username"] = "discovery"
+	data["discovery_auth_password"] = "discovery-secret"
+	conn, _ = connectors.NewConnector("ISCSI", connInfo, host.Options()...)
+	if _, err := conn.ConnectVolume(ctx); !errors.Is(err, exception.ErrAuthFailed) {
+		t.Errorf("Expected the login to fail with a wrong password, got %v", err)
+	}
+
+	data["auth_password"] = "secret"
+	conn, _ = connectors.NewConnector("ISCSI", connInfo, host.Options()...)
+	host.Inject(fake.Fault{Match: "iscsiadm --op update -n node.session.auth.password", ExitCode: 7, Count: 1})
+	_, err = conn.ConnectVolume(ctx)
+	if !errors.Is(err, exception.ErrCommandFailed) || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected the failed update to be returned with the password masked, got %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] == "" {
+		t.Fatalf("Expected a device, got %v %v", res, err)
+	}
+	if sessions := host.Sessions(); !reflect.DeepEqual(sessions, []string{portal1 + " " + iqn}) {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestISCSISharedTarget(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib, 2: 2 * gib})
+	second := iscsiConnInfo()
+	data := second["data"].(map[string]interface{})
+	data["volume_id"] = "2"
+	data["target_lun"] = 2
+	data["target_luns"] = []interface{}{2, 2}
+	var conns []connectors.ConnProperties
+	var paths []string
+	for _, connInfo := range []map[string]interface{}{iscsiConnInfo(), second} {
+		conn, err := connectors.NewConnector("ISCSI", connInfo, host.Options()...)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		res, err := conn.ConnectVolume(ctx)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		conns = append(conns, conn)
+		paths = append(paths, res["path"])
+	}
+	if paths[0] == paths[1] {
+		t.Fatalf("Expected a device per LUN, got %v", paths)
+	}
+	if err := conns[0].DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []string{portal1 + " " + iqn, portal2 + " " + iqn}
+	if sessions := host.Sessions(); !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("Expected the sessions to stay for LUN 2, got %v", sessions)
+	}
+	if host.Root().Exists(paths[0]) || !host.Root().Exists(paths[1]) {
+		t.Errorf("Expected only %s to be removed", paths[0])
+	}
+	if err := conns[1].DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+}
+
+func TestISER(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	conn, err := connectors.NewConnector("ISER", iscsiConnInfo(), host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := conn.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	sessions, err := iscsi.GetSessions(ctx, host)
+	if err != nil || len(sessions) != 2 || sessions[0].Transport != "iser" || sessions[1].Transport != "iser" {
+		t.Errorf("Expected two iser sessions, got %+v %v", sessions, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+
+	connInfo := iscsiConnInfo()
+	connInfo["driver_volume_type"] = "iser"
+	conn, _ = connectors.NewConnector("ISCSI", connInfo, host.Options()...)
+	if _, err := conn.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions, err := iscsi.GetSessions(ctx, host); err != nil || len(sessions) != 2 || sessions[0].Transport != "iser" {
+		t.Errorf("Expected iser sessions for an iser volume, got %+v %v", sessions, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestISERReconcile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	store := state.NewMemoryStore()
+	conn, err := connectors.NewConnector("ISER", iscsiConnInfo(), append(host.Options(), connectors.WithStateStore(store))...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := conn.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	records, err := store.List()
+	if err != nil || len(records) != 1 || records[0].Protocol != "ISER" {
+		t.Fatalf("Expected an ISER record, got %+v %v", records, err)
+	}
+	report, err := connectors.Reconcile(ctx, store, true, host.Options()...)
+	if err != nil || len(report.Attached) != 1 || len(report.Stale) != 0 {
+		t.Errorf("Unexpected reconcile report %+v %v", report, err)
+	}
+	// The record rebuilds an iser connector, which logs out of the iser sessions
+	rebuilt, err := connectors.NewConnector(records[0].Protocol, records[0].ConnInfo, host.Options()...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := rebuilt.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+}
+
+func TestISCSIIface(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	host.AddTarget(iqn, []string{portal1, portal2}, map[int]int64{1: gib})
+	host.AddIface("storage0", "tcp", "eth1")
+	opts := append(host.Options(), connectors.WithISCSIIface("storage0"))
+	conn, err := connectors.NewConnector("ISCSI", iscsiConnInfo(), opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := conn.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	logins := 0
+	for _, line := range host.CommandLines() {
+		if strings.Contains(line, "--login") {
+			logins++
+			if !strings.Contains(line, "-I storage0") {
+				t.Errorf("Expected the login to be bound to storage0, got %s", line)
+			}
+		}
+	}
+	if logins != 2 {
+		t.Errorf("Expected 2 logins, got %d", logins)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if sessions := host.Sessions(); len(sessions) != 0 {
+		t.Errorf("Expected no session left, got %v", sessions)
+	}
+
+	conn, _ = connectors.NewConnector("ISER", iscsiConnInfo(), opts...)
+	if _, err := conn.ConnectVolume(ctx); !errors.Is(err, exception.ErrInvalidConnInfo) {
+		t.Errorf("Expected ErrInvalidConnInfo for a tcp iface with iser, got %v", err)
+	}
+	conn, _ = connectors.NewConnector("ISCSI", iscsiConnInfo(), append(host.Options(), connectors.WithISCSIIface("missing"))...)
+	if _, err := conn.ConnectVolume(ctx); err == nil {
+		t.Error("Expected an error for a missing iface")
+	}
+}
+
+func TestFakeProtocol(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	host := fake.NewHost(t)
+	store := state.NewMemoryStore()
+	connInfo := map[string]interface{}{"data": map[string]interface{}{"volume_id": "volume-1", "size": gib}}
+	opts := append(host.Options(), connectors.WithStateStore(store))
+	conn, err := connectors.NewConnector("fake", connInfo, opts...)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	res, err := conn.ConnectVolume(ctx)
+	if err != nil || res["path"] != "/dev/vda" {
+		t.Fatalf("Expected /dev/vda, got %v %v", res, err)
+	}
+	if err := host.ResizeVolume("volume-1", 2*gib); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := conn.ExtendVolume(ctx); err != nil || size != 2*gib {
+		t.Errorf("Expected size %d, got %d %v", 2*gib, size, err)
+	}
+	report, err := connectors.Reconcile(ctx, store, false, host.Options()...)
+	if err != nil || len(report.Attached) != 1 || report.Attached[0].Size != 2*gib {
+		t.Errorf("Unexpected reconcile report %+v %v", report, err)
+	}
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if path := conn.GetDevicePath(ctx); path != "" {
+		t.Errorf("Expected no device after disconnect, got %s", path)
+	}
+	if _, err := connectors.NewConnector("FAKE", map[string]interface{}{"data": map[string]interface{}{}}); !errors.Is(err, exception.ErrInvalidConnInfo) {
+		t.Errorf("Expected ErrInvalidConnInfo, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package fake
+
+import (
+	"strings"
+)
+
+// Fault makes the commands it matches fail
+type Fault struct {
+	// Match selects the commands, every word of it must appear in the
+	// command line in the same order
+	Match string
+	// ExitCode, Stdout and Stderr are the result of the failed command
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	// Count is how many commands fail, zero fails every matching command
+	Count int
+
+	// noHolder lets the command succeed without building dm devices
+	noHolder bool
+	fired    int
+
+	// hang blocks the command until its context is done
+	hang bool
+}
+
+// LoginTimeout Fail the iscsi logins to portal, every portal when it is empty,
+// the way iscsiadm reports an unreachable target
+func LoginTimeout(portal string) Fault {
+	return Fault{
+		Match:    strings.TrimSpace("iscsiadm -m node -p " + portal + " --login"),
+		ExitCode: 8,
+		Stderr:   "iscsiadm: Could not login to [iface: default, portal: " + portal + "].\niscsiadm: initiator reported error (8 - connection timed out)",
+	}
+}
+
+// LoginHang Block the iscsi logins to portal until they are cancelled, the
+// way iscsiadm waits on a portal which drops the packets
+func LoginHang(portal string) Fault {
+	return Fault{Match: "iscsiadm -m node -p " + portal + " --login", hang: true}
+}
+
+// DeviceBusy Fail rbd unmap the way the kernel reports an open device
+func DeviceBusy() Fault {
+	return Fault{
+		Match:    "rbd unmap",
+		ExitCode: 16,
+		Stderr:   "rbd: sysfs write failed\nrbd: unmap failed: (16) Device or resource busy",
+	}
+}
+
+// MissingDMHolder Let the iscsi logins succeed without multipathd building
+// a dm device over the new disks
+func MissingDMHolder() Fault {
+	return Fault{Match: "iscsiadm --login", noHolder: true}
+}
+
+// matches Check the fault applies to a command line
+func (f *Fault) matches(line string) bool {
+	if f.Count > 0 && f.fired >= f.Count {
+		return false
+	}
+	words := strings.Fields(line)
+	i := 0
+	for _, want := range strings.Fields(f.Match) {
+		for i < len(words) && words[i] != want {
+			i++
+		}
+		if i == len(words) {
+			return false
+		}
+		i++
+	}
+	return true
+}
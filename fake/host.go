@@ -0,0 +1,529 @@
+// Package fake simulates a storage node for tests which can not run on a
+// real one. A Host runs the rbd, iscsiadm, multipath, multipathd, blockdev
+// and tee commands of the connectors against an in-memory model of the
+// ceph cluster and iscsi targets, and keeps a fake sysfs and devfs tree in
+// sync with it. Connectors use a Host as their executor and its root:
+//
+//	host := fake.NewHost(t)
+//	conn, err := connectors.NewConnector("RBD", connInfo, host.Options()...)
+package fake
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+)
+
+// Host is a fake storage node, it implements utils.Executor
+type Host struct {
+	tree *sysfstest.Tree
+
+	mu       sync.Mutex
+	images   map[string]*image
+	mapped   map[int]*mapping
+	nbds     map[int]*mapping
+	targets  map[string]*target
+	nodes    map[string]map[string]string
+	sessions map[int]*session
+	dms      map[string]*multipathDevice
+	volumes  map[string]*volume
+	faults   []*Fault
+	commands []utils.Command
+	// multipathd tells whether multipathd runs and builds dm devices over the iscsi disks
+	multipathd bool
+	nextID     map[string]int
+	// discoverydb are the discovery records by portal
+	discoverydb map[string]map[string]string
+	// discoveryAuth are the CHAP credentials the portals require for discovery
+	discoveryAuth map[string]CHAP
+	// ifaces are the iscsiadm ifaces by name
+	ifaces map[string]iface
+}
+
+// image is an rbd image of the fake cluster
+type image struct {
+	pool      string
+	namespace string
+	name      string
+	size      int64
+	features  []string
+	// snaps are the sizes of the snapshots by name
+	snaps map[string]int64
+}
+
+// spec Return the pool[/namespace]/image form of the image
+func (img *image) spec() string {
+	return path.Join(img.pool, img.namespace, img.name)
+}
+
+// mapping is an rbd image or snapshot mapped by the kernel or rbd-nbd
+type mapping struct {
+	id    int
+	image *image
+	snap  string
+}
+
+// spec Return the pool[/namespace]/image[@snap] form of the mapping
+func (m *mapping) spec() string {
+	if m.snap == "" {
+		return m.image.spec()
+	}
+	return m.image.spec() + "@" + m.snap
+}
+
+// size Return the size of the mapped image or snapshot
+func (m *mapping) size() int64 {
+	if m.snap == "" {
+		return m.image.size
+	}
+	return m.image.snaps[m.snap]
+}
+
+// target is an iscsi target and the luns it exports
+type target struct {
+	iqn     string
+	portals []string
+	luns    map[int]int64
+	// auth are the CHAP credentials the target requires for login, nil
+	// when it accepts any initiator
+	auth *CHAP
+}
+
+// CHAP are the credentials a target or portal requires
+type CHAP struct {
+	Username string
+	Password string
+	// UsernameIn and PasswordIn are the credentials of the target, the
+	// initiator must expect them for mutual CHAP
+	UsernameIn string
+	PasswordIn string
+}
+
+// session is a logged in iscsi session
+type session struct {
+	id     int
+	host   int
+	portal string
+	iqn    string
+	disks  map[int]string
+	// iface is the iface the session is bound to and transport the one of the iface
+	iface     string
+	transport string
+}
+
+// iface is an iscsiadm iface record
+type iface struct {
+	transport string
+	netIface  string
+}
+
+// multipathDevice is a dm device over the disks of the luns of a target
+type multipathDevice struct {
+	name   string
+	alias  string
+	slaves []string
+}
+
+// NewHost Build an empty host in a temporary directory removed when the test ends
+func NewHost(t testing.TB) *Host {
+	t.Helper()
+	h, err := NewHostAt(t.TempDir())
+	if err != nil {
+		t.Fatalf("build fake host: %v", err)
+	}
+	return h
+}
+
+// NewHostAt Build an empty host whose sysfs and devfs tree is in dir
+func NewHostAt(dir string) (*Host, error) {
+	tree, err := sysfstest.Build(dir, sysfstest.Layout{
+		Files: map[string]string{"/sys/bus/rbd/supported_features": krbdSupportedFeatures},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Host{
+		tree:       tree,
+		images:     map[string]*image{},
+		mapped:     map[int]*mapping{},
+		nbds:       map[int]*mapping{},
+		targets:    map[string]*target{},
+		nodes:      map[string]map[string]string{},
+		sessions:   map[int]*session{},
+		dms:        map[string]*multipathDevice{},
+		volumes:    map[string]*volume{},
+		multipathd: true,
+		nextID:     map[string]int{"session": 1},
+
+		discoverydb:   map[string]map[string]string{},
+		discoveryAuth: map[string]CHAP{},
+		ifaces: map[string]iface{
+			defaultIface: {transport: "tcp", netIface: "default"},
+			"iser":       {transport: "iser", netIface: "default"},
+		},
+	}, nil
+}
+
+// Root Return the root of the sysfs and devfs tree of the host
+func (h *Host) Root() sysfs.Root {
+	return h.tree.Root
+}
+
+// Tree Return the sysfs and devfs tree of the host
+func (h *Host) Tree() *sysfstest.Tree {
+	return h.tree
+}
+
+// AddImage Create an rbd image in the fake cluster, name is image or
+// namespace/image for an image in a rados namespace
+func (h *Host) AddImage(pool, name string, size int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	img := &image{pool: pool, name: name, size: size, features: []string{"layering"}, snaps: map[string]int64{}}
+	if i := strings.Index(name, "/"); i >= 0 {
+		img.namespace, img.name = name[:i], name[i+1:]
+	}
+	h.images[pool+"/"+name] = img
+}
+
+// AddSnapshot Snapshot an rbd image at its current size
+func (h *Host) AddSnapshot(pool, name, snap string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	img, ok := h.images[pool+"/"+name]
+	if !ok {
+		return fmt.Errorf("no image %s/%s", pool, name)
+	}
+	img.snaps[snap] = img.size
+	return nil
+}
+
+// SetImageFeatures Set the features of an rbd image, krbd refuses to map
+// images with the journaling feature
+func (h *Host) SetImageFeatures(pool, name string, features ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	img, ok := h.images[pool+"/"+name]
+	if !ok {
+		return fmt.Errorf("no image %s/%s", pool, name)
+	}
+	img.features = features
+	return nil
+}
+
+// ResizeImage Change the size of an rbd image, mapped devices see the new size
+func (h *Host) ResizeImage(pool, name string, size int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	img, ok := h.images[pool+"/"+name]
+	if !ok {
+		return fmt.Errorf("no image %s/%s", pool, name)
+	}
+	img.size = size
+	for _, m := range h.mapped {
+		if m.image == img && m.snap == "" {
+			if err := h.tree.SetSize(fmt.Sprintf("rbd%d", m.id), size); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range h.nbds {
+		if m.image == img && m.snap == "" {
+			// rbd-nbd watches the image header and resizes the device
+			if err := h.tree.SetSize(fmt.Sprintf("nbd%d", m.id), size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddTarget Export luns, by number with their size in bytes, through an iscsi target reachable on portals
+func (h *Host) AddTarget(iqn string, portals []string, luns map[int]int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := &target{iqn: iqn, portals: portals, luns: map[int]int64{}}
+	for lun, size := range luns {
+		t.luns[lun] = size
+	}
+	h.targets[iqn] = t
+}
+
+// RequireCHAP Make the logins to a target fail unless the node records the
+// credentials of auth
+func (h *Host) RequireCHAP(iqn string, auth CHAP) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.targets[iqn]
+	if !ok {
+		return fmt.Errorf("no target %s", iqn)
+	}
+	t.auth = &auth
+	return nil
+}
+
+// AddIface Create an iscsiadm iface using transport, bound to the NIC netIface
+func (h *Host) AddIface(name, transport, netIface string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ifaces[name] = iface{transport: transport, netIface: netIface}
+}
+
+// RequireDiscoveryCHAP Make sendtargets discovery on portal fail unless
+// the discovery record of the portal holds the credentials of auth
+func (h *Host) RequireDiscoveryCHAP(portal string, auth CHAP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.discoveryAuth[portal] = auth
+}
+
+// ResizeLUN Change the size of a lun of a target, the disks of the lun see
+// the new size once they are rescanned and the dm device once multipathd resizes it
+func (h *Host) ResizeLUN(iqn string, lun int, size int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.targets[iqn]
+	if !ok {
+		return fmt.Errorf("no target %s", iqn)
+	}
+	if _, ok := t.luns[lun]; !ok {
+		return fmt.Errorf("no lun %d in target %s", lun, iqn)
+	}
+	t.luns[lun] = size
+	return nil
+}
+
+// SetMultipathd Start or stop the fake multipathd, dm devices are only built while it runs
+func (h *Host) SetMultipathd(running bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.multipathd = running
+}
+
+// Inject Add a fault, faults are checked in the order they were added
+func (h *Host) Inject(f Fault) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.faults = append(h.faults, &f)
+}
+
+// Commands Return the commands run so far
+func (h *Host) Commands() []utils.Command {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]utils.Command(nil), h.commands...)
+}
+
+// CommandLines Return the commands run so far as command lines
+func (h *Host) CommandLines() []string {
+	var lines []string
+	for _, cmd := range h.Commands() {
+		lines = append(lines, cmd.String())
+	}
+	return lines
+}
+
+// Sessions Return the portal and iqn of the logged in iscsi sessions
+func (h *Host) Sessions() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var res []string
+	for _, s := range h.sessions {
+		res = append(res, s.portal+" "+s.iqn)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// MappedImages Return the pool[/namespace]/image[@snap] of the mapped rbd images
+func (h *Host) MappedImages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var res []string
+	for _, m := range h.mapped {
+		res = append(res, m.spec())
+	}
+	for _, m := range h.nbds {
+		res = append(res, m.spec()+" (nbd)")
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Run implements utils.Executor
+func (h *Host) Run(ctx context.Context, cmd utils.Command) (utils.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return utils.Result{ExitCode: -1}, exception.NewCommandError(cmd.Argv(), "", "", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.commands = append(h.commands, cmd)
+	line := cmd.String()
+	var skipHolder bool
+	for _, f := range h.faults {
+		if !f.matches(line) {
+			continue
+		}
+		f.fired++
+		if f.noHolder {
+			skipHolder = true
+			continue
+		}
+		if f.hang {
+			h.mu.Unlock()
+			<-ctx.Done()
+			h.mu.Lock()
+			return utils.Result{ExitCode: -1}, exception.NewCommandError(cmd.Argv(), "", "", ctx.Err())
+		}
+		return h.fail(cmd, f.ExitCode, f.Stdout, f.Stderr)
+	}
+	var (
+		stdout string
+		code   int
+		stderr string
+	)
+	switch cmd.Name {
+	case "which":
+		if len(cmd.Args) == 0 {
+			return h.fail(cmd, 1, "", "")
+		}
+		stdout = "/usr/bin/" + cmd.Args[0] + "\n"
+	case "rbd":
+		stdout, stderr, code = h.rbd(cmd.Args)
+	case "rbd-nbd":
+		stdout, stderr, code = h.rbdNbd(cmd.Args)
+	case "iscsiadm":
+		stdout, stderr, code = h.iscsiadm(cmd.Args, skipHolder)
+	case "multipath":
+		stdout, stderr, code = h.multipath(cmd.Args)
+	case "multipathd":
+		stdout, stderr, code = h.multipathdCmd(cmd.Args)
+	case "blockdev":
+		stdout, stderr, code = h.blockdev(cmd.Args)
+	case "fake-attach":
+		stdout, stderr, code = h.attach(cmd.Args)
+	case "fake-detach":
+		stdout, stderr, code = h.detach(cmd.Args)
+	case "tee":
+		stderr, code = h.tee(cmd.Args, cmd.Stdin)
+		stdout = cmd.Stdin
+	default:
+		return h.fail(cmd, 127, "", cmd.Name+": command not found")
+	}
+	if code != 0 {
+		return h.fail(cmd, code, stdout, stderr)
+	}
+	return utils.Result{Stdout: stdout, Stderr: stderr}, nil
+}
+
+// fail Return the result and error of a command exiting with code
+func (h *Host) fail(cmd utils.Command, code int, stdout, stderr string) (utils.Result, error) {
+	err := exception.NewCommandError(cmd.Argv(), stdout, stderr, fmt.Errorf("exit status %d", code))
+	err.ExitCode = code
+	if code == 127 {
+		err.Reason = exception.ErrCommandNotFound
+	}
+	return utils.Result{Stdout: stdout, Stderr: stderr, ExitCode: code}, err
+}
+
+// allocate Return the next free number of a kind of object
+func (h *Host) allocate(kind string, used func(int) bool) int {
+	n := h.nextID[kind]
+	for used(n) {
+		n++
+	}
+	h.nextID[kind] = n + 1
+	return n
+}
+
+// diskName Return the kernel name of the n-th scsi disk: sda, ..., sdz, sdaa, ...
+func diskName(n int) string {
+	return "sd" + letters(n)
+}
+
+// letters Return the n-th disk suffix: a, ..., z, aa, ...
+func letters(n int) string {
+	name := ""
+	for n >= 0 {
+		name = string(rune('a'+n%26)) + name
+		n = n/26 - 1
+	}
+	return name
+}
+
+// tee Write stdin to a file of the tree, a write to the delete file of a
+// scsi disk removes it as the kernel does
+func (h *Host) tee(args []string, content string) (string, int) {
+	if len(args) == 0 {
+		return "tee: missing file operand", 1
+	}
+	path := h.tree.Root.Logical(args[len(args)-1])
+	if path == args[len(args)-1] {
+		return fmt.Sprintf("tee: %s: outside the fake host", path), 1
+	}
+	if !h.tree.Root.Exists(path) {
+		return fmt.Sprintf("tee: %s: No such file or directory", path), 1
+	}
+	if strings.HasPrefix(path, "/sys/block/") && strings.HasSuffix(path, "/device/delete") {
+		device := strings.Split(path, "/")[3]
+		h.removeDisk(device)
+		return "", 0
+	}
+	if strings.HasPrefix(path, "/sys/block/") && strings.HasSuffix(path, "/device/rescan") {
+		if err := h.rescanDisk(strings.Split(path, "/")[3]); err != nil {
+			return err.Error(), 1
+		}
+		return "", 0
+	}
+	if strings.HasPrefix(path, "/sys/") {
+		// sysfs attributes such as scan and rescan are triggers
+		return "", 0
+	}
+	f, err := os.OpenFile(h.tree.Root.Path(path), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err.Error(), 1
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		return err.Error(), 1
+	}
+	return "", 0
+}
+
+// blockdev Simulate blockdev --flushbufs and --getsize64
+func (h *Host) blockdev(args []string) (string, string, int) {
+	if len(args) != 2 {
+		return "", "blockdev: unexpected arguments", 1
+	}
+	device := args[1]
+	if !h.tree.Root.Exists(device) {
+		return "", fmt.Sprintf("blockdev: cannot open %s: No such file or directory", device), 1
+	}
+	switch args[0] {
+	case "--flushbufs":
+		return "", "", 0
+	case "--getsize64":
+		name, err := h.tree.Root.EvalSymlinks(device)
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		sectors, err := h.tree.Root.ReadString("/sys/block/" + strings.TrimPrefix(name, "/dev/") + "/size")
+		if err != nil {
+			return "", err.Error(), 1
+		}
+		var n int64
+		fmt.Sscan(sectors, &n)
+		return fmt.Sprintf("%d\n", n*512), "", 0
+	}
+	return "", "blockdev: unknown option " + args[0], 1
+}
@@ -0,0 +1,378 @@
+package fake
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
+)
+
+// iscsiadm exit codes, see include/iscsi_err.h in open-iscsi
+const (
+	iscsiErrTrans       = 4
+	iscsiErrSessExists  = 15
+	iscsiErrNoObjsFound = 21
+	iscsiErrInvalid     = 7
+	iscsiErrAuthFailed  = 24
+)
+
+// iscsiadmValueFlags are the iscsiadm options which take a value
+var iscsiadmValueFlags = map[string]bool{
+	"-m": true, "--mode": true, "-t": true, "--type": true, "-p": true, "--portal": true,
+	"-T": true, "--targetname": true, "-o": true, "--op": true, "-n": true, "--name": true,
+	"-v": true, "--value": true, "-I": true, "--interface": true, "-r": true, "--sid": true,
+	"-P": true, "--print": true,
+}
+
+// iscsiadmAliases maps the long iscsiadm options to the short ones
+var iscsiadmAliases = map[string]string{
+	"--mode": "-m", "--type": "-t", "--portal": "-p", "--targetname": "-T", "--op": "-o",
+	"--name": "-n", "--value": "-v", "--interface": "-I", "--sid": "-r", "--print": "-P",
+	"-l": "--login", "-u": "--logout",
+}
+
+// parseIscsiadmArgs Return the iscsiadm options by their short name
+func parseIscsiadmArgs(args []string) map[string]string {
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name := arg
+		if alias, ok := iscsiadmAliases[arg]; ok {
+			name = alias
+		}
+		if iscsiadmValueFlags[arg] && i+1 < len(args) {
+			flags[name] = args[i+1]
+			i++
+			continue
+		}
+		flags[name] = ""
+	}
+	return flags
+}
+
+// defaultIface is the iface of the commands which name none
+const defaultIface = "default"
+
+// nodeKey Return the key of a node record, nodes are per iface
+func nodeKey(portal, iqn, iface string) string {
+	if iface == "" {
+		iface = defaultIface
+	}
+	return portal + " " + iqn + " " + iface
+}
+
+// iscsiadm Simulate the open-iscsi cli, skipHolder keeps multipathd from
+// building dm devices over the disks of a login
+func (h *Host) iscsiadm(args []string, skipHolder bool) (string, string, int) {
+	flags := parseIscsiadmArgs(args)
+	switch flags["-m"] {
+	case "discovery":
+		if _, ok := h.discoveryAuth[flags["-p"]]; ok {
+			return "", discoveryAuthFailure(flags["-p"]), iscsiErrAuthFailed
+		}
+		return h.iscsiDiscovery(flags["-p"], flags["-I"])
+	case "discoverydb":
+		return h.iscsiDiscoveryDB(flags)
+	case "iface":
+		return h.iscsiIface(flags["-I"])
+	case "node":
+		return h.iscsiNode(flags, skipHolder)
+	case "session":
+		return h.iscsiSession()
+	}
+	return "", "iscsiadm: unsupported mode " + flags["-m"], iscsiErrInvalid
+}
+
+// iscsiDiscovery Return the targets reachable through portal and record
+// their nodes bound to iface
+func (h *Host) iscsiDiscovery(portal, iface string) (string, string, int) {
+	if _, stderr, code := h.iscsiIface(iface); code != 0 {
+		return "", stderr, code
+	}
+	var lines []string
+	for _, t := range h.sortedTargets() {
+		if !contains(t.portals, portal) {
+			continue
+		}
+		for _, p := range t.portals {
+			lines = append(lines, fmt.Sprintf("%s,1 %s", p, t.iqn))
+			if _, ok := h.nodes[nodeKey(p, t.iqn, iface)]; !ok {
+				h.nodes[nodeKey(p, t.iqn, iface)] = map[string]string{"node.startup": "manual"}
+			}
+		}
+	}
+	if len(lines) == 0 {
+		return "", fmt.Sprintf("iscsiadm: cannot make connection to %s: Connection refused", portal), iscsiErrTrans
+	}
+	return strings.Join(lines, "\n") + "\n", "", 0
+}
+
+// iscsiDiscoveryDB Simulate the discoverydb mode, the discovery of a portal
+// requiring CHAP succeeds when its record holds the credentials
+func (h *Host) iscsiDiscoveryDB(flags map[string]string) (string, string, int) {
+	portal := flags["-p"]
+	record, ok := h.discoverydb[portal]
+	switch {
+	case flags["-o"] == "new":
+		h.discoverydb[portal] = map[string]string{}
+		return "", "", 0
+	case !ok:
+		return "", "iscsiadm: No records found", iscsiErrNoObjsFound
+	case flags["-o"] == "update":
+		record[flags["-n"]] = flags["-v"]
+		return "", "", 0
+	case flags["-o"] == "delete":
+		delete(h.discoverydb, portal)
+		return "", "", 0
+	}
+	if _, ok := flags["--discover"]; !ok {
+		return "", "", 0
+	}
+	if auth, ok := h.discoveryAuth[portal]; ok && !authMatches(record, "discovery.sendtargets.auth", auth) {
+		return "", discoveryAuthFailure(portal), iscsiErrAuthFailed
+	}
+	return h.iscsiDiscovery(portal, flags["-I"])
+}
+
+// iscsiIface Print an iface record, the default iface when name is empty
+func (h *Host) iscsiIface(name string) (string, string, int) {
+	if name == "" {
+		name = defaultIface
+	}
+	i, ok := h.ifaces[name]
+	if !ok {
+		return "", fmt.Sprintf("iscsiadm: Could not read iface %s (%d)", name, iscsiErrNoObjsFound), iscsiErrNoObjsFound
+	}
+	return fmt.Sprintf("# BEGIN RECORD 2.1.5\niface.iscsi_ifacename = %s\niface.net_ifacename = %s\niface.transport_name = %s\n# END RECORD\n",
+		name, i.netIface, i.transport), "", 0
+}
+
+// authMatches Check the settings under prefix of a node or discovery record
+// hold the CHAP credentials auth, and expect the target credentials only
+// when auth has them
+func authMatches(record map[string]string, prefix string, auth CHAP) bool {
+	return record[prefix+".authmethod"] == "CHAP" &&
+		record[prefix+".username"] == auth.Username &&
+		record[prefix+".password"] == auth.Password &&
+		record[prefix+".username_in"] == auth.UsernameIn &&
+		record[prefix+".password_in"] == auth.PasswordIn
+}
+
+// discoveryAuthFailure Return the error iscsiadm prints when a portal rejects discovery
+func discoveryAuthFailure(portal string) string {
+	return fmt.Sprintf("iscsiadm: Login failed to authenticate with target\niscsiadm: discovery login to %s rejected: initiator failed authorization", portal)
+}
+
+// iscsiNode Simulate the node mode
+func (h *Host) iscsiNode(flags map[string]string, skipHolder bool) (string, string, int) {
+	portal, iqn, ifaceName := flags["-p"], flags["-T"], flags["-I"]
+	key := nodeKey(portal, iqn, ifaceName)
+	node, ok := h.nodes[key]
+	switch {
+	case flags["-o"] == "new":
+		h.nodes[key] = map[string]string{"node.startup": "manual"}
+		return "", "", 0
+	case !ok:
+		return "", "iscsiadm: No records found", iscsiErrNoObjsFound
+	case flags["-o"] == "update":
+		node[flags["-n"]] = flags["-v"]
+		return "", "", 0
+	case flags["-o"] == "delete":
+		delete(h.nodes, key)
+		return "", "", 0
+	case flags["-o"] == "show":
+		var lines []string
+		for k, v := range node {
+			lines = append(lines, k+" = "+v)
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n") + "\n", "", 0
+	}
+	if _, ok := flags["--login"]; ok {
+		if t, ok := h.targets[iqn]; ok && t.auth != nil && !authMatches(node, "node.session.auth", *t.auth) {
+			return "", fmt.Sprintf("iscsiadm: Could not login to [iface: default, target: %s, portal: %s].\niscsiadm: initiator reported error (24 - iSCSI login failed due to authorization failure)", iqn, portal), iscsiErrAuthFailed
+		}
+		return h.iscsiLogin(portal, iqn, ifaceName, skipHolder)
+	}
+	if _, ok := flags["--logout"]; ok {
+		return h.iscsiLogout(portal, iqn)
+	}
+	return "", "", 0
+}
+
+// iscsiLogin Create a session bound to ifaceName and the disks of the luns of its target
+func (h *Host) iscsiLogin(portal, iqn, ifaceName string, skipHolder bool) (string, string, int) {
+	if ifaceName == "" {
+		ifaceName = defaultIface
+	}
+	if h.findSession(portal, iqn) != nil {
+		return "", fmt.Sprintf("iscsiadm: %s: 1 session requested, but 1 already present.", ifaceName), iscsiErrSessExists
+	}
+	t, ok := h.targets[iqn]
+	if !ok || !contains(t.portals, portal) {
+		return "", fmt.Sprintf("iscsiadm: Could not login to [iface: %s, target: %s, portal: %s].", ifaceName, iqn, portal), iscsiErrTrans
+	}
+	s := &session{
+		id:        h.allocate("session", func(n int) bool { _, ok := h.sessions[n]; return ok }),
+		host:      h.allocate("host", func(int) bool { return false }),
+		portal:    portal,
+		iqn:       iqn,
+		disks:     map[int]string{},
+		iface:     ifaceName,
+		transport: h.ifaces[ifaceName].transport,
+	}
+	layout := sysfstest.Session{ID: s.id, Host: s.host, Portal: portal, IQN: iqn}
+	for _, lun := range sortedLuns(t) {
+		device := diskName(h.allocate("disk", h.diskUsed))
+		s.disks[lun] = device
+		layout.LUNs = append(layout.LUNs, sysfstest.LUN{LUN: lun, Device: device, Size: t.luns[lun], WWID: wwid(iqn, lun)})
+	}
+	if err := h.tree.AddSession(layout); err != nil {
+		return "", err.Error(), 1
+	}
+	h.sessions[s.id] = s
+	if h.multipathd && !skipHolder {
+		for _, lun := range sortedLuns(t) {
+			if err := h.addPath(iqn, lun, t.luns[lun], s.disks[lun]); err != nil {
+				return "", err.Error(), 1
+			}
+		}
+	}
+	msg := fmt.Sprintf("Logging in to [iface: %s, target: %s, portal: %s]\nLogin to [iface: %s, target: %s, portal: %s] successful.\n",
+		ifaceName, iqn, portal, ifaceName, iqn, portal)
+	return msg, "", 0
+}
+
+// iscsiLogout Remove a session and its disks
+func (h *Host) iscsiLogout(portal, iqn string) (string, string, int) {
+	s := h.findSession(portal, iqn)
+	if s == nil {
+		return "", "iscsiadm: No matching sessions found", iscsiErrNoObjsFound
+	}
+	for _, device := range s.disks {
+		h.removeDisk(device)
+	}
+	if err := h.tree.RemoveSession(s.id); err != nil {
+		return "", err.Error(), 1
+	}
+	delete(h.sessions, s.id)
+	return fmt.Sprintf("Logout of [sid: %d, target: %s, portal: %s] successful.\n", s.id, iqn, portal), "", 0
+}
+
+// iscsiSession List the sessions as iscsiadm -m session does
+func (h *Host) iscsiSession() (string, string, int) {
+	if len(h.sessions) == 0 {
+		return "", "iscsiadm: No active sessions.", iscsiErrNoObjsFound
+	}
+	var ids []int
+	for id := range h.sessions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var out strings.Builder
+	for _, id := range ids {
+		s := h.sessions[id]
+		fmt.Fprintf(&out, "%s: [%d] %s,1 %s (non-flash)\n", s.transport, s.id, s.portal, s.iqn)
+	}
+	return out.String(), "", 0
+}
+
+// findSession Return the session to a portal and target
+func (h *Host) findSession(portal, iqn string) *session {
+	for _, s := range h.sessions {
+		if s.portal == portal && s.iqn == iqn {
+			return s
+		}
+	}
+	return nil
+}
+
+// diskUsed Check the n-th disk name is in use
+func (h *Host) diskUsed(n int) bool {
+	name := diskName(n)
+	for _, s := range h.sessions {
+		for _, d := range s.disks {
+			if d == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rescanDisk Update the size of a scsi disk to the size of its lun
+func (h *Host) rescanDisk(device string) error {
+	for _, s := range h.sessions {
+		for lun, d := range s.disks {
+			if d == device {
+				return h.tree.SetSize(device, h.targets[s.iqn].luns[lun])
+			}
+		}
+	}
+	return fmt.Errorf("%s is not a disk of an iscsi session", device)
+}
+
+// removeDisk Remove a scsi disk from its session, its dm device and the tree
+func (h *Host) removeDisk(device string) {
+	for _, s := range h.sessions {
+		for lun, d := range s.disks {
+			if d == device {
+				delete(s.disks, lun)
+			}
+		}
+	}
+	_ = h.tree.RemoveDisk(device)
+	for key, dm := range h.dms {
+		for i, slave := range dm.slaves {
+			if slave != device {
+				continue
+			}
+			dm.slaves = append(dm.slaves[:i], dm.slaves[i+1:]...)
+			if len(dm.slaves) == 0 {
+				// multipathd removes maps which lost all their paths
+				_ = h.tree.RemoveMultipath(dm.name)
+				delete(h.dms, key)
+			}
+			break
+		}
+	}
+}
+
+// sortedTargets Return the targets sorted by iqn
+func (h *Host) sortedTargets() []*target {
+	var res []*target
+	for _, t := range h.targets {
+		res = append(res, t)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].iqn < res[j].iqn })
+	return res
+}
+
+// sortedLuns Return the luns of a target in order
+func sortedLuns(t *target) []int {
+	var luns []int
+	for lun := range t.luns {
+		luns = append(luns, lun)
+	}
+	sort.Ints(luns)
+	return luns
+}
+
+// wwid Return the scsi wwid of a lun
+func wwid(iqn string, lun int) string {
+	f := fnv.New32a()
+	f.Write([]byte(iqn))
+	return fmt.Sprintf("36001405%08x%04x", f.Sum32(), lun)
+}
+
+// contains Check s is in list
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package fake
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
+)
+
+// addPath Add a disk to the dm device of a lun as multipathd does, the
+// device is created with the first path
+func (h *Host) addPath(iqn string, lun int, size int64, device string) error {
+	key := wwid(iqn, lun)
+	dm, ok := h.dms[key]
+	if !ok {
+		n := h.allocate("dm", func(n int) bool {
+			for _, dm := range h.dms {
+				if dm.name == fmt.Sprintf("dm-%d", n) {
+					return true
+				}
+			}
+			return false
+		})
+		dm = &multipathDevice{name: fmt.Sprintf("dm-%d", n), alias: key}
+		h.dms[key] = dm
+	}
+	dm.slaves = append(dm.slaves, device)
+	return h.tree.AddMultipath(sysfstest.Multipath{Name: dm.name, Alias: dm.alias, Slaves: dm.slaves, Size: size})
+}
+
+// findMultipath Return the dm device a device path or alias names
+func (h *Host) findMultipath(name string) (string, *multipathDevice) {
+	name = strings.TrimPrefix(strings.TrimPrefix(name, "/dev/mapper/"), "/dev/")
+	for key, dm := range h.dms {
+		if dm.name == name || dm.alias == name {
+			return key, dm
+		}
+	}
+	return "", nil
+}
+
+// multipath Simulate the multipath cli
+func (h *Host) multipath(args []string) (string, string, int) {
+	if len(args) == 2 && args[0] == "-f" {
+		key, dm := h.findMultipath(args[1])
+		if dm == nil {
+			return "", fmt.Sprintf("%s: map not found", args[1]), 1
+		}
+		if err := h.tree.RemoveMultipath(dm.name); err != nil {
+			return "", err.Error(), 1
+		}
+		delete(h.dms, key)
+		return "", "", 0
+	}
+	if len(args) == 0 || args[0] == "-l" || args[0] == "-ll" {
+		var out strings.Builder
+		for _, dm := range h.dms {
+			fmt.Fprintf(&out, "%s (%s) %s\n", dm.alias, dm.alias, dm.name)
+		}
+		return out.String(), "", 0
+	}
+	return "", "multipath: unsupported arguments " + strings.Join(args, " "), 1
+}
+
+// multipathdCmd Simulate the multipathd interactive commands
+func (h *Host) multipathdCmd(args []string) (string, string, int) {
+	if !h.multipathd {
+		return "", "ux_socket_connect: No such file or directory", 1
+	}
+	command := strings.Join(args, " ")
+	switch {
+	case command == "show status":
+		return "path checker states:\nup                  1\n", "", 0
+	case strings.HasPrefix(command, "resize map "):
+		_, dm := h.findMultipath(strings.TrimPrefix(command, "resize map "))
+		if dm == nil || len(dm.slaves) == 0 {
+			return "fail\n", "", 1
+		}
+		// The map takes the size of its paths, they all have to agree
+		size, err := h.tree.Root.ReadString("/sys/block/" + dm.slaves[0] + "/size")
+		if err != nil {
+			return "fail\n", "", 1
+		}
+		for _, slave := range dm.slaves[1:] {
+			if other, err := h.tree.Root.ReadString("/sys/block/" + slave + "/size"); err != nil || other != size {
+				return "fail\n", "", 0
+			}
+		}
+		var sectors int64
+		fmt.Sscan(size, &sectors)
+		if err := h.tree.SetSize(dm.name, sectors*512); err != nil {
+			return "fail\n", "", 1
+		}
+		return "ok\n", "", 0
+	}
+	return "ok\n", "", 0
+}
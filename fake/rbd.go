@@ -0,0 +1,344 @@
+package fake
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
+)
+
+// rbdValueFlags are the rbd options which take a value
+var rbdValueFlags = map[string]bool{
+	"-p": true, "--pool": true, "--namespace": true, "--image": true, "--snap": true,
+	"--id": true, "--user": true, "-m": true, "--mon_host": true, "-o": true, "--options": true,
+	"-c": true, "--conf": true, "-k": true, "--keyring": true, "--cluster": true,
+	"--format": true, "-t": true, "--device-type": true,
+}
+
+// krbdUnsupported are the image features the fake kernel can not map
+var krbdUnsupported = map[string]bool{"journaling": true}
+
+// nbdPidBase is the pid of the fake rbd-nbd process serving /dev/nbd0
+const nbdPidBase = 4000
+
+// krbdSupportedFeatures is the supported_features mask of the fake kernel,
+// every feature but journaling, migrating and non-primary
+const krbdSupportedFeatures = "0x1bf"
+
+// clusterFSID Return the fsid of the fake cluster of a mon_host list. Each
+// list of monitors is a cluster of its own, they all serve the same images
+func clusterFSID(monHost string) string {
+	sum := sha1.Sum([]byte(monHost))
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// parseRbdArgs Split rbd arguments into positional arguments and options
+func parseRbdArgs(args []string) ([]string, map[string]string) {
+	var positional []string
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			positional = append(positional, arg)
+			continue
+		}
+		if kv := strings.SplitN(arg, "=", 2); len(kv) == 2 {
+			flags[kv[0]] = kv[1]
+			continue
+		}
+		if rbdValueFlags[arg] && i+1 < len(args) {
+			flags[arg] = args[i+1]
+			i++
+			continue
+		}
+		flags[arg] = ""
+	}
+	return positional, flags
+}
+
+// rbd Simulate the rbd cli
+func (h *Host) rbd(args []string) (string, string, int) {
+	positional, flags := parseRbdArgs(args)
+	if len(positional) == 0 {
+		return "", "rbd: missing command", 22
+	}
+	if stderr, code := checkConf(flags); code != 0 {
+		return "", stderr, code
+	}
+	if positional[0] == "device" && len(positional) > 1 {
+		positional = positional[1:]
+	}
+	switch positional[0] {
+	case "showmapped", "list":
+		return h.rbdShowmapped()
+	case "map":
+		return h.rbdMap(positional[1:], flags)
+	case "unmap":
+		return h.rbdUnmap(positional[1:], flags)
+	case "info":
+		return h.rbdInfo(positional[1:], flags)
+	case "feature":
+		return h.rbdFeature(positional[1:], flags)
+	}
+	return "", "rbd: unknown command " + positional[0], 22
+}
+
+// rbdFeature Simulate rbd feature disable, the features the image does not
+// have are rejected the way rbd does
+func (h *Host) rbdFeature(args []string, flags map[string]string) (string, string, int) {
+	if len(args) < 3 || args[0] != "disable" {
+		return "", "rbd: unsupported feature command", 22
+	}
+	m, spec := h.lookupImage(args[1], flags)
+	if m == nil {
+		return "", fmt.Sprintf("rbd: error opening image %s: (2) No such file or directory", spec), 2
+	}
+	features := m.image.features
+	for _, f := range args[2:] {
+		if !contains(features, f) {
+			return "", fmt.Sprintf("rbd: failed to update image features: (22) Invalid argument: %s is not enabled", f), 22
+		}
+		var kept []string
+		for _, g := range features {
+			if g != f {
+				kept = append(kept, g)
+			}
+		}
+		features = kept
+	}
+	m.image.features = features
+	return "", "", 0
+}
+
+// rbdInfo Describe an image in the json format of rbd info
+func (h *Host) rbdInfo(args []string, flags map[string]string) (string, string, int) {
+	if len(args) != 1 {
+		return "", "rbd: image name was not specified", 22
+	}
+	m, spec := h.lookupImage(args[0], flags)
+	if m == nil {
+		return "", fmt.Sprintf("rbd: error opening image %s: (2) No such file or directory", spec), 2
+	}
+	out, _ := json.Marshal(map[string]interface{}{
+		"name":     m.image.name,
+		"size":     m.size(),
+		"objects":  (m.size() + 1<<22 - 1) >> 22,
+		"order":    22,
+		"features": m.image.features,
+	})
+	return string(out) + "\n", "", 0
+}
+
+// rbdShowmapped List the mapped images in the json format of rbd showmapped
+func (h *Host) rbdShowmapped() (string, string, int) {
+	type entry struct {
+		ID        string `json:"id"`
+		Pool      string `json:"pool"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		Snap      string `json:"snap"`
+		Device    string `json:"device"`
+	}
+	entries := []entry{}
+	for id := 0; len(entries) < len(h.mapped); id++ {
+		m, ok := h.mapped[id]
+		if !ok {
+			continue
+		}
+		entries = append(entries, entry{
+			ID:        fmt.Sprint(id),
+			Pool:      m.image.pool,
+			Namespace: m.image.namespace,
+			Name:      m.image.name,
+			Snap:      snapColumn(m.snap),
+			Device:    fmt.Sprintf("/dev/rbd%d", id),
+		})
+	}
+	out, _ := json.Marshal(entries)
+	return string(out) + "\n", "", 0
+}
+
+// checkConf Fail like the ceph tools when the config or keyring they are given is missing
+func checkConf(flags map[string]string) (string, int) {
+	for _, flag := range []string{"--conf", "-c", "--keyring", "-k"} {
+		file, ok := flags[flag]
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Sprintf("global_init: unable to open config file from search list %s", file), 2
+		}
+	}
+	return "", 0
+}
+
+// snapColumn Return the snapshot as the rbd tools list it, - for the image head
+func snapColumn(snap string) string {
+	if snap == "" {
+		return "-"
+	}
+	return snap
+}
+
+// lookupImage Return the image or snapshot a pool[/namespace]/image[@snap]
+// spec and its options name, as a mapping without device, and its full spec.
+// The mapping is nil when the image or the snapshot does not exist
+func (h *Host) lookupImage(spec string, flags map[string]string) (*mapping, string) {
+	pool, namespace, snap := "rbd", flags["--namespace"], flags["--snap"]
+	if p, ok := flags["--pool"]; ok {
+		pool = p
+	} else if p, ok := flags["-p"]; ok {
+		pool = p
+	}
+	name := spec
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, snap = name[:i], name[i+1:]
+	}
+	switch parts := strings.Split(name, "/"); len(parts) {
+	case 2:
+		pool, name = parts[0], parts[1]
+	case 3:
+		pool, namespace, name = parts[0], parts[1], parts[2]
+	}
+	full := path.Join(pool, namespace, name)
+	if snap != "" {
+		full += "@" + snap
+	}
+	img, ok := h.images[path.Join(pool, namespace, name)]
+	if !ok {
+		return nil, full
+	}
+	if _, ok := img.snaps[snap]; snap != "" && !ok {
+		return nil, full
+	}
+	return &mapping{image: img, snap: snap}, full
+}
+
+// rbdMap Map an image and create its device
+func (h *Host) rbdMap(args []string, flags map[string]string) (string, string, int) {
+	if len(args) != 1 {
+		return "", "rbd: image name was not specified", 22
+	}
+	m, spec := h.lookupImage(args[0], flags)
+	if m == nil {
+		return "", fmt.Sprintf("rbd: sysfs write failed\nrbd: map failed: (2) No such file or directory: %s", spec), 2
+	}
+	for _, f := range m.image.features {
+		if krbdUnsupported[f] {
+			return "", fmt.Sprintf("rbd: sysfs write failed\nRBD image feature set mismatch. You can disable features unsupported by the kernel with \"rbd feature disable %s %s\".\nrbd: map failed: (6) No such device or address", spec, f), 6
+		}
+	}
+	id := h.allocate("rbd", func(n int) bool { _, ok := h.mapped[n]; return ok })
+	err := h.tree.AddRBD(sysfstest.RBDDevice{
+		ID:          id,
+		Pool:        m.image.pool,
+		Namespace:   m.image.namespace,
+		Image:       m.image.name,
+		Snap:        m.snap,
+		Size:        m.size(),
+		ClientID:    fmt.Sprintf("client%d", 4100+id),
+		ClusterFSID: clusterFSID(flags["--mon_host"]),
+		Monitors:    flags["--mon_host"],
+		UdevLink:    true,
+	})
+	if err != nil {
+		return "", err.Error(), 5
+	}
+	m.id = id
+	h.mapped[id] = m
+	return fmt.Sprintf("/dev/rbd%d\n", id), "", 0
+}
+
+// rbdUnmap Unmap an image given its device or spec
+func (h *Host) rbdUnmap(args []string, flags map[string]string) (string, string, int) {
+	if len(args) != 1 {
+		return "", "rbd: unmap requires either image name or device path", 22
+	}
+	for id, m := range h.mapped {
+		device := fmt.Sprintf("/dev/rbd%d", id)
+		if args[0] != device && args[0] != m.spec() {
+			continue
+		}
+		if err := h.tree.RemoveRBD(id); err != nil {
+			return "", err.Error(), 5
+		}
+		delete(h.mapped, id)
+		return "", "", 0
+	}
+	return "", fmt.Sprintf("rbd: %s: not a mapped image or snapshot", args[0]), 22
+}
+
+// rbdNbd Simulate the rbd-nbd cli
+func (h *Host) rbdNbd(args []string) (string, string, int) {
+	positional, flags := parseRbdArgs(args)
+	if len(positional) == 0 {
+		return "", "rbd-nbd: missing command", 22
+	}
+	if stderr, code := checkConf(flags); code != 0 {
+		return "", stderr, code
+	}
+	switch positional[0] {
+	case "list-mapped":
+		var lines []string
+		for id := 0; len(lines) < len(h.nbds); id++ {
+			if m, ok := h.nbds[id]; ok {
+				lines = append(lines, fmt.Sprintf(`{"id":"%d","pool":"%s","namespace":"%s","image":"%s","snap":"%s","device":"/dev/nbd%d"}`,
+					1000+id, m.image.pool, m.image.namespace, m.image.name, snapColumn(m.snap), id))
+			}
+		}
+		return "[" + strings.Join(lines, ",") + "]\n", "", 0
+	case "map":
+		if len(positional) != 2 {
+			return "", "rbd-nbd: image name was not specified", 22
+		}
+		m, spec := h.lookupImage(positional[1], flags)
+		if m == nil {
+			return "", fmt.Sprintf("rbd-nbd: failed to open image %s: (2) No such file or directory", spec), 2
+		}
+		id := h.allocate("nbd", func(n int) bool { _, ok := h.nbds[n]; return ok })
+		device := fmt.Sprintf("nbd%d", id)
+		if err := h.tree.WriteFile("/dev/"+device, ""); err != nil {
+			return "", err.Error(), 5
+		}
+		if err := h.tree.SetSize(device, m.size()); err != nil {
+			return "", err.Error(), 5
+		}
+		// rbd-nbd list-mapped and the connector find the image from the
+		// command line of the rbd-nbd process serving the device
+		pid := fmt.Sprint(nbdPidBase + id)
+		if err := h.tree.WriteFile("/sys/block/"+device+"/pid", pid+"\n"); err != nil {
+			return "", err.Error(), 5
+		}
+		cmdline := strings.Join(append([]string{"rbd-nbd"}, args...), "\x00") + "\x00"
+		if err := h.tree.WriteFile("/proc/"+pid+"/cmdline", cmdline); err != nil {
+			return "", err.Error(), 5
+		}
+		m.id = id
+		h.nbds[id] = m
+		return "/dev/" + device + "\n", "", 0
+	case "unmap":
+		if len(positional) != 2 {
+			return "", "rbd-nbd: unmap requires a device path", 22
+		}
+		for id, m := range h.nbds {
+			device := fmt.Sprintf("nbd%d", id)
+			if positional[1] != "/dev/"+device && positional[1] != m.spec() {
+				continue
+			}
+			pid := fmt.Sprint(nbdPidBase + id)
+			for _, p := range []string{"/dev/" + device, "/sys/block/" + device, "/proc/" + pid} {
+				if err := os.RemoveAll(h.tree.Root.Path(p)); err != nil {
+					return "", err.Error(), 5
+				}
+			}
+			delete(h.nbds, id)
+			return "", "", 0
+		}
+		return "", fmt.Sprintf("rbd-nbd: %s is not mapped", positional[1]), 22
+	}
+	return "", "rbd-nbd: unknown command " + positional[0], 22
+}
@@ -0,0 +1,181 @@
+package iscsi
+
+import (
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/iscsi"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+)
+
+// ConnInfo is the iscsi connection info returned by cinder initialize_connection
+type ConnInfo struct {
+	TargetDiscovered bool
+	TargetPortal     string
+	TargetPortals    []string
+	TargetIqn        string
+	TargetIqns       []string
+	TargetLun        int
+	TargetLuns       []int
+	VolumeID         string
+	AuthMethod       string
+	AuthUsername     string
+	AuthPassword     string
+	QosSpecs         string
+	AccessMode       string
+	Encrypted        bool
+
+	// AuthUsernameIn and AuthPasswordIn authenticate the target to the
+	// initiator with mutual CHAP
+	AuthUsernameIn string
+	AuthPasswordIn string
+	// DiscoveryAuth* are the CHAP credentials of sendtargets discovery
+	DiscoveryAuthMethod     string
+	DiscoveryAuthUsername   string
+	DiscoveryAuthPassword   string
+	DiscoveryAuthUsernameIn string
+	DiscoveryAuthPasswordIn string
+	// Transport is iser when the driver_volume_type of the connection info
+	// is iser, it is empty for tcp
+	Transport string
+}
+
+// rawConnInfo is the wire form of ConnInfo
+type rawConnInfo struct {
+	TargetDiscovered utils.Bool    `json:"target_discovered"`
+	TargetPortal     utils.String  `json:"target_portal"`
+	TargetPortals    utils.Strings `json:"target_portals"`
+	TargetIqn        utils.String  `json:"target_iqn"`
+	TargetIqns       utils.Strings `json:"target_iqns"`
+	TargetLun        utils.Int     `json:"target_lun"`
+	TargetLuns       utils.Ints    `json:"target_luns"`
+	VolumeID         utils.String  `json:"volume_id"`
+	AuthMethod       utils.String  `json:"auth_method"`
+	AuthUsername     utils.String  `json:"auth_username"`
+	AuthPassword     utils.String  `json:"auth_password"`
+	QosSpecs         utils.String  `json:"qos_specs"`
+	AccessMode       utils.String  `json:"access_mode"`
+	Encrypted        utils.Bool    `json:"encrypted"`
+
+	AuthUsernameIn          utils.String `json:"auth_username_in"`
+	AuthPasswordIn          utils.String `json:"auth_password_in"`
+	DiscoveryAuthMethod     utils.String `json:"discovery_auth_method"`
+	DiscoveryAuthUsername   utils.String `json:"discovery_auth_username"`
+	DiscoveryAuthPassword   utils.String `json:"discovery_auth_password"`
+	DiscoveryAuthUsernameIn utils.String `json:"discovery_auth_username_in"`
+	DiscoveryAuthPasswordIn utils.String `json:"discovery_auth_password_in"`
+}
+
+// ParseConnInfo Build a validated ConnInfo from the data section of a connection info map
+func ParseConnInfo(connInfo map[string]interface{}) (*ConnInfo, error) {
+	var raw rawConnInfo
+	if err := utils.DecodeConnInfoData(connInfo, &raw); err != nil {
+		return nil, exception.InvalidConnInfo("iscsi", "%v", err)
+	}
+	info := &ConnInfo{
+		TargetDiscovered: bool(raw.TargetDiscovered),
+		TargetPortal:     string(raw.TargetPortal),
+		TargetIqn:        string(raw.TargetIqn),
+		TargetLun:        int(raw.TargetLun),
+		VolumeID:         string(raw.VolumeID),
+		AuthMethod:       string(raw.AuthMethod),
+		AuthUsername:     string(raw.AuthUsername),
+		AuthPassword:     string(raw.AuthPassword),
+		QosSpecs:         string(raw.QosSpecs),
+		AccessMode:       string(raw.AccessMode),
+		Encrypted:        bool(raw.Encrypted),
+
+		AuthUsernameIn:          string(raw.AuthUsernameIn),
+		AuthPasswordIn:          string(raw.AuthPasswordIn),
+		DiscoveryAuthMethod:     string(raw.DiscoveryAuthMethod),
+		DiscoveryAuthUsername:   string(raw.DiscoveryAuthUsername),
+		DiscoveryAuthPassword:   string(raw.DiscoveryAuthPassword),
+		DiscoveryAuthUsernameIn: string(raw.DiscoveryAuthUsernameIn),
+		DiscoveryAuthPasswordIn: string(raw.DiscoveryAuthPasswordIn),
+	}
+	if t, ok := connInfo["driver_volume_type"].(string); ok && strings.EqualFold(t, iscsi.TransportISER) {
+		info.Transport = iscsi.TransportISER
+	}
+	if raw.TargetPortals != nil || raw.TargetIqns != nil || raw.TargetLuns != nil {
+		info.TargetPortals = raw.TargetPortals
+		info.TargetIqns = raw.TargetIqns
+		info.TargetLuns = raw.TargetLuns
+	}
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DecodeConnInfo Build a validated ConnInfo from the JSON of a cinder initialize_connection call
+func DecodeConnInfo(b []byte) (*ConnInfo, error) {
+	connInfo, err := utils.ParseConnInfoJSON(b)
+	if err != nil {
+		return nil, exception.InvalidConnInfo("iscsi", "%v", err)
+	}
+	return ParseConnInfo(connInfo)
+}
+
+// Validate Check the connection info is complete and consistent
+func (i *ConnInfo) Validate() error {
+	multiPath := i.TargetPortals != nil || i.TargetIqns != nil || i.TargetLuns != nil
+	if multiPath {
+		if len(i.TargetPortals) == 0 {
+			return exception.InvalidConnInfo("iscsi", "target_portals is empty")
+		}
+		if len(i.TargetIqns) != len(i.TargetPortals) || len(i.TargetLuns) != len(i.TargetPortals) {
+			return exception.InvalidConnInfo("iscsi", "connection info has %d target_portals, %d target_iqns and %d target_luns",
+				len(i.TargetPortals), len(i.TargetIqns), len(i.TargetLuns))
+		}
+		for n := range i.TargetPortals {
+			if i.TargetPortals[n] == "" || i.TargetIqns[n] == "" {
+				return exception.InvalidConnInfo("iscsi", "target %d has an empty portal or iqn", n)
+			}
+			if i.TargetLuns[n] < 0 {
+				return exception.InvalidConnInfo("iscsi", "target %d has negative lun %d", n, i.TargetLuns[n])
+			}
+		}
+	} else {
+		if i.TargetPortal == "" {
+			return exception.InvalidConnInfo("iscsi", "target_portal is required")
+		}
+		if i.TargetIqn == "" {
+			return exception.InvalidConnInfo("iscsi", "target_iqn is required")
+		}
+	}
+	if i.TargetLun < 0 {
+		return exception.InvalidConnInfo("iscsi", "target_lun %d is negative", i.TargetLun)
+	}
+	if err := i.SessionAuth().Validate("iscsi", "auth"); err != nil {
+		return err
+	}
+	if err := i.DiscoveryAuth().Validate("iscsi", "discovery_auth"); err != nil {
+		return err
+	}
+	if i.AccessMode != "" && i.AccessMode != "rw" && i.AccessMode != "ro" {
+		return exception.InvalidConnInfo("iscsi", "unknown access_mode %q, expected rw or ro", i.AccessMode)
+	}
+	return nil
+}
+
+// SessionAuth Return the CHAP credentials of the sessions
+func (i *ConnInfo) SessionAuth() iscsi.Auth {
+	return iscsi.Auth{
+		Method:     i.AuthMethod,
+		Username:   i.AuthUsername,
+		Password:   i.AuthPassword,
+		UsernameIn: i.AuthUsernameIn,
+		PasswordIn: i.AuthPasswordIn,
+	}
+}
+
+// DiscoveryAuth Return the CHAP credentials of sendtargets discovery
+func (i *ConnInfo) DiscoveryAuth() iscsi.Auth {
+	return iscsi.Auth{
+		Method:     i.DiscoveryAuthMethod,
+		Username:   i.DiscoveryAuthUsername,
+		Password:   i.DiscoveryAuthPassword,
+		UsernameIn: i.DiscoveryAuthUsernameIn,
+		PasswordIn: i.DiscoveryAuthPasswordIn,
+	}
+}
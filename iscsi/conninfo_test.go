@@ -0,0 +1,49 @@
+package iscsi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConnInfo(t *testing.T) {
+	t.Parallel()
+	body := `{"driver_volume_type": "iscsi", "data": {
+		"target_discovered": false, "target_portal": "10.0.0.1:3260", "target_iqn": "iqn.2010-10.org.openstack:volume-1",
+		"target_lun": 1, "target_portals": ["10.0.0.1:3260", "10.0.0.2:3260"],
+		"target_iqns": ["iqn.2010-10.org.openstack:volume-1", "iqn.2010-10.org.openstack:volume-1"],
+		"target_luns": [1, "2"], "auth_method": "CHAP", "auth_username": "user", "auth_password": "pass"}}`
+	info, err := DecodeConnInfo([]byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(info.TargetLuns, []int{1, 2}) || info.TargetLun != 1 {
+		t.Errorf("Unexpected connection info %+v", info)
+	}
+	if auth := info.SessionAuth(); !auth.Enabled() || auth.Mutual() || info.DiscoveryAuth().Enabled() {
+		t.Errorf("Unexpected auth %+v %+v", auth, info.DiscoveryAuth())
+	}
+	conn := &ConnISCSI{ConnInfo: *info}
+	targets := conn.getAllTargets()
+	if len(targets) != 2 || targets[1].Lun != 2 {
+		t.Errorf("Unexpected targets %+v", targets)
+	}
+
+	invalid := []string{
+		`{"data": {"target_iqn": "iqn"}}`,
+		`{"data": {"target_portal": "10.0.0.1:3260"}}`,
+		`{"data": {"target_portals": ["p1", "p2"], "target_iqns": ["i1"], "target_luns": [1, 2]}}`,
+		`{"data": {"target_portals": ["p1"], "target_iqns": ["i1"], "target_luns": [1, 2]}}`,
+		`{"data": {"target_portals": ["p1"], "target_iqns": ["i1"]}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "auth_method": "CHAP"}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "target_lun": "x"}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "discovery_auth_method": "CHAP", "discovery_auth_username": "u"}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "discovery_auth_method": "none"}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "auth_username_in": "t", "auth_password_in": "s"}}`,
+		`{"data": {"target_portal": "p1", "target_iqn": "i1", "auth_method": "CHAP", "auth_username": "u", "auth_password": "p", "auth_username_in": "t"}}`,
+	}
+	for _, body := range invalid {
+		if _, err := DecodeConnInfo([]byte(body)); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+}
@@ -1,140 +1,479 @@
 package iscsi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
-	"sync"
+	"strings"
+	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
 	"github.com/fightdou/os-brick-rbd/pkg/iscsi"
+	"github.com/fightdou/os-brick-rbd/pkg/lock"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
 
 var RetryCount int = 10
 
+const (
+	// DefaultMultipathTimeout is how long a multipath attach waits for multipathd to build the dm device
+	DefaultMultipathTimeout = 10 * time.Second
+	// multipathPollInterval is how often the dm device is looked for while waiting for it
+	multipathPollInterval = 200 * time.Millisecond
+	// rollbackTimeout bounds the logouts of a failed attach, they do not
+	// stop when the attach is cancelled
+	rollbackTimeout = 30 * time.Second
+)
+
 // ConnISCSI contains iscsi volume info
 type ConnISCSI struct {
-	targetDiscovered bool
-	targetPortal     string
-	targetPortals    []string
-	targetIqn        string
-	targetIqns       []string
-	targetLun        int
-	targetLuns       []int
-	volumeID         string
-	authMethod       string
-	authUsername     string
-	authPassword     string
-	QosSpecs         string
-	AccessMode       string
-	Encrypted        bool
+	ConnInfo
+	// Executor runs iscsiadm and the other external commands, they run
+	// directly when it is nil
+	Executor utils.Executor
+	// Store records the attachment, nothing is recorded when it is nil
+	Store state.Store
+	// Locker serializes the operations on the volume and its targets between
+	// processes, there is no locking when it is nil
+	Locker *lock.Locker
+	// Root is where the host sysfs and devfs are mounted, device paths stay
+	// relative to the host
+	Root sysfs.Root
+	// MinPaths is how many paths a multipath attach needs, the portals which
+	// fail beyond that are reported in the failed_portals result
+	MinPaths int
+	// MultipathTimeout is how long a multipath attach waits for the dm device,
+	// and then for the logins still running before it cancels them
+	MultipathTimeout time.Duration
+	// Iface is the iscsiadm iface the sessions are bound to, for example one
+	// bound to a storage NIC with iface.net_ifacename. Its transport must be
+	// the one of the volume, the builtin default or iser iface is used when it is empty
+	Iface string
+
+	connInfo map[string]interface{}
 }
 
-// NewISCSIConnector Return ConnRbd Pointer to the object
-func NewISCSIConnector(connInfo map[string]interface{}) *ConnISCSI {
-	data := connInfo["data"].(map[string]interface{})
-	conn := &ConnISCSI{}
-	conn.targetDiscovered = utils.ToBool(data["target_discovered"])
-	conn.targetPortal = utils.ToString(data["target_portal"])
-	if data["target_portals"] != nil && data["target_iqns"] != nil && data["target_luns"] != nil {
-		conn.targetPortals = utils.ToStringSlice(data["target_portals"])
-		conn.targetIqns = utils.ToStringSlice(data["target_iqns"])
-		conn.targetLuns = utils.ToIntSlice(data["target_luns"])
-	}
-	conn.targetIqn = utils.ToString(data["target_iqn"])
-	conn.targetLun = utils.ToInt(data["target_lun"])
-	conn.volumeID = utils.ToString(data["volume_id"])
-	conn.authMethod = utils.ToString(data["auth_method"])
-	conn.authUsername = utils.ToString(data["auth_username"])
-	conn.authPassword = utils.ToString(data["auth_password"])
-	conn.QosSpecs = utils.ToString(data["qos_specs"])
-	conn.AccessMode = utils.ToString(data["access_mode"])
-	conn.Encrypted = utils.ToBool(data["encrypted"])
-	return conn
+// NewISCSIConnector Return ConnISCSI Pointer to the object
+func NewISCSIConnector(connInfo map[string]interface{}) (*ConnISCSI, error) {
+	info, err := ParseConnInfo(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnISCSI{ConnInfo: *info, MinPaths: 1, MultipathTimeout: DefaultMultipathTimeout, connInfo: connInfo}, nil
+}
+
+// NewISERConnector Return a new iscsi connector logging in with the iser transport
+func NewISERConnector(connInfo map[string]interface{}) (*ConnISCSI, error) {
+	conn, err := NewISCSIConnector(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	conn.Transport = iscsi.TransportISER
+	return conn, nil
 }
 
 //ConnectVolume Attach the volume to pod
-func (c *ConnISCSI) ConnectVolume() (map[string]string, error) {
+func (c *ConnISCSI) ConnectVolume(ctx context.Context) (map[string]string, error) {
 	res := map[string]string{}
-	if len(c.targetIqns) >= 1 {
-		device, err := c.connectMultiPathVolume()
+	unlock, err := c.Locker.Lock(ctx, c.volumeLockKey())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	recorded, err := state.Lookup(c.Store, c.AttachmentID())
+	if err != nil {
+		logger.Error("Read iscsi attachment record failed", err)
+		return nil, err
+	}
+	if recorded != nil {
+		if c.Root.Exists(recorded.DevicePath) {
+			logger.Info("Volume is already attached to %s", recorded.DevicePath)
+			res["path"] = recorded.DevicePath
+			return res, nil
+		}
+		logger.Warn("Recorded device %s of the volume is gone, attaching again", recorded.DevicePath)
+	}
+	if err := c.checkIface(ctx); err != nil {
+		return nil, err
+	}
+	if len(c.TargetIqns) >= 1 {
+		device, failed, err := c.connectMultiPathVolume(ctx)
 		if err != nil {
 			return nil, err
 		}
 		res["path"] = device
+		if len(failed) > 0 {
+			res["failed_portals"] = strings.Join(failed, ",")
+		}
 	} else {
-		device, err := c.connectSinglePathVolume()
+		device, err := c.connectSinglePathVolume(ctx)
 		if err != nil {
 			return nil, err
 		}
 		res["path"] = device
 	}
+	err = state.Save(c.Store, &state.Attachment{
+		ID:         c.AttachmentID(),
+		Protocol:   c.protocol(),
+		VolumeID:   c.VolumeID,
+		ConnInfo:   c.connInfo,
+		DevicePath: res["path"],
+	})
+	if err != nil {
+		logger.Error("Record iscsi attachment failed", err)
+		return nil, err
+	}
 	return res, nil
 }
 
 //DisConnectVolume Detach the volume from pod
-func (c *ConnISCSI) DisConnectVolume() error {
-	err := c.cleanupConnection()
+func (c *ConnISCSI) DisConnectVolume(ctx context.Context) error {
+	unlock, err := c.Locker.Lock(ctx, c.volumeLockKey())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = c.cleanupConnection(ctx)
 	if err != nil {
 		logger.Error("Disconnect volume failed", err)
 		return err
 	}
+	if err := state.Forget(c.Store, c.AttachmentID()); err != nil {
+		logger.Error("Remove iscsi attachment record failed", err)
+		return err
+	}
 	return nil
 }
 
-//ExtendVolume Update the local kernel's size information
-func (c *ConnISCSI) ExtendVolume() (int64, error) {
-	return 0, nil
+//ExtendVolume Update the local kernel's size information, every path of the
+// volume is rescanned and a multipath device is resized to the new size
+func (c *ConnISCSI) ExtendVolume(ctx context.Context) (int64, error) {
+	unlock, err := c.Locker.Lock(ctx, c.volumeLockKey())
+	if err != nil {
+		return -1, err
+	}
+	defer unlock()
+	devices, err := iscsi.GetConnectionDevices(ctx, c.Executor, c.Root, c.getAllTargets())
+	if err != nil {
+		logger.Error("Get iscsi connection device failed", err)
+		return -1, err
+	}
+	if len(devices) == 0 {
+		return -1, exception.Wrap(exception.ErrDeviceNotFound, nil, "volume %s has no scsi device", c.AttachmentID())
+	}
+	size, err := iscsi.ExtendDevices(ctx, c.Executor, c.Root, devices)
+	if err != nil {
+		logger.Error("Rescan iscsi devices failed", err)
+		return -1, err
+	}
+	devicePath := filepath.Join("/dev", devices[0])
+	dm, err := iscsi.FindSysfsMultipathDM(c.Root, devices[0])
+	if err == nil {
+		if err := iscsi.ResizeMultipathDevice(ctx, c.Executor, c.Root, dm, size); err != nil {
+			logger.Error("Resize multipath device failed", err)
+			return -1, err
+		}
+		devicePath = filepath.Join("/dev", dm)
+	} else if len(devices) > 1 {
+		logger.Warn("Volume has %d paths but no multipath device: %v", len(devices), err)
+	}
+	logger.Info("extend volume to %d is success", size)
+	err = state.Update(c.Store, c.AttachmentID(), func(a *state.Attachment) {
+		a.DevicePath = devicePath
+		a.Size = size
+	})
+	if err != nil {
+		logger.Error("Record iscsi attachment failed", err)
+		return -1, err
+	}
+	return size, nil
 }
 
-//GetDevicePath Get mount device local path
-func (c *ConnISCSI) GetDevicePath() string {
+//GetDevicePath Get mount device local path, the multipath device when the
+// paths of the volume are held by one, else the by-path link of a present path
+func (c *ConnISCSI) GetDevicePath(ctx context.Context) string {
 	target := c.getAllTargets()
-	var devicePath string
+	var devicePath, present string
 	for _, i := range target {
 		devicePath = fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", i.Portal, i.Iqn, i.Lun)
+		device, err := c.Root.EvalSymlinks(devicePath)
+		if err != nil {
+			continue
+		}
+		if dm, err := iscsi.FindSysfsMultipathDM(c.Root, filepath.Base(device)); err == nil {
+			return filepath.Join("/dev", dm)
+		}
+		if present == "" {
+			present = devicePath
+		}
+	}
+	if present != "" {
+		return present
 	}
 	return devicePath
 }
 
-//connectMultiPathVolume Connect to a multipathed volume launching parallel login requests
-func (c *ConnISCSI) connectMultiPathVolume() (string, error) {
-	var err error
-	target := c.getIpsIqnsLuns()
-	var wg sync.WaitGroup
+// AttachmentID Return the id the attachment is recorded under, the first
+// target identifies the volume
+func (c *ConnISCSI) AttachmentID() string {
+	t := c.getAllTargets()[0]
+	return fmt.Sprintf("iscsi:%s:%s:%d", t.Portal, t.Iqn, t.Lun)
+}
+
+// volumeLockKey Return the lock key of the volume
+func (c *ConnISCSI) volumeLockKey() string {
+	if c.VolumeID != "" {
+		return lock.VolumeKey(c.VolumeID)
+	}
+	return lock.VolumeKey(c.AttachmentID())
+}
+
+// pathResult is the outcome of connecting a path of a multipath volume
+type pathResult struct {
+	target iscsi.Target
+	device string
+	// opened is set when the session of the path was opened by this attach
+	opened bool
+	err    error
+}
+
+//connectMultiPathVolume Connect to a multipathed volume launching parallel login requests.
+// The attach succeeds once the multipath device has MinPaths paths, the logins
+// still running then get MultipathTimeout to add their paths before they are
+// cancelled, and the portals which did not connect are returned. The sessions
+// the attach opened are logged out when it fails, and those of the portals
+// which did not connect when it succeeds
+func (c *ConnISCSI) connectMultiPathVolume(ctx context.Context) (string, []string, error) {
+	targets, err := c.getIpsIqnsLuns(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	loginCtx, cancelLogins := context.WithCancel(ctx)
+	defer cancelLogins()
+	type indexedResult struct {
+		i int
+		pathResult
+	}
+	done := make(chan indexedResult, len(targets))
+	for i, t := range targets {
+		go func(i int, t iscsi.Target) {
+			device, opened, err := c.connVolume(loginCtx, t.Portal, t.Iqn, t.Lun)
+			done <- indexedResult{i, pathResult{target: t, device: device, opened: opened, err: err}}
+		}(i, t)
+	}
+	results := make([]pathResult, len(targets))
+	pending := len(targets)
+	// collect Record the result of a path
 	var devices []string
-	for _, p := range target {
-		wg.Add(1)
-		device, err := c.connVolume(p.Portal, p.Iqn, p.Lun)
-		if err != nil {
-			logger.Error("Failed to connect volume", err)
-			return "", err
+	collect := func(r indexedResult) {
+		pending--
+		results[r.i] = r.pathResult
+		if r.err == nil {
+			devices = append(devices, r.device)
+		}
+	}
+	// finish Cancel the logins still running and wait for them, so that the
+	// sessions they opened are known to the rollback
+	finish := func() {
+		cancelLogins()
+		for pending > 0 {
+			collect(<-done)
 		}
-		devices = append(devices, device)
-		wg.Done()
 	}
-	wg.Wait()
 
+	minPaths := c.minPaths()
+	var timeout, poll, settle <-chan time.Time
 	var dm string
-	for _, d := range devices {
-		dm, err = iscsi.FindSysfsMultipathDM(d)
-		if err == nil {
-			logger.Info("found dm device: %v", dm)
+	var dmErr error
+	for {
+		if dm == "" && len(devices) >= minPaths {
+			if dm, dmErr = c.findMultipathDevice(devices, minPaths); dmErr == nil {
+				logger.Info("found dm device: %v", dm)
+				timeout, poll = nil, nil
+				if pending > 0 && c.MultipathTimeout > 0 {
+					settle = time.After(c.MultipathTimeout)
+				}
+			} else {
+				if timeout == nil && c.MultipathTimeout > 0 {
+					timeout = time.After(c.MultipathTimeout)
+				}
+				poll = time.After(multipathPollInterval)
+			}
+		}
+		if dm != "" && pending == 0 {
+			break
+		}
+		if dm == "" && len(devices)+pending < minPaths {
 			break
 		}
-		logger.Error("found err, continue... [device: %s] [err: %s]", d, err.Error())
-		continue
+		select {
+		case r := <-done:
+			collect(r)
+		case <-poll:
+		case <-settle:
+			logger.Warn("Stop waiting for %d logins of the volume attached through %s", pending, dm)
+			finish()
+		case <-timeout:
+			finish()
+			c.rollbackPaths(results, true)
+			logger.Error("no multipath device found for %v", devices, dmErr)
+			return "", c.failedPaths(results), exception.Wrap(exception.ErrDeviceNotFound, dmErr, "no multipath device found for %v", devices)
+		case <-ctx.Done():
+			finish()
+			c.rollbackPaths(results, true)
+			return "", c.failedPaths(results), ctx.Err()
+		}
+	}
+	if dm != "" {
+		failed := c.failedPaths(results)
+		if len(failed) > 0 {
+			logger.Warn("Volume is attached through %s without portals %v", dm, failed)
+			c.rollbackPaths(results, false)
+		}
+		return filepath.Join("/dev", dm), failed, nil
+	}
+
+	finish()
+	c.rollbackPaths(results, true)
+	failed := c.failedPaths(results)
+	var pathErr error
+	var reasons []string
+	for _, r := range results {
+		if r.err == nil {
+			continue
+		}
+		if pathErr == nil {
+			pathErr = r.err
+		} else {
+			reasons = append(reasons, fmt.Sprintf("portal %s: %v", r.target.Portal, r.err))
+		}
+	}
+	if pathErr == nil {
+		return "", failed, exception.Wrap(exception.ErrTargetUnreachable, nil, "volume has %d paths, %d needed", len(devices), minPaths)
+	}
+	summary := fmt.Sprintf("%d of %d paths connected, %d needed", len(devices), len(results), minPaths)
+	if len(reasons) > 0 {
+		summary += ": " + strings.Join(reasons, "; ")
+	}
+	return "", failed, fmt.Errorf("%s: portal %s: %w", summary, failed[0], pathErr)
+}
+
+// failedPaths Return the portals of the paths which did not connect, the
+// failures are logged
+func (c *ConnISCSI) failedPaths(results []pathResult) []string {
+	var failed []string
+	for _, r := range results {
+		if r.err != nil {
+			logger.Error("Failed to connect volume through portal %s", r.target.Portal, r.err)
+			failed = append(failed, r.target.Portal)
+		}
+	}
+	return failed
+}
+
+// transport Return the transport the sessions are opened with
+func (c *ConnISCSI) transport() string {
+	if c.Transport == "" {
+		return iscsi.TransportTCP
+	}
+	return c.Transport
+}
+
+// protocol Return the protocol the attachment is recorded with, ISER for iser
+// volumes so that they are rebuilt with the iser transport
+func (c *ConnISCSI) protocol() string {
+	if c.transport() == iscsi.TransportISER {
+		return "ISER"
+	}
+	return "ISCSI"
+}
+
+// iface Return the iface the nodes are bound to, the builtin iser iface for
+// iser volumes and the default iface, left implicit, for tcp ones
+func (c *ConnISCSI) iface() string {
+	if c.Iface == "" && c.transport() == iscsi.TransportISER {
+		return iscsi.TransportISER
+	}
+	return c.Iface
+}
+
+// checkIface Check the configured iface uses the transport of the volume
+func (c *ConnISCSI) checkIface(ctx context.Context) error {
+	if c.Iface == "" {
+		return nil
+	}
+	transport, err := iscsi.IfaceTransport(ctx, c.Executor, c.Iface)
+	if err != nil {
+		return err
+	}
+	if transport != c.transport() {
+		return exception.InvalidConnInfo("iscsi", "iface %s uses transport %s, the volume is attached with %s", c.Iface, transport, c.transport())
+	}
+	return nil
+}
+
+// minPaths Return how many paths a multipath attach needs
+func (c *ConnISCSI) minPaths() int {
+	if c.MinPaths < 1 {
+		return 1
+	}
+	return c.MinPaths
+}
+
+// findMultipathDevice Return the name of the dm device multipathd built
+// over at least minPaths of the devices, an exception.ErrDeviceNotFound
+// error tells why there is none yet
+func (c *ConnISCSI) findMultipathDevice(devices []string, minPaths int) (string, error) {
+	var lastErr error
+	for _, d := range devices {
+		dm, err := iscsi.FindSysfsMultipathDM(c.Root, d)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		slaves, err := c.Root.Glob("/sys/block/" + dm + "/slaves/*")
+		if err == nil && len(slaves) >= minPaths {
+			return dm, nil
+		}
+		lastErr = exception.Wrap(exception.ErrDeviceNotFound, nil, "multipath device %s has %d paths, %d needed", dm, len(slaves), minPaths)
+	}
+	return "", lastErr
+}
+
+// rollbackPaths Log out of the sessions the attach opened, only those of
+// the failed paths unless all is set. Sessions which other LUNs use meanwhile
+// are kept. The logouts run under their own timeout so that a cancelled
+// attach is cleaned up too. Failures are logged, the attach reports its own error
+func (c *ConnISCSI) rollbackPaths(results []pathResult, all bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	for _, r := range results {
+		if !r.opened || (!all && r.err == nil) {
+			continue
+		}
+		unlock, err := c.Locker.Lock(ctx, lock.TargetKey(r.target.Portal, r.target.Iqn))
+		if err != nil {
+			logger.Error("Lock target %s %s for rollback failed", r.target.Portal, r.target.Iqn, err)
+			continue
+		}
+		if err := iscsi.DisconnectUnusedSessions(ctx, c.Executor, c.Root, []iscsi.Target{r.target}); err != nil {
+			logger.Error("Roll back session of portal %s failed", r.target.Portal, err)
+		}
+		unlock()
 	}
-	return filepath.Join("/dev", dm), nil
 }
 
 //connectSinglePathVolume Connect to a volume using a single path.
-func (c *ConnISCSI) connectSinglePathVolume() (string, error) {
+func (c *ConnISCSI) connectSinglePathVolume(ctx context.Context) (string, error) {
 	var device string
 	var err error
 	target := c.getAllTargets()
 	for i := range target {
-		device, err = c.connVolume(target[i].Portal, target[i].Iqn, target[i].Lun)
+		device, _, err = c.connVolume(ctx, target[i].Portal, target[i].Iqn, target[i].Lun)
 		if err != nil {
 			logger.Error("Request connect iscsi singlepath volume failed", err)
 			return "", err
@@ -144,114 +483,150 @@ func (c *ConnISCSI) connectSinglePathVolume() (string, error) {
 }
 
 //getIpsIqnsLuns Build a list of ips, iqns, and luns, use iSCSI discovery to get the information
-func (c *ConnISCSI) getIpsIqnsLuns() []iscsi.Target {
-	if c.targetPortals != nil && c.targetIqns != nil {
+func (c *ConnISCSI) getIpsIqnsLuns(ctx context.Context) ([]iscsi.Target, error) {
+	if c.TargetPortals != nil && c.TargetIqns != nil {
 		ipsIqnsLuns := c.getAllTargets()
-		return ipsIqnsLuns
-	} else {
-		target := iscsi.DiscoverIscsiPortals(c.targetPortal, c.targetIqn, c.targetLun)
-		return target
+		return ipsIqnsLuns, nil
 	}
+	return iscsi.DiscoverIscsiPortals(ctx, c.Executor, c.TargetPortal, c.TargetIqn, c.TargetLun, c.iface(), c.DiscoveryAuth())
 }
 
 //getAllTargets Get target include ips, iqns, and luns
 func (c *ConnISCSI) getAllTargets() []iscsi.Target {
 	var allTarget []iscsi.Target
-	if len(c.targetPortals) > 1 && len(c.targetIqns) > 1 {
-		for i, portalIP := range c.targetPortals {
-			ips := iscsi.NewTarget(portalIP, c.targetIqns[i], c.targetLun)
+	if len(c.TargetPortals) > 0 && len(c.TargetIqns) == len(c.TargetPortals) {
+		for i, portalIP := range c.TargetPortals {
+			ips := iscsi.NewTarget(portalIP, c.TargetIqns[i], c.TargetLuns[i])
+			ips.Iface = c.iface()
 			allTarget = append(allTarget, ips)
 		}
 		return allTarget
 	}
-	ips := iscsi.NewTarget(c.targetPortal, c.targetIqn, c.targetLun)
+	ips := iscsi.NewTarget(c.TargetPortal, c.TargetIqn, c.TargetLun)
+	ips.Iface = c.iface()
 	allTarget = append(allTarget, ips)
 	return allTarget
 }
 
 //connVolume Make a connection to a volume, send scans and wait for the device.
-func (c *ConnISCSI) connVolume(portal string, iqn string, lun int) (string, error) {
-	sessionId, err := c.connectToIscsiPortal(portal, iqn)
+// opened tells whether the session was opened by this call
+func (c *ConnISCSI) connVolume(ctx context.Context, portal string, iqn string, lun int) (string, bool, error) {
+	// The target lock keeps another process from logging out of the
+	// target while this one logs in and scans its lun
+	unlock, err := c.Locker.Lock(ctx, lock.TargetKey(portal, iqn))
+	if err != nil {
+		return "", false, err
+	}
+	defer unlock()
+	sessionId, opened, err := c.connectToIscsiPortal(ctx, portal, iqn)
 	if err != nil {
 		logger.Error("Failed get iscsi session failed", err)
-		return "", err
+		return "", opened, err
 	}
-	hctl, err := iscsi.GetHctl(sessionId, lun)
+	hctl, err := iscsi.GetHctl(c.Root, sessionId, lun)
 	if err != nil {
 		logger.Error("Failed get volume hctl ", err)
-		return "", err
+		return "", opened, err
 	}
-	if err := iscsi.ScanISCSI(hctl); err != nil {
+	if err := iscsi.ScanISCSI(ctx, c.Executor, c.Root, hctl); err != nil {
 		logger.Error("Failed to rescan target", err)
-		return "", err
+		return "", opened, err
 	}
-	device, err := iscsi.GetDeviceName(sessionId, hctl)
+	device, err := iscsi.GetDeviceName(ctx, c.Executor, c.Root, sessionId, hctl)
 	if err != nil {
 		logger.Error("Failed to get device name", err)
-		return "", err
+		return "", opened, err
 	}
 	logger.Debug("Connect volume [portal %s, iqn %s] success", portal, iqn)
-	return device, nil
+	return device, opened, nil
 }
 
-//connectToIscsiPortal Connect to iSCSI portal-target and return the session id
-func (c *ConnISCSI) connectToIscsiPortal(portal string, iqn string) (int, error) {
-	var err error
-	if err := c.loginPortal(portal, iqn); err != nil {
+//connectToIscsiPortal Connect to iSCSI portal-target and return the session id,
+// opened is false when the session existed before
+func (c *ConnISCSI) connectToIscsiPortal(ctx context.Context, portal string, iqn string) (int, bool, error) {
+	opened := true
+	sessions, err := iscsi.GetSessions(ctx, c.Executor)
+	if err != nil {
+		logger.Error("Get iscsi session failed", err)
+		return -1, false, err
+	}
+	for _, session := range sessions {
+		if session.TargetPortal == portal && session.IQN == iqn {
+			opened = false
+		}
+	}
+	if loggedIn, err := c.loginPortal(ctx, portal, iqn); err != nil {
+		// The session is open when a step after the login failed or was
+		// cancelled, the rollback has to log out of it
 		logger.Error("Iscsi login portal failed", err)
-		return -1, err
+		return -1, opened && loggedIn, err
 	}
 	for i := 0; i < RetryCount; i++ {
-		sessions, err := iscsi.GetSessions()
+		sessions, err := iscsi.GetSessions(ctx, c.Executor)
 		if err != nil {
 			logger.Error("Get iscsi session failed", err)
-			return 0, err
+			return 0, opened, err
 		}
 		for _, session := range sessions {
 			if session.TargetPortal == portal && session.IQN == iqn {
-				return session.SessionID, nil
+				return session.SessionID, opened, nil
 			}
 		}
+		if err := utils.Sleep(ctx, 1*time.Second); err != nil {
+			return -1, opened, err
+		}
 	}
-	return -1, err
+	return -1, opened, exception.Wrap(exception.ErrSessionNotFound, nil, "no session for portal %s iqn %s after login", portal, iqn)
 }
 
-//loginPortal login iscsi partal
-func (c *ConnISCSI) loginPortal(portal string, iqn string) error {
+//loginPortal login iscsi partal, the bool tells the login itself succeeded
+// even when a later step failed
+func (c *ConnISCSI) loginPortal(ctx context.Context, portal string, iqn string) (bool, error) {
 	var err error
-	args := []string{"-m", "discovery", "-t", "sendtargets", "-p", portal}
-	_, err = utils.Execute("iscsiadm", args...)
+	_, err = iscsi.Discover(ctx, c.Executor, portal, c.iface(), c.DiscoveryAuth())
 	if err != nil {
 		logger.Error("Exec iscsiadm discovery %s %s command failed", portal, iqn, err)
-		return err
+		return false, err
 	}
 
-	if c.authMethod == "CHAP" {
-		_, _ = utils.UpdateIscsiadm(portal, iqn, "node.session.auth.authmethod", c.authMethod, nil)
-		_, _ = utils.UpdateIscsiadm(portal, iqn, "node.session.auth.username", c.authUsername, nil)
-		_, _ = utils.UpdateIscsiadm(portal, iqn, "node.session.auth.password", c.authPassword, nil)
+	if err := iscsi.SetNodeAuth(ctx, c.Executor, portal, iqn, c.iface(), c.SessionAuth()); err != nil {
+		logger.Error("Set CHAP credentials of %s %s failed", portal, iqn, err)
+		return false, err
 	}
 
-	_, err = utils.ExecIscsiadm(portal, iqn, []string{"--login"})
+	_, err = utils.ExecIscsiadm(ctx, c.Executor, portal, iqn, append(iscsi.IfaceArgs(c.iface()), "--login"))
+	if errors.Is(err, exception.ErrSessionExists) {
+		logger.Info("iscsiadm portal %s is already logged in", portal)
+		err = nil
+	}
 	if err != nil {
 		logger.Error("Exec iscsiadm login %s %s command failed", portal, iqn, err)
-		return err
+		return false, err
 	}
 
-	_, err = utils.UpdateIscsiadm(portal, iqn, "node.startup", "automatic", nil)
+	_, err = utils.UpdateIscsiadm(ctx, c.Executor, portal, iqn, "node.startup", "automatic", iscsi.IfaceArgs(c.iface()))
 	if err != nil {
 		logger.Error("Exec iscsiadm update command failed", err)
-		return err
+		return true, err
 	}
 	logger.Debug("iscsiadm portal %s login success", portal)
-	return nil
+	return true, nil
 }
 
 //cleanupConnection Cleans up connection flushing and removing devices and multipath
-func (c *ConnISCSI) cleanupConnection() error {
+func (c *ConnISCSI) cleanupConnection(ctx context.Context) error {
 	var err error
 	target := c.getAllTargets()
-	deviceMap, err := iscsi.GetConnectionDevices(target)
+	var keys []string
+	for _, t := range target {
+		keys = append(keys, lock.TargetKey(t.Portal, t.Iqn))
+	}
+	unlock, err := c.Locker.LockAll(ctx, keys...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	deviceMap, err := iscsi.GetConnectionDevices(ctx, c.Executor, c.Root, target)
 	if err != nil {
 		logger.Error("Get iscsi connection device failed", err)
 		return err
@@ -262,13 +637,13 @@ func (c *ConnISCSI) cleanupConnection() error {
 		isMultiPath = true
 	}
 
-	err = iscsi.RemoveConnection(deviceMap, isMultiPath)
+	err = iscsi.RemoveConnection(ctx, c.Executor, c.Root, deviceMap, isMultiPath)
 	if err != nil {
 		logger.Error("Remove iscsi connection failed", err)
 		return err
 	}
 
-	if err = iscsi.DisconnectConnection(target); err != nil {
+	if err = iscsi.DisconnectUnusedSessions(ctx, c.Executor, c.Root, target); err != nil {
 		logger.Error("failed to disconnet iSCSI connection", err)
 		return err
 	}
@@ -0,0 +1,56 @@
+package local
+
+import (
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+)
+
+// ConnInfo is the local volume connection info
+type ConnInfo struct {
+	VolumeID string
+}
+
+// rawConnInfo is the wire form of ConnInfo
+type rawConnInfo struct {
+	VolumeID utils.String `json:"volume_id"`
+}
+
+// ParseConnInfo Build a validated ConnInfo from a connection info map, the
+// volume id is read from the data section and falls back to the top level
+func ParseConnInfo(connInfo map[string]interface{}) (*ConnInfo, error) {
+	var raw rawConnInfo
+	source := connInfo
+	if data, ok := connInfo["data"].(map[string]interface{}); ok && data["volume_id"] != nil {
+		source = data
+	}
+	if err := utils.DecodeValue(source, &raw); err != nil {
+		return nil, exception.InvalidConnInfo("local", "%v", err)
+	}
+	info := &ConnInfo{VolumeID: string(raw.VolumeID)}
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DecodeConnInfo Build a validated ConnInfo from the JSON of a cinder initialize_connection call
+func DecodeConnInfo(b []byte) (*ConnInfo, error) {
+	connInfo, err := utils.ParseConnInfoJSON(b)
+	if err != nil {
+		return nil, exception.InvalidConnInfo("local", "%v", err)
+	}
+	return ParseConnInfo(connInfo)
+}
+
+// Validate Check the connection info is complete
+func (i *ConnInfo) Validate() error {
+	if i.VolumeID == "" {
+		return exception.InvalidConnInfo("local", "volume_id is required")
+	}
+	if strings.ContainsAny(i.VolumeID, "/*?[") {
+		return exception.InvalidConnInfo("local", "volume_id %q contains path or glob characters", i.VolumeID)
+	}
+	return nil
+}
@@ -1,88 +1,165 @@
 package local
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/lock"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
 
 //ConnLocal A local volume type object
 type ConnLocal struct {
-	volumeID   string
+	volumeID string
+	// Executor runs lvdisplay, it runs directly when nil
+	Executor utils.Executor
+	// Store records the attachment, nothing is recorded when it is nil
+	Store state.Store
+	// Locker serializes the operations on the volume between processes, there is no locking when it is nil
+	Locker *lock.Locker
+	// Root is where the host devfs is mounted, device paths stay relative to the host
+	Root sysfs.Root
+
+	connInfo map[string]interface{}
 }
 
 //NewLocalConnector Build a local volume type connection object
-func NewLocalConnector(connInfo map[string]interface{}) *ConnLocal {
-	conn := &ConnLocal{}
-	conn.volumeID = utils.ToString(connInfo["volume_id"])
-	return conn
+func NewLocalConnector(connInfo map[string]interface{}) (*ConnLocal, error) {
+	info, err := ParseConnInfo(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	conn := &ConnLocal{connInfo: connInfo}
+	conn.volumeID = info.VolumeID
+	return conn, nil
 }
 
 //ConnectVolume Connect the local volume
-func (c *ConnLocal) ConnectVolume() (map[string]string, error) {
+func (c *ConnLocal) ConnectVolume(ctx context.Context) (map[string]string, error) {
 	res := map[string]string{}
-	globStr := fmt.Sprintf("/dev/*/*%s", c.volumeID)
-	paths, err := filepath.Glob(globStr)
+	unlock, err := c.Locker.Lock(ctx, lock.VolumeKey(c.volumeID))
 	if err != nil {
 		return nil, err
 	}
-	if len(paths) != 1 {
+	defer unlock()
+	path, err := c.findDevice()
+	if err != nil {
 		logger.Error("lvm volume path not found", err)
 		return nil, err
 	}
-	logger.Info("Get lvm path success", paths[0])
-	res["path"] = paths[0]
+	logger.Info("Get lvm path success", path)
+	res["path"] = path
+	err = state.Save(c.Store, &state.Attachment{
+		ID:         c.AttachmentID(),
+		Protocol:   "LOCAL",
+		VolumeID:   c.volumeID,
+		ConnInfo:   c.connInfo,
+		DevicePath: path,
+	})
+	if err != nil {
+		logger.Error("Record local attachment failed", err)
+		return nil, err
+	}
 	return res, nil
 }
 
 //DisConnectVolume DisConnect the local volume
-func (c *ConnLocal) DisConnectVolume() error {
+func (c *ConnLocal) DisConnectVolume(ctx context.Context) error {
+	unlock, err := c.Locker.Lock(ctx, lock.VolumeKey(c.volumeID))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := state.Forget(c.Store, c.AttachmentID()); err != nil {
+		logger.Error("Remove local attachment record failed", err)
+		return err
+	}
 	logger.Info("local volume disconnect volume success")
 	return nil
 }
 
 //ExtendVolume Extend the local volume
-func (c *ConnLocal) ExtendVolume() (int64, error) {
-	globStr := fmt.Sprintf("/dev/*/*%s", c.volumeID)
-	paths, err := filepath.Glob(globStr)
+func (c *ConnLocal) ExtendVolume(ctx context.Context) (int64, error) {
+	unlock, err := c.Locker.Lock(ctx, lock.VolumeKey(c.volumeID))
 	if err != nil {
 		return 0, err
 	}
-	if len(paths) != 1 {
+	defer unlock()
+	path, err := c.findDevice()
+	if err != nil {
 		logger.Error("lvm volume path not found", err)
 		return 0, err
 	}
-	sizeCmd := fmt.Sprintf("lvdisplay --units B %s 2>&1 | grep 'LV Size' | awk '{print $3}'", globStr)
-	out, err := utils.Execute(sizeCmd)
+	out, err := utils.Exec(ctx, c.Executor, "lvdisplay", "--units", "B", path)
 	if err != nil {
 		logger.Error("Exec lvdisplay command failed", err)
 		return 0, err
 	}
-	sizeStr := strings.Split(out, ".")[0]
-	sizeInt, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 10, 64)
+	sizeInt, err := parseLvSize(out)
 	if err != nil {
 		logger.Error("Parse lvm size failed", err)
 		return 0, err
 	}
 	logger.Info("Get lvm size success", sizeInt)
+	err = state.Update(c.Store, c.AttachmentID(), func(a *state.Attachment) {
+		a.DevicePath = path
+		a.Size = sizeInt
+	})
+	if err != nil {
+		logger.Error("Record local attachment failed", err)
+		return 0, err
+	}
 	return sizeInt, nil
 }
 
 //GetDevicePath Get the volume device path
-func (c *ConnLocal) GetDevicePath() string {
-	globStr := fmt.Sprintf("/dev/*/*%s", c.volumeID)
-	paths, err := filepath.Glob(globStr)
+func (c *ConnLocal) GetDevicePath(ctx context.Context) string {
+	path, err := c.findDevice()
 	if err != nil {
+		logger.Error("lvm volume path not found", err)
 		return ""
 	}
+	logger.Info("Get lvm path success", path)
+	return path
+}
+
+//AttachmentID Return the id the attachment is recorded under
+func (c *ConnLocal) AttachmentID() string {
+	return "local:" + c.volumeID
+}
+
+//findDevice Find the single device whose name ends with the volume id
+func (c *ConnLocal) findDevice() (string, error) {
+	globStr := fmt.Sprintf("/dev/*/*%s", c.volumeID)
+	paths, err := c.Root.Glob(globStr)
+	if err != nil {
+		return "", exception.Wrap(exception.ErrDeviceNotFound, err, "glob %s", globStr)
+	}
 	if len(paths) != 1 {
-		logger.Error("lvm volume path not found", err)
-		return ""
+		return "", exception.Wrap(exception.ErrDeviceNotFound, nil, "found %d devices matching %s", len(paths), globStr)
 	}
-	logger.Info("Get lvm path success", paths[0])
-	return paths[0]
-}
\ No newline at end of file
+	return paths[0], nil
+}
+
+//parseLvSize Parse the size in bytes from the LV Size line of lvdisplay --units B
+func parseLvSize(out string) (int64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "LV" || fields[1] != "Size" {
+			continue
+		}
+		sizeStr := strings.Split(fields[2], ".")[0]
+		sizeInt, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			return 0, exception.Wrap(exception.ErrUnexpectedOutput, err, "lvdisplay size %q", fields[2])
+		}
+		return sizeInt, nil
+	}
+	return 0, exception.Wrap(exception.ErrUnexpectedOutput, nil, "lvdisplay output has no LV Size line")
+}
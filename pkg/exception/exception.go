@@ -0,0 +1,172 @@
+// Package exception defines the errors returned by the connectors. Every
+// failure matches one of the sentinel errors below through errors.Is, and
+// failed external commands can be inspected with errors.As and *CommandError.
+package exception
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrDeviceNotFound the local device of a volume or one of its sysfs entries does not exist
+	ErrDeviceNotFound = errors.New("device not found")
+	// ErrAlreadyAttached the volume is already attached to this host
+	ErrAlreadyAttached = errors.New("volume is already attached")
+	// ErrVolumeBusy the volume device is still in use and can not be detached
+	ErrVolumeBusy = errors.New("volume is busy")
+	// ErrAuthFailed the storage backend rejected our credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrTargetUnreachable the storage target or monitor could not be reached
+	ErrTargetUnreachable = errors.New("target unreachable")
+	// ErrSessionNotFound no iscsi session exists for the target
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSessionExists an iscsi session already exists for the target
+	ErrSessionExists = errors.New("session already exists")
+	// ErrInvalidConnInfo the connection info is missing fields or inconsistent
+	ErrInvalidConnInfo = errors.New("invalid connection info")
+	// ErrCommandNotFound a required executable is not installed
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrCommandFailed an external command exited with an error
+	ErrCommandFailed = errors.New("command failed")
+	// ErrUnexpectedOutput a command output or a sysfs file could not be parsed
+	ErrUnexpectedOutput = errors.New("unexpected output")
+	// ErrTimeout an operation did not complete within its retry budget
+	ErrTimeout = errors.New("operation timed out")
+	// ErrAttachmentNotFound the state store has no record of the attachment
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	// ErrUnsupportedFeature the host can not attach the volume because it lacks a feature the volume uses
+	ErrUnsupportedFeature = errors.New("unsupported feature")
+	// ErrIO reading or writing a device, sysfs or state file failed
+	ErrIO = errors.New("i/o error")
+)
+
+// CommandError is returned when an external command fails
+type CommandError struct {
+	// Argv is the command and its arguments
+	Argv []string
+	// ExitCode is the exit status, -1 when the command did not run or was killed
+	ExitCode int
+	// Stdout is the standard output of the command
+	Stdout string
+	// Stderr is the standard error of the command
+	Stderr string
+	// Reason is the sentinel error the failure was classified as, it may be nil
+	Reason error
+	// Err is the underlying error from os/exec or the context
+	Err error
+}
+
+// NewCommandError Build a CommandError from the result of running argv
+func NewCommandError(argv []string, stdout, stderr string, err error) *CommandError {
+	e := &CommandError{
+		Argv:     argv,
+		ExitCode: -1,
+		Stdout:   stdout,
+		Stderr:   stderr,
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		e.Reason = ErrCommandNotFound
+	}
+	return e
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("command %q failed", strings.Join(e.Argv, " "))
+	if e.ExitCode >= 0 {
+		msg = fmt.Sprintf("%s with exit code %d", msg, e.ExitCode)
+	} else if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	if out := strings.TrimSpace(e.Stderr); out != "" {
+		msg = fmt.Sprintf("%s: %s", msg, out)
+	}
+	return msg
+}
+
+// Unwrap Return the underlying os/exec or context error
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a CommandError match ErrCommandFailed and its Reason
+func (e *CommandError) Is(target error) bool {
+	if target == ErrCommandFailed {
+		return true
+	}
+	return e.Reason != nil && errors.Is(e.Reason, target)
+}
+
+// ConnInfoError is returned when a connection info fails validation
+type ConnInfoError struct {
+	Protocol string
+	Reason   string
+}
+
+// InvalidConnInfo Build a ConnInfoError for protocol
+func InvalidConnInfo(protocol, format string, args ...interface{}) error {
+	return &ConnInfoError{Protocol: protocol, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (e *ConnInfoError) Error() string {
+	return fmt.Sprintf("invalid %s connection info: %s", e.Protocol, e.Reason)
+}
+
+// Is makes a ConnInfoError match ErrInvalidConnInfo
+func (e *ConnInfoError) Is(target error) bool {
+	return target == ErrInvalidConnInfo
+}
+
+// Wrap Annotate err with a sentinel so that errors.Is matches kind, the
+// message of err is kept but it is no longer unwrapped
+func Wrap(kind error, err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", kind, msg, err)
+	}
+	return fmt.Errorf("%w: %s", kind, msg)
+}
+
+// BusyError is returned when a device can not be released because it is
+// still held by other devices or mounted
+type BusyError struct {
+	// Device is the busy device
+	Device string
+	// Holders are the devices stacked on the device, such as dm-0
+	Holders []string
+	// Mounts are the mount points of the device and its partitions
+	Mounts []string
+	// Err is the error of the last release attempt, it may be nil
+	Err error
+}
+
+func (e *BusyError) Error() string {
+	msg := fmt.Sprintf("device %s is busy", e.Device)
+	if len(e.Holders) > 0 {
+		msg = fmt.Sprintf("%s, held by %s", msg, strings.Join(e.Holders, ", "))
+	}
+	if len(e.Mounts) > 0 {
+		msg = fmt.Sprintf("%s, mounted on %s", msg, strings.Join(e.Mounts, ", "))
+	}
+	if e.Err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, e.Err)
+	}
+	return msg
+}
+
+// Unwrap Return the error of the last release attempt
+func (e *BusyError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes a BusyError match ErrVolumeBusy
+func (e *BusyError) Is(target error) bool {
+	return target == ErrVolumeBusy
+}
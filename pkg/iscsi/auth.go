@@ -0,0 +1,127 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+// Auth is the CHAP configuration of iscsi sessions or of sendtargets discovery
+type Auth struct {
+	// Method is CHAP, or empty when the target does not authenticate the initiator
+	Method   string
+	Username string
+	Password string
+	// UsernameIn and PasswordIn are the credentials the target presents to
+	// the initiator, they are only set for mutual CHAP
+	UsernameIn string
+	PasswordIn string
+}
+
+// Enabled Check CHAP is used
+func (a Auth) Enabled() bool {
+	return strings.EqualFold(a.Method, "CHAP")
+}
+
+// Mutual Check the target authenticates itself to the initiator too
+func (a Auth) Mutual() bool {
+	return a.UsernameIn != "" || a.PasswordIn != ""
+}
+
+// Validate Check the credentials are complete, field prefixes the names of
+// the connection info fields in the error
+func (a Auth) Validate(protocol, field string) error {
+	if a.Method != "" && !a.Enabled() {
+		return exception.InvalidConnInfo(protocol, "unsupported %s_method %q", field, a.Method)
+	}
+	if a.Enabled() && (a.Username == "" || a.Password == "") {
+		return exception.InvalidConnInfo(protocol, "CHAP %s requires %s_username and %s_password", field, field, field)
+	}
+	if a.Mutual() && !a.Enabled() {
+		return exception.InvalidConnInfo(protocol, "mutual CHAP requires %s_method CHAP", field)
+	}
+	if a.Mutual() && (a.UsernameIn == "" || a.PasswordIn == "") {
+		return exception.InvalidConnInfo(protocol, "mutual CHAP requires %s_username_in and %s_password_in", field, field)
+	}
+	return nil
+}
+
+// settings Return the iscsiadm settings of the credentials under prefix, in
+// the order they are applied
+func (a Auth) settings(prefix string) [][2]string {
+	s := [][2]string{
+		{prefix + ".authmethod", "CHAP"},
+		{prefix + ".username", a.Username},
+		{prefix + ".password", a.Password},
+	}
+	if a.Mutual() {
+		s = append(s, [2]string{prefix + ".username_in", a.UsernameIn}, [2]string{prefix + ".password_in", a.PasswordIn})
+	}
+	return s
+}
+
+// SetNodeAuth Record the session CHAP credentials in the node of a target
+// bound to iface, the node must exist, discovery creates it
+func SetNodeAuth(ctx context.Context, e utils.Executor, portal string, iqn string, iface string, auth Auth) error {
+	if !auth.Enabled() {
+		return nil
+	}
+	for _, kv := range auth.settings("node.session.auth") {
+		args := append([]string{"-m", "node", "-T", iqn, "-p", portal}, IfaceArgs(iface)...)
+		args = append(args, "--op", "update", "-n", kv[0], "-v", kv[1])
+		if err := runAuthUpdate(ctx, e, args); err != nil {
+			logger.Error("failed to set %s of node %s %s", kv[0], portal, iqn, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Discover Run sendtargets discovery on portal through iface and return the
+// iscsiadm output, the nodes it creates are bound to iface. With discovery
+// CHAP the credentials are recorded in the discovery database first, and
+// the discovery runs from that record
+func Discover(ctx context.Context, e utils.Executor, portal string, iface string, auth Auth) (string, error) {
+	if !auth.Enabled() {
+		args := append([]string{"-m", "discovery", "-t", "sendtargets"}, IfaceArgs(iface)...)
+		return utils.RunIscsiadm(ctx, e, append(args, "-p", portal)...)
+	}
+	db := append([]string{"-m", "discoverydb", "-t", "sendtargets"}, IfaceArgs(iface)...)
+	db = append(db, "-p", portal)
+	for i, kv := range auth.settings("discovery.sendtargets.auth") {
+		args := append(append([]string{}, db...), "--op", "update", "-n", kv[0], "-v", kv[1])
+		err := runAuthUpdate(ctx, e, args)
+		if i == 0 && errors.Is(err, exception.ErrSessionNotFound) {
+			// iscsiadm reports a missing discovery record as no objects found
+			if _, err = utils.RunIscsiadm(ctx, e, append(append([]string{}, db...), "--op", "new")...); err == nil {
+				err = runAuthUpdate(ctx, e, args)
+			}
+		}
+		if err != nil {
+			logger.Error("failed to set %s of discovery portal %s", kv[0], portal, err)
+			return "", err
+		}
+	}
+	return utils.RunIscsiadm(ctx, e, append(db, "--discover")...)
+}
+
+// runAuthUpdate Run an iscsiadm update of a credential, the value of the
+// passwords is masked in the returned error
+func runAuthUpdate(ctx context.Context, e utils.Executor, args []string) error {
+	_, err := utils.RunIscsiadm(ctx, e, args...)
+	var cmdErr *exception.CommandError
+	if errors.As(err, &cmdErr) {
+		masked := append([]string{}, cmdErr.Argv...)
+		for i := 2; i < len(masked); i++ {
+			if masked[i-1] == "-v" && strings.Contains(masked[i-2], "password") {
+				masked[i] = "***"
+			}
+		}
+		cmdErr.Argv = masked
+	}
+	return err
+}
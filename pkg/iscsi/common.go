@@ -1,6 +1,8 @@
 package iscsi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -8,6 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
@@ -21,39 +25,39 @@ type Hctl struct {
 }
 
 //GetHctl Given an iSCSI session return the host, channel, target, and lun
-func GetHctl(id int, lun int) (*Hctl, error) {
+func GetHctl(root sysfs.Root, id int, lun int) (*Hctl, error) {
 	globStr := fmt.Sprintf("/sys/class/iscsi_host/host*/device/session%d/target*", id)
-	paths, err := filepath.Glob(globStr)
+	paths, err := root.Glob(globStr)
 	if err != nil {
 		logger.Error("Failed to get session path", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrSessionNotFound, err, "glob %s", globStr)
 	}
 	if len(paths) != 1 {
 		logger.Error("target fail is not found", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrSessionNotFound, nil, "found %d targets for session %d", len(paths), id)
 	}
 	_, fileName := filepath.Split(paths[0])
 	ids := strings.Split(fileName, ":")
 	if len(ids) != 3 {
 		logger.Error("failed to parse iSCSI session filename", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, nil, "target name %s", fileName)
 	}
 	channelID, err := strconv.Atoi(ids[1])
 	if err != nil {
 		logger.Error("failed to parse channel ID", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "channel id of %s", fileName)
 	}
 	targetID, err := strconv.Atoi(ids[2])
 	if err != nil {
 		logger.Error("failed to parse target ID", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "target id of %s", fileName)
 	}
 	names := strings.Split(paths[0], "/")
 	hostIDstr := strings.TrimPrefix(searchHost(names), "host")
 	hostID, err := strconv.Atoi(hostIDstr)
 	if err != nil {
 		logger.Error("failed to parse host ID", err)
-		return nil, err
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "host id of %s", paths[0])
 	}
 	hctl := &Hctl{
 		HostID:    hostID,
@@ -75,40 +79,45 @@ func searchHost(names []string) string {
 }
 
 //ScanISCSI Send an iSCSI scan request given the host and optionally the ctl
-func ScanISCSI(hctl *Hctl) error {
+func ScanISCSI(ctx context.Context, e utils.Executor, root sysfs.Root, hctl *Hctl) error {
 	path := fmt.Sprintf("/sys/class/scsi_host/host%d/scan", hctl.HostID)
 	content := fmt.Sprintf("%d %d %d",
 		hctl.ChannelID,
 		hctl.TargetID,
 		hctl.HostLUNID)
 
-	return utils.EchoScsiCommand(path, content)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return utils.WriteFile(ctx, e, root.Path(path), content)
 }
 
 //GetDeviceName Add retry to get device name
-func GetDeviceName(sessionID int, hctl *Hctl) (string, error) {
+func GetDeviceName(ctx context.Context, e utils.Executor, root sysfs.Root, sessionID int, hctl *Hctl) (string, error) {
 	var lastErr error
 	for i := 0; i < 10; i++ {
 		// retry 10 times
-		deviceName, err := getDeviceName(sessionID, hctl)
+		deviceName, err := getDeviceName(root, sessionID, hctl)
 		if err == nil {
 			return deviceName, nil
 		}
 		logger.Debug("failed to get device name (sessionID: %d, hctl: %+v), do retry: %+v", sessionID, hctl, err)
 		lastErr = err
 
-		if err := ScanISCSI(hctl); err != nil {
+		if err := ScanISCSI(ctx, e, root, hctl); err != nil {
 			logger.Error("failed to scan iSCSI", err)
 			return "", err
 		}
 
-		time.Sleep(1 * time.Second)
+		if err := utils.Sleep(ctx, 1*time.Second); err != nil {
+			return "", err
+		}
 	}
 	return "", lastErr
 }
 
 //getDeviceName Get device on /sys/class/scsi_host dir name
-func getDeviceName(sessionID int, hctl *Hctl) (string, error) {
+func getDeviceName(root sysfs.Root, sessionID int, hctl *Hctl) (string, error) {
 	p := fmt.Sprintf(
 		"/sys/class/iscsi_host/host%d/device/session%d/target%d:%d:%d/%d:%d:%d:%d/block/*",
 		hctl.HostID,
@@ -116,35 +125,35 @@ func getDeviceName(sessionID int, hctl *Hctl) (string, error) {
 		hctl.HostID, hctl.ChannelID, hctl.TargetID,
 		hctl.HostID, hctl.ChannelID, hctl.TargetID, hctl.HostLUNID)
 
-	paths, err := filepath.Glob(p)
+	paths, err := root.Glob(p)
 	if err != nil {
 		logger.Error("failed to parse iSCSI block device filepath", err)
-		return "", err
+		return "", exception.Wrap(exception.ErrDeviceNotFound, err, "glob %s", p)
 	}
 	if len(paths) == 0 {
-		return "", fmt.Errorf("device filepath is not found")
+		return "", exception.Wrap(exception.ErrDeviceNotFound, nil, "no block device for session %d lun %d", sessionID, hctl.HostLUNID)
 	}
 	_, deviceName := filepath.Split(paths[0])
 	return deviceName, nil
 }
 
 //removeScsiDevice Removes a scsi device based upon /dev/sdX name
-func removeScsiDevice(devicePath string) error {
+func removeScsiDevice(ctx context.Context, e utils.Executor, root sysfs.Root, devicePath string) error {
 	deviceName := strings.TrimPrefix(devicePath, "/dev/")
 	deletePath := fmt.Sprintf("/sys/block/%s/device/delete", deviceName)
-	_, err := os.Stat(deletePath)
+	_, err := root.Stat(deletePath)
 	if err != nil {
 		logger.Error("failed to stat device delete path", err)
-		return err
+		return exception.Wrap(exception.ErrDeviceNotFound, err, "stat %s", deletePath)
 	}
 
-	err = flushDeviceIO(devicePath)
+	err = flushDeviceIO(ctx, e, root, devicePath)
 	if err != nil {
 		logger.Error("failed to flush device I/O", err)
 		return err
 	}
 
-	err = utils.EchoScsiCommand(deletePath, "1")
+	err = utils.WriteFile(ctx, e, root.Path(deletePath), "1")
 	if err != nil {
 		logger.Error("failed to write to delete path", err)
 		return err
@@ -153,10 +162,10 @@ func removeScsiDevice(devicePath string) error {
 }
 
 //waitForVolumesRemoval Wait for device paths to be removed from the system
-func waitForVolumesRemoval(targetDevicePaths []string) bool {
+func waitForVolumesRemoval(root sysfs.Root, targetDevicePaths []string) bool {
 	exist := false
 	for _, devicePath := range targetDevicePaths {
-		_, err := os.Stat(devicePath)
+		_, err := root.Stat(devicePath)
 		if err == nil {
 			logger.Info("found not deleted volume: %s", devicePath)
 			exist = true
@@ -167,9 +176,9 @@ func waitForVolumesRemoval(targetDevicePaths []string) bool {
 }
 
 // GetConnectionDevices get volumes in paths
-func GetConnectionDevices(targets []Target) ([]string, error) {
+func GetConnectionDevices(ctx context.Context, e utils.Executor, root sysfs.Root, targets []Target) ([]string, error) {
 	var devices []string
-	sessions, err := GetSessions()
+	sessions, err := GetSessions(ctx, e)
 	if err != nil {
 		logger.Error("failed to get iSCSI sessions", err)
 		return nil, err
@@ -179,12 +188,12 @@ func GetConnectionDevices(targets []Target) ([]string, error) {
 			if session.TargetPortal != target.Portal || session.IQN != target.Iqn {
 				continue
 			}
-			hctl, err := GetHctl(session.SessionID, target.Lun)
+			hctl, err := GetHctl(root, session.SessionID, target.Lun)
 			if err != nil {
 				logger.Error("failed to get hctl info", err)
 				return nil, err
 			}
-			deviceName, err := GetDeviceName(session.SessionID, hctl)
+			deviceName, err := GetDeviceName(ctx, e, root, session.SessionID, hctl)
 			if err != nil {
 				logger.Error("failed to get device name", err)
 				return nil, err
@@ -198,44 +207,46 @@ func GetConnectionDevices(targets []Target) ([]string, error) {
 }
 
 //RemoveConnection Remove LUNs and multipath associated with devices names
-func RemoveConnection(targetDeviceNames []string, isMultiPath bool) error {
+func RemoveConnection(ctx context.Context, e utils.Executor, root sysfs.Root, targetDeviceNames []string, isMultiPath bool) error {
 	var devicePaths []string
 	var err error
 	for _, dn := range targetDeviceNames {
 		devicePaths = append(devicePaths, "/dev/"+dn)
 	}
-	if isMultiPath {
-		multiPathDeviceName, err := FindSysfsMultipathDM(targetDeviceNames[0])
+	if isMultiPath && len(targetDeviceNames) > 0 {
+		multiPathDeviceName, err := FindSysfsMultipathDM(root, targetDeviceNames[0])
 		if err != nil {
 			logger.Error("Find dm device failed", err)
 			return err
 		}
 		logger.Debug("Removing devices %v", devicePaths)
 		multiPathDevicePath := "/dev/" + multiPathDeviceName
-		err = flushMultipathDevice(multiPathDevicePath)
+		err = flushMultipathDevice(ctx, e, multiPathDevicePath)
 		logger.Debug("Flush multipath devices %v", devicePaths)
 		if err != nil {
 			logger.Error("Flush %s failed", multiPathDevicePath)
 		}
 	}
 	for _, devicePath := range devicePaths {
-		err := removeScsiDevice(devicePath)
+		err := removeScsiDevice(ctx, e, root, devicePath)
 		if err != nil {
-			return fmt.Errorf("timeout exceeded wait for volume removal")
+			return err
 		}
 	}
 	timeoutSecond := 10
-	for i := 0; waitForVolumesRemoval(targetDeviceNames); i++ {
+	for i := 0; waitForVolumesRemoval(root, devicePaths); i++ {
 		// until exist target volume.
 		logger.Info("wait removed target volume...")
-		time.Sleep(1 * time.Second)
+		if err := utils.Sleep(ctx, 1*time.Second); err != nil {
+			return err
+		}
 
 		if i == timeoutSecond {
 			logger.Error("timeout exceeded wait for volume removal")
-			return err
+			return exception.Wrap(exception.ErrTimeout, nil, "devices %v were not removed", devicePaths)
 		}
 	}
-	err = removeScsiSymlinks(devicePaths)
+	err = removeScsiSymlinks(root, devicePaths)
 	if err != nil {
 		logger.Error("failed to remove scsi symlinks", err)
 		return err
@@ -244,15 +255,15 @@ func RemoveConnection(targetDeviceNames []string, isMultiPath bool) error {
 }
 
 //removeScsiSymlinks Remove iscsi device link path
-func removeScsiSymlinks(devicePaths []string) error {
-	links, err := filepath.Glob("/dev/disk/by-id/scsi-*")
+func removeScsiSymlinks(root sysfs.Root, devicePaths []string) error {
+	links, err := root.Glob("/dev/disk/by-id/scsi-*")
 	if err != nil {
 		logger.Error("failed to get scsi link", err)
-		return err
+		return exception.Wrap(exception.ErrIO, err, "glob /dev/disk/by-id/scsi-*")
 	}
 	var removeTarget []string
 	for _, link := range links {
-		realpath, err := filepath.EvalSymlinks(link)
+		realpath, err := root.EvalSymlinks(link)
 		if err != nil {
 			logger.Error("failed to get realpath: %v", err)
 		}
@@ -265,19 +276,19 @@ func removeScsiSymlinks(devicePaths []string) error {
 		}
 	}
 	for _, l := range removeTarget {
-		err = os.Remove(l)
-		if err != nil {
+		err = root.Remove(l)
+		if err != nil && !os.IsNotExist(err) {
 			logger.Error("failed to delete symlink", err)
-			return err
+			return exception.Wrap(exception.ErrIO, err, "remove %s", l)
 		}
 	}
 	return nil
 }
 
 //DisconnectConnection Close iscsi connection
-func DisconnectConnection(targets []Target) error {
+func DisconnectConnection(ctx context.Context, e utils.Executor, targets []Target) error {
 	for _, p := range targets {
-		err := disconnectFromIscsiPortal(p.Portal, p.Iqn)
+		err := disconnectFromIscsiPortal(ctx, e, p.Portal, p.Iqn, p.Iface)
 		if err != nil {
 			logger.Error("failed to disconnect from iSCSI portal", err)
 			return err
@@ -286,19 +297,81 @@ func DisconnectConnection(targets []Target) error {
 	return nil
 }
 
-//disconnectFromIscsiPortal logout iscsi partal
-func disconnectFromIscsiPortal(portal string, iqn string) error {
-	_, err := utils.UpdateIscsiadm(portal, iqn, "node.startup", "manual", nil)
+// DisconnectUnusedSessions Log out of the sessions of the targets and delete
+// their node records, unless the sessions still have LUNs other than the
+// ones of the targets. Arrays export many volumes as LUNs of one target and
+// detaching one of them must not cut the I/O to the others
+func DisconnectUnusedSessions(ctx context.Context, e utils.Executor, root sysfs.Root, targets []Target) error {
+	sessions, err := GetSessions(ctx, e)
+	if err != nil {
+		logger.Error("failed to get iSCSI sessions", err)
+		return err
+	}
+	for _, t := range targets {
+		var others []int
+		for _, session := range sessions {
+			if session.TargetPortal != t.Portal || session.IQN != t.Iqn {
+				continue
+			}
+			luns, err := SessionLUNs(root, session.SessionID)
+			if err != nil {
+				return err
+			}
+			for _, lun := range luns {
+				if lun != t.Lun {
+					others = append(others, lun)
+				}
+			}
+		}
+		if len(others) > 0 {
+			logger.Info("keeping the session to portal %s target %s, it still has LUNs %v", t.Portal, t.Iqn, others)
+			continue
+		}
+		if err := DisconnectConnection(ctx, e, []Target{t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionLUNs Return the LUNs of the scsi devices of a session from sysfs
+func SessionLUNs(root sysfs.Root, id int) ([]int, error) {
+	globStr := fmt.Sprintf("/sys/class/iscsi_host/host*/device/session%d/target*/*:*:*:*", id)
+	paths, err := root.Glob(globStr)
+	if err != nil {
+		logger.Error("failed to list the devices of session %d", id, err)
+		return nil, exception.Wrap(exception.ErrIO, err, "glob %s", globStr)
+	}
+	var luns []int
+	for _, p := range paths {
+		ids := strings.Split(filepath.Base(p), ":")
+		lun, err := strconv.Atoi(ids[len(ids)-1])
+		if len(ids) != 4 || err != nil {
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "scsi device name %s", filepath.Base(p))
+		}
+		luns = append(luns, lun)
+	}
+	return luns, nil
+}
+
+//disconnectFromIscsiPortal logout iscsi partal, iface is the iface the node is bound to
+func disconnectFromIscsiPortal(ctx context.Context, e utils.Executor, portal string, iqn string, iface string) error {
+	_, err := utils.UpdateIscsiadm(ctx, e, portal, iqn, "node.startup", "manual", IfaceArgs(iface))
 	if err != nil {
 		logger.Error("failed to update node.startup to manual", err)
 		return err
 	}
-	_, err = utils.ExecIscsiadm(portal, iqn, []string{"--logout"})
+	_, err = utils.ExecIscsiadm(ctx, e, portal, iqn, append(IfaceArgs(iface), "--logout"))
+	// A path which failed to log in has no session left to log out of
+	if errors.Is(err, exception.ErrSessionNotFound) {
+		logger.Debug("no session to log out of for portal %s", portal)
+		err = nil
+	}
 	if err != nil {
 		logger.Error("Exec iscsiadm logout command failed", err)
 		return err
 	}
-	_, err = utils.ExecIscsiadm(portal, iqn, []string{"--op", "delete"})
+	_, err = utils.ExecIscsiadm(ctx, e, portal, iqn, append(IfaceArgs(iface), "--op", "delete"))
 	if err != nil {
 		logger.Error("failed to execute --op delete", err)
 		return err
@@ -308,14 +381,14 @@ func disconnectFromIscsiPortal(portal string, iqn string) error {
 }
 
 //flushDeviceIO This is used to flush any remaining IO in the buffers
-func flushDeviceIO(devicePath string) error {
-	_, err := os.Stat(devicePath)
+func flushDeviceIO(ctx context.Context, e utils.Executor, root sysfs.Root, devicePath string) error {
+	_, err := root.Stat(devicePath)
 	if err != nil {
 		logger.Error("failed to stat device path", err)
-		return err
+		return exception.Wrap(exception.ErrDeviceNotFound, err, "stat %s", devicePath)
 	}
 	args := []string{"--flushbufs", devicePath}
-	if _, err := utils.Execute("blockdev", args...); err != nil {
+	if _, err := utils.Exec(ctx, e, "blockdev", args...); err != nil {
 		logger.Error("failed to execute blockdev command", err)
 		return err
 	}
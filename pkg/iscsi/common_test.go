@@ -0,0 +1,200 @@
+package iscsi
+
+import (
+	"context"
+	"errors"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+)
+
+var fakeLayout = sysfstest.Layout{
+	Sessions: []sysfstest.Session{
+		{ID: 1, Host: 3, Target: 0, Portal: "10.0.0.1:3260", IQN: "iqn.2010-10.org.openstack:volume-1",
+			LUNs: []sysfstest.LUN{{LUN: 1, Device: "sda", Size: 1 << 30, WWID: "36001405aaaa"}}},
+		{ID: 2, Host: 4, Target: 0, Portal: "10.0.0.2:3260", IQN: "iqn.2010-10.org.openstack:volume-1",
+			LUNs: []sysfstest.LUN{{LUN: 1, Device: "sdb", Size: 1 << 30, WWID: "36001405aaaa"}}},
+	},
+	Multipath: []sysfstest.Multipath{{Name: "dm-0", Alias: "36001405aaaa", Slaves: []string{"sda", "sdb"}, Size: 1 << 30}},
+}
+
+// treeExecutor applies the sysfs writes and multipath flushes of the commands to a fake tree
+type treeExecutor struct {
+	tree     *sysfstest.Tree
+	commands []string
+
+	// lunSizes are the sizes the disks take when they are rescanned
+	lunSizes map[string]int64
+	// stuckMaps keeps the dm devices at their size on multipathd resize map
+	stuckMaps bool
+}
+
+func (e *treeExecutor) Run(ctx context.Context, cmd utils.Command) (utils.Result, error) {
+	e.commands = append(e.commands, cmd.String())
+	switch cmd.Name {
+	case "tee":
+		file := e.tree.Root.Logical(cmd.Args[len(cmd.Args)-1])
+		if strings.HasSuffix(file, "/device/delete") {
+			return utils.Result{}, e.tree.RemoveDisk(path.Base(path.Dir(path.Dir(file))))
+		}
+		if size, ok := e.lunSizes[path.Base(path.Dir(path.Dir(file)))]; ok && strings.HasSuffix(file, "/device/rescan") {
+			return utils.Result{}, e.tree.SetSize(path.Base(path.Dir(path.Dir(file))), size)
+		}
+		return utils.Result{}, nil
+	case "multipath":
+		return utils.Result{}, e.tree.RemoveMultipath(path.Base(cmd.Args[len(cmd.Args)-1]))
+	case "blockdev":
+		return utils.Result{}, nil
+	case "multipathd":
+		if e.stuckMaps {
+			return utils.Result{Stdout: "ok\n"}, nil
+		}
+		size, _ := e.tree.Root.ReadString("/sys/block/sda/size")
+		return utils.Result{Stdout: "ok\n"}, e.tree.WriteFile("/sys/block/"+cmd.Args[len(cmd.Args)-1]+"/size", size)
+	}
+	return utils.Result{}, errors.New("unexpected command " + cmd.String())
+}
+
+func TestSysfsLookups(t *testing.T) {
+	t.Parallel()
+	tree := sysfstest.New(t, fakeLayout)
+	hctl, err := GetHctl(tree.Root, 2, 1)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(hctl, &Hctl{HostID: 4, ChannelID: 0, TargetID: 0, HostLUNID: 1}) {
+		t.Errorf("Unexpected hctl %+v", hctl)
+	}
+	if _, err := GetHctl(tree.Root, 3, 1); !errors.Is(err, exception.ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+	name, err := getDeviceName(tree.Root, 2, hctl)
+	if err != nil || name != "sdb" {
+		t.Errorf("Expected sdb, got %q %v", name, err)
+	}
+	dm, err := FindSysfsMultipathDM(tree.Root, "sda")
+	if err != nil || dm != "dm-0" {
+		t.Errorf("Expected dm-0, got %q %v", dm, err)
+	}
+	if luns, err := SessionLUNs(tree.Root, 1); err != nil || !reflect.DeepEqual(luns, []int{1}) {
+		t.Errorf("Expected LUN 1 on session 1, got %v %v", luns, err)
+	}
+	if err := tree.RemoveDisk("sda"); err != nil {
+		t.Fatal(err)
+	}
+	if luns, err := SessionLUNs(tree.Root, 1); err != nil || len(luns) != 0 {
+		t.Errorf("Expected no LUN left on session 1, got %v %v", luns, err)
+	}
+}
+
+func TestRemoveConnection(t *testing.T) {
+	t.Parallel()
+	tree := sysfstest.New(t, fakeLayout)
+	executor := &treeExecutor{tree: tree}
+	err := RemoveConnection(context.Background(), executor, tree.Root, []string{"sda", "sdb"}, true)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []string{
+		"multipath -f /dev/dm-0",
+		"blockdev --flushbufs /dev/sda",
+		"tee -a " + tree.Root.Path("/sys/block/sda/device/delete"),
+		"blockdev --flushbufs /dev/sdb",
+		"tee -a " + tree.Root.Path("/sys/block/sdb/device/delete"),
+	}
+	if !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected, "\n"), strings.Join(executor.commands, "\n"))
+	}
+	for _, p := range []string{"/dev/sda", "/dev/sdb", "/dev/dm-0", "/dev/disk/by-id/scsi-36001405aaaa"} {
+		if tree.Root.Exists(p) {
+			t.Errorf("Expected %s to be removed", p)
+		}
+	}
+}
+
+func TestExtendDevices(t *testing.T) {
+	ctx := context.Background()
+	tree := sysfstest.New(t, fakeLayout)
+	executor := &treeExecutor{tree: tree, lunSizes: map[string]int64{"sda": 2 << 30, "sdb": 2 << 30}}
+	size, err := ExtendDevices(ctx, executor, tree.Root, []string{"sda", "sdb"})
+	if err != nil || size != 2<<30 {
+		t.Fatalf("Expected size %d, got %d %v", 2<<30, size, err)
+	}
+	if err := ResizeMultipathDevice(ctx, executor, tree.Root, "dm-0", size); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []string{
+		"tee -a " + tree.Root.Path("/sys/block/sda/device/rescan"),
+		"tee -a " + tree.Root.Path("/sys/block/sdb/device/rescan"),
+		"multipathd resize map dm-0",
+	}
+	if !reflect.DeepEqual(executor.commands, expected) {
+		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected, "\n"), strings.Join(executor.commands, "\n"))
+	}
+
+	defer func(count int) { ResizeRetryCount = count }(ResizeRetryCount)
+	ResizeRetryCount = 1
+	// A path rescanned before still counts as the new size
+	executor.lunSizes = map[string]int64{"sda": 3 << 30, "sdb": 3 << 30}
+	if err := tree.SetSize("sda", 3<<30); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := ExtendDevices(ctx, executor, tree.Root, []string{"sda", "sdb"}); err != nil || size != 3<<30 {
+		t.Errorf("Expected size %d, got %d %v", 3<<30, size, err)
+	}
+
+	// One path still reports the old size
+	executor.lunSizes = map[string]int64{"sda": 4 << 30}
+	_, err = ExtendDevices(ctx, executor, tree.Root, []string{"sda", "sdb"})
+	if !errors.Is(err, exception.ErrTimeout) || !strings.Contains(err.Error(), "sda=4294967296, sdb=3221225472") {
+		t.Errorf("Expected the sizes of the paths in a timeout error, got %v", err)
+	}
+
+	// The paths already report the new size before the rescan
+	executor.lunSizes = nil
+	if err := tree.SetSize("sda", 3<<30); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := ExtendDevices(ctx, executor, tree.Root, []string{"sda", "sdb"}); err != nil || size != 3<<30 {
+		t.Errorf("Expected size %d, got %d %v", 3<<30, size, err)
+	}
+
+	// The dm device keeps its size after multipathd resize map
+	executor.stuckMaps = true
+	if err := ResizeMultipathDevice(ctx, executor, tree.Root, "dm-0", 4<<30); !errors.Is(err, exception.ErrTimeout) {
+		t.Errorf("Expected ErrTimeout while the dm device keeps its size, got %v", err)
+	}
+}
+
+func TestParseSession(t *testing.T) {
+	t.Parallel()
+	out := `tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)
+iser: [2] [fd00::1]:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)
+qla4xxx: [3] 10.0.0.2:3260,-1 iqn.2010-10.org.openstack:volume-2 (flash)
+tcp: [4] 10.0.0.3:3260,2 iqn.2010-10.org.openstack:volume-3
+be2iscsi: [5] 10.0.0.4:3260 iqn.2010-10.org.openstack:volume-4
+iscsiadm: some warning
+`
+	sessions, err := parseSession(out)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []SessionIscsi{
+		{Transport: "tcp", SessionID: 1, TargetPortal: "10.0.0.1:3260", TargetPortalGroupTag: 1, IQN: "iqn.2010-10.org.openstack:volume-1", NodeType: "non-flash"},
+		{Transport: "iser", SessionID: 2, TargetPortal: "[fd00::1]:3260", TargetPortalGroupTag: 1, IQN: "iqn.2010-10.org.openstack:volume-1", NodeType: "non-flash"},
+		{Transport: "qla4xxx", SessionID: 3, TargetPortal: "10.0.0.2:3260", TargetPortalGroupTag: -1, IQN: "iqn.2010-10.org.openstack:volume-2", NodeType: "flash"},
+		{Transport: "tcp", SessionID: 4, TargetPortal: "10.0.0.3:3260", TargetPortalGroupTag: 2, IQN: "iqn.2010-10.org.openstack:volume-3"},
+		{Transport: "be2iscsi", SessionID: 5, TargetPortal: "10.0.0.4:3260", TargetPortalGroupTag: -1, IQN: "iqn.2010-10.org.openstack:volume-4"},
+	}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("Unexpected sessions %+v", sessions)
+	}
+	if _, err := parseSession("tcp: [x] 10.0.0.1:3260,1 iqn"); !errors.Is(err, exception.ErrUnexpectedOutput) {
+		t.Errorf("Expected ErrUnexpectedOutput, got %v", err)
+	}
+}
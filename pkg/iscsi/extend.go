@@ -0,0 +1,143 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+// ResizeRetryCount is how many times the sizes of the paths, and then of the
+// multipath device, are checked after a resize before giving up, one second apart
+var ResizeRetryCount int = 10
+
+// ExtendDevices Rescan the scsi devices of a volume and wait until they all
+// report the same size, no smaller than the size of the volume before the
+// rescan. The paths may already report the new size, when the kernel noticed
+// the change first or an earlier extend failed later on, the size is then
+// returned as it is. The new size of the volume in bytes is returned
+func ExtendDevices(ctx context.Context, e utils.Executor, root sysfs.Root, deviceNames []string) (int64, error) {
+	if len(deviceNames) == 0 {
+		return -1, exception.Wrap(exception.ErrDeviceNotFound, nil, "no scsi device to rescan")
+	}
+	sizes, err := deviceSizes(root, deviceNames)
+	if err != nil {
+		return -1, err
+	}
+	// Some paths may already have been rescanned, the volume has the size of the others
+	oldSize := int64(-1)
+	for _, s := range sizes {
+		if oldSize < 0 || s < oldSize {
+			oldSize = s
+		}
+	}
+	for _, name := range deviceNames {
+		rescanPath := fmt.Sprintf("/sys/block/%s/device/rescan", name)
+		if _, err := root.Stat(rescanPath); err != nil {
+			logger.Error("failed to stat device rescan path", err)
+			return -1, exception.Wrap(exception.ErrDeviceNotFound, err, "stat %s", rescanPath)
+		}
+		if err := utils.WriteFile(ctx, e, root.Path(rescanPath), "1"); err != nil {
+			logger.Error("failed to rescan %s", name, err)
+			return -1, err
+		}
+	}
+	for i := 0; i < ResizeRetryCount; i++ {
+		sizes, err = deviceSizes(root, deviceNames)
+		if err != nil {
+			return -1, err
+		}
+		if size, ok := sameSize(sizes); ok && size >= oldSize {
+			logger.Info("devices %v report size %d after rescan", deviceNames, size)
+			return size, nil
+		}
+		if i == ResizeRetryCount-1 {
+			break
+		}
+		logger.Info("wait for the paths to report the same size of at least %d: %s", oldSize, formatSizes(deviceNames, sizes))
+		if err := utils.Sleep(ctx, 1*time.Second); err != nil {
+			return -1, err
+		}
+	}
+	return -1, exception.Wrap(exception.ErrTimeout, nil, "paths of the volume do not report the same size of at least %d after rescan: %s",
+		oldSize, formatSizes(deviceNames, sizes))
+}
+
+// ResizeMultipathDevice Make multipathd resize the dm device to the size of
+// its paths and wait until the dm device reports it
+func ResizeMultipathDevice(ctx context.Context, e utils.Executor, root sysfs.Root, dmDeviceName string, size int64) error {
+	out, err := utils.Exec(ctx, e, "multipathd", "resize", "map", dmDeviceName)
+	if err != nil {
+		logger.Error("failed to execute multipathd resize map", err)
+		return err
+	}
+	// multipathd reports a failed command on stdout and exits with 0
+	if strings.TrimSpace(out) == "fail" {
+		return exception.Wrap(exception.ErrCommandFailed, nil, "multipathd resize map %s failed", dmDeviceName)
+	}
+	var sizes map[string]int64
+	for i := 0; i < ResizeRetryCount; i++ {
+		sizes, err = deviceSizes(root, []string{dmDeviceName})
+		if err != nil {
+			return err
+		}
+		if sizes[dmDeviceName] == size {
+			return nil
+		}
+		if i == ResizeRetryCount-1 {
+			break
+		}
+		logger.Info("wait for multipath device %s to report size %d, it has %d", dmDeviceName, size, sizes[dmDeviceName])
+		if err := utils.Sleep(ctx, 1*time.Second); err != nil {
+			return err
+		}
+	}
+	return exception.Wrap(exception.ErrTimeout, nil, "multipath device %s has size %d after resize, its paths have %d",
+		dmDeviceName, sizes[dmDeviceName], size)
+}
+
+// deviceSizes Read the sizes in bytes of block devices from /sys/block
+func deviceSizes(root sysfs.Root, deviceNames []string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	for _, name := range deviceNames {
+		sizePath := fmt.Sprintf("/sys/block/%s/size", name)
+		sectors, err := root.ReadString(sizePath)
+		if err != nil {
+			logger.Error("failed to read device size", err)
+			return nil, exception.Wrap(exception.ErrDeviceNotFound, err, "read %s", sizePath)
+		}
+		n, err := strconv.ParseInt(sectors, 10, 64)
+		if err != nil {
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse %s", sizePath)
+		}
+		sizes[name] = n * 512
+	}
+	return sizes, nil
+}
+
+// sameSize Return the size the devices share
+func sameSize(sizes map[string]int64) (int64, bool) {
+	size := int64(-1)
+	for _, s := range sizes {
+		if size >= 0 && s != size {
+			return -1, false
+		}
+		size = s
+	}
+	return size, true
+}
+
+// formatSizes Return the sizes of the devices as sda=1073741824, sdb=...
+func formatSizes(deviceNames []string, sizes map[string]int64) string {
+	var parts []string
+	for _, name := range deviceNames {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, sizes[name]))
+	}
+	return strings.Join(parts, ", ")
+}
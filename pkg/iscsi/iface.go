@@ -0,0 +1,41 @@
+package iscsi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+// The transports the iscsi connector logs in with
+const (
+	TransportTCP  = "tcp"
+	TransportISER = "iser"
+)
+
+// IfaceArgs Return the iscsiadm arguments binding a command to iface, none
+// for the default iface
+func IfaceArgs(iface string) []string {
+	if iface == "" {
+		return nil
+	}
+	return []string{"-I", iface}
+}
+
+// IfaceTransport Return the iface.transport_name of an iscsiadm iface record
+func IfaceTransport(ctx context.Context, e utils.Executor, iface string) (string, error) {
+	out, err := utils.RunIscsiadm(ctx, e, "-m", "iface", "-I", iface)
+	if err != nil {
+		logger.Error("failed to read iface %s", iface, err)
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "iface.transport_name" {
+			return strings.TrimSpace(kv[1]), nil
+		}
+	}
+	return "", exception.Wrap(exception.ErrUnexpectedOutput, nil, "iface %s has no iface.transport_name", iface)
+}
@@ -1,10 +1,13 @@
 package iscsi
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"strings"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
@@ -14,23 +17,24 @@ type Target struct {
 	Portal string
 	Iqn    string
 	Lun    int
+	// Iface is the iscsiadm iface the node is bound to, empty for the default one
+	Iface string
 }
 
-// DiscoverIscsiPortals get iscsi connection information
-func DiscoverIscsiPortals(portal string, iqn string, luns int) []Target {
+// DiscoverIscsiPortals get iscsi connection information through iface
+func DiscoverIscsiPortals(ctx context.Context, e utils.Executor, portal string, iqn string, luns int, iface string, auth Auth) ([]Target, error) {
 	var target []Target
 	var portals []string
 	var iqns []string
-	args := []string{"-m", "discovery", "-t", "sendtargets", "-p", portal}
-	out, err := utils.Execute("iscsiadm", args...)
+	out, err := Discover(ctx, e, portal, iface, auth)
 	if err != nil {
 		logger.Error("Exec iscsiadm discovery command failed", err)
-		return nil
+		return nil, err
 	}
 	entries := strings.Split(out, "\n")
 	for _, entry := range entries {
-		data := strings.Split(entry, " ")
-		if !strings.Contains(data[1], iqn) {
+		data := strings.Fields(entry)
+		if len(data) < 2 || !strings.Contains(data[1], iqn) {
 			continue
 		}
 		p := strings.Split(data[0], ",")[0]
@@ -40,10 +44,13 @@ func DiscoverIscsiPortals(portal string, iqn string, luns int) []Target {
 
 	for i, por := range portals {
 		t := NewTarget(por, iqns[i], luns)
+		t.Iface = iface
 		target = append(target, t)
 	}
-
-	return target
+	if len(target) == 0 {
+		return nil, exception.Wrap(exception.ErrTargetUnreachable, nil, "portal %s does not expose target %s", portal, iqn)
+	}
+	return target, nil
 }
 
 //NewTarget Build a target object include portal, iqn, lun
@@ -57,15 +64,15 @@ func NewTarget(portals string, iqns string, luns int) Target {
 }
 
 //FindSysfsMultipathDM Find the dm device name given a list of device names
-func FindSysfsMultipathDM(deviceName string) (dmDeviceName string, err error) {
+func FindSysfsMultipathDM(root sysfs.Root, deviceName string) (dmDeviceName string, err error) {
 	globStr := fmt.Sprintf("/sys/block/%s/holders/dm-*", deviceName)
-	paths, err := filepath.Glob(globStr)
+	paths, err := root.Glob(globStr)
 	if err != nil {
 		logger.Error("failed to glob dm device filepath", err)
-		return "", err
+		return "", exception.Wrap(exception.ErrDeviceNotFound, err, "glob %s", globStr)
 	}
 	if len(paths) == 0 {
-		return "", fmt.Errorf("dm device is not found")
+		return "", exception.Wrap(exception.ErrDeviceNotFound, nil, "no dm holder for %s", deviceName)
 	}
 
 	_, name := filepath.Split(paths[0])
@@ -73,9 +80,9 @@ func FindSysfsMultipathDM(deviceName string) (dmDeviceName string, err error) {
 }
 
 //flushMultipathDevice Flush dm device
-func flushMultipathDevice(targetMultipathPath string) error {
+func flushMultipathDevice(ctx context.Context, e utils.Executor, targetMultipathPath string) error {
 	args := []string{"-f", targetMultipathPath}
-	_, err := utils.Execute("multipath", args...)
+	_, err := utils.Exec(ctx, e, "multipath", args...)
 	if err != nil {
 		logger.Error("failed to execute multipath device flush command", err)
 		return err
@@ -1,9 +1,12 @@
 package iscsi
 
 import (
+	"context"
+	"errors"
 	"strconv"
 	"strings"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
@@ -14,13 +17,19 @@ type SessionIscsi struct {
 	TargetPortal         string
 	TargetPortalGroupTag int
 	IQN                  string
-	NodeType             string
+	// NodeType is flash for the sessions of the targets stored in the flash
+	// of an offload adapter, non-flash otherwise
+	NodeType string
 }
 
 //GetSessions access to the iscsi sessions
-func GetSessions() ([]SessionIscsi, error) {
+func GetSessions(ctx context.Context, e utils.Executor) ([]SessionIscsi, error) {
 	args := []string{"-m", "session"}
-	out, err := utils.Execute("iscsiadm", args...)
+	out, err := utils.RunIscsiadm(ctx, e, args...)
+	if errors.Is(err, exception.ErrSessionNotFound) {
+		// iscsiadm exits with an error when there is no active session
+		return nil, nil
+	}
 	if err != nil {
 		logger.Error("Exec iscsiadm -m session command failed", err)
 		return nil, err
@@ -33,35 +42,52 @@ func GetSessions() ([]SessionIscsi, error) {
 	return session, nil
 }
 
-//parseSession parse session content
+//parseSession parse the output of iscsiadm -m session, one line per session:
+//
+//	tcp: [1] 10.0.0.1:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)
+//	iser: [2] [fd00::1]:3260,1 iqn.2010-10.org.openstack:volume-1 (non-flash)
+//	qla4xxx: [3] 10.0.0.2:3260,1 iqn.2010-10.org.openstack:volume-2 (flash)
+//
+// Older open-iscsi releases print no node type and some offload transports
+// no portal group tag, lines which are not sessions are skipped
 func parseSession(out string) ([]SessionIscsi, error) {
-	lines := strings.Split(strings.TrimSpace(out), "\n")
-	re := strings.NewReplacer("[", "", "]", "")
 	var session []SessionIscsi
-	for _, line := range lines {
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
 		l := strings.Fields(line)
-		if len(l) < 4 {
+		if len(l) < 4 || !strings.HasSuffix(l[0], ":") || !strings.HasPrefix(l[1], "[") || !strings.HasSuffix(l[1], "]") {
+			if strings.TrimSpace(line) != "" {
+				logger.Warn("skipping iscsiadm session line %q", line)
+			}
 			continue
 		}
-		protocol := strings.Split(l[0], ":")[0]
-		id := re.Replace(l[1])
-		id64, _ := strconv.ParseInt(id, 10, 32)
-		portal := strings.Split(l[2], ",")[0]
-		portalTag, err := strconv.Atoi(strings.Split(l[2], ",")[1])
+		id, err := strconv.Atoi(strings.Trim(l[1], "[]"))
 		if err != nil {
-			logger.Error("failed to parse portal port group tag", err)
-			return nil, err
+			logger.Error("failed to parse session id", err)
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "session line %q", line)
+		}
+		portal, portalTag := l[2], -1
+		// the tag follows the last comma, IPv6 portals are bracketed and have none
+		if n := strings.LastIndex(l[2], ","); n >= 0 {
+			portal = l[2][:n]
+			portalTag, err = strconv.Atoi(l[2][n+1:])
+			if err != nil {
+				logger.Error("failed to parse portal port group tag", err)
+				return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "session line %q", line)
+			}
+		}
+		nodeType := ""
+		if len(l) > 4 {
+			nodeType = strings.Trim(l[4], "()")
 		}
 		s := SessionIscsi{
-			Transport:            protocol,
-			SessionID:            int(id64),
+			Transport:            strings.TrimSuffix(l[0], ":"),
+			SessionID:            id,
 			TargetPortal:         portal,
 			TargetPortalGroupTag: portalTag,
 			IQN:                  l[3],
-			NodeType:             strings.Split(l[3], ":")[1],
+			NodeType:             nodeType,
 		}
 		session = append(session, s)
-
 	}
 	return session, nil
 }
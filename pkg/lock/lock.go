@@ -0,0 +1,178 @@
+// Package lock serializes attach and detach operations of the processes of
+// a host with file locks
+package lock
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/wonderivan/logger"
+)
+
+const (
+	// DefaultDir is the lock directory of the connectors built by connectors.NewConnector
+	DefaultDir = "/var/lock/os-brick"
+	// DefaultTimeout bounds the wait for a lock of a Locker built by NewLocker
+	DefaultTimeout = 5 * time.Minute
+	// pollInterval is the delay between two attempts to take a busy lock
+	pollInterval = 100 * time.Millisecond
+)
+
+// Locker takes exclusive locks shared by all processes using the same
+// directory. A nil *Locker does not lock at all
+type Locker struct {
+	// Dir holds one lock file per key, it is created on first use
+	Dir string
+	// Timeout bounds the wait for a lock, zero waits until the context is done
+	Timeout time.Duration
+
+	mkdir sync.Once
+}
+
+// NewLocker Build a Locker keeping its lock files in dir
+func NewLocker(dir string) *Locker {
+	return &Locker{Dir: dir, Timeout: DefaultTimeout}
+}
+
+// Unlock releases a lock
+type Unlock func()
+
+// VolumeKey Return the lock key of a volume
+func VolumeKey(volumeID string) string {
+	return "volume-" + volumeID
+}
+
+// TargetKey Return the lock key of an iscsi target
+func TargetKey(portal, iqn string) string {
+	return "iscsi-" + portal + "-" + iqn
+}
+
+// ImageKey Return the lock key of an rbd image of a cluster
+func ImageKey(cluster, pool, image string) string {
+	return "rbd-" + cluster + "-" + pool + "-" + image
+}
+
+// Lock Take the lock of key, waiting while another process or goroutine
+// holds it. The wait ends with an exception.ErrTimeout error after
+// l.Timeout, or with the context error when ctx is done first
+func (l *Locker) Lock(ctx context.Context, key string) (Unlock, error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	var err error
+	l.mkdir.Do(func() {
+		err = os.MkdirAll(l.Dir, 0755)
+	})
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "create lock directory %s", l.Dir)
+	}
+	path := filepath.Join(l.Dir, url.PathEscape(key)+".lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "open lock file %s", path)
+	}
+	if l.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	logged := false
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, exception.Wrap(exception.ErrIO, err, "lock %s", path)
+		}
+		if !logged {
+			logger.Warn("waiting for lock %s held by %s", key, holder(path))
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, exception.Wrap(exception.ErrTimeout, ctx.Err(), "lock %s held by %s", key, holder(path))
+			}
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+	if logged {
+		logger.Info("took lock %s after %s", key, time.Since(start))
+	}
+	writeHolder(f, key)
+	logger.Debug("took lock %s", key)
+	return func() {
+		f.Close()
+		logger.Debug("released lock %s", key)
+	}, nil
+}
+
+// LockAll Take the locks of keys in sorted order, so that two callers
+// locking overlapping sets can not deadlock
+func (l *Locker) LockAll(ctx context.Context, keys ...string) (Unlock, error) {
+	sorted := sortUnique(keys)
+	var unlocks []Unlock
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, key := range sorted {
+		unlock, err := l.Lock(ctx, key)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// writeHolder Record the current process in a lock file it holds
+func writeHolder(f *os.File, key string) {
+	host, _ := os.Hostname()
+	info := fmt.Sprintf("pid=%d host=%s since=%s key=%s\n", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339), key)
+	if err := f.Truncate(0); err != nil {
+		logger.Warn("failed to record holder of lock %s: %v", key, err)
+		return
+	}
+	if _, err := f.WriteAt([]byte(info), 0); err != nil {
+		logger.Warn("failed to record holder of lock %s: %v", key, err)
+	}
+}
+
+// holder Return the holder recorded in a lock file
+func holder(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(content))) == 0 {
+		return "an unknown process"
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// sortUnique Return the keys sorted without duplicates
+func sortUnique(keys []string) []string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	var res []string
+	for i, k := range sorted {
+		if i == 0 || k != sorted[i-1] {
+			res = append(res, k)
+		}
+	}
+	return res
+}
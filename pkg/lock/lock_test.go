@@ -0,0 +1,88 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+)
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+	l := NewLocker(filepath.Join(t.TempDir(), "locks"))
+	l.Timeout = 300 * time.Millisecond
+	ctx := context.Background()
+	key := TargetKey("10.0.0.1:3260", "iqn.2010-10.org.openstack:volume-1")
+
+	unlock, err := l.Lock(ctx, key)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, err = l.Lock(ctx, key)
+	if !errors.Is(err, exception.ErrTimeout) {
+		t.Fatalf("Expected ErrTimeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("pid=%d", os.Getpid())) {
+		t.Errorf("Expected the error to name the holder, got %v", err)
+	}
+	if other, err := l.Lock(ctx, VolumeKey("volume-1")); err != nil {
+		t.Errorf("Unexpected error locking another key %v", err)
+	} else {
+		other()
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := l.Lock(canceled, key); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		unlock, err := l.Lock(ctx, key)
+		if err == nil {
+			unlock()
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	unlock()
+	if err := <-done; err != nil {
+		t.Errorf("Expected the waiter to take the lock, got %v", err)
+	}
+}
+
+func TestLockAll(t *testing.T) {
+	t.Parallel()
+	l := NewLocker(t.TempDir())
+	l.Timeout = 200 * time.Millisecond
+	ctx := context.Background()
+	unlock, err := l.LockAll(ctx, ImageKey("ceph", "volumes", "b"), ImageKey("ceph", "volumes", "a"), ImageKey("ceph", "volumes", "b"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := l.LockAll(ctx, ImageKey("ceph", "volumes", "c"), ImageKey("ceph", "volumes", "a")); !errors.Is(err, exception.ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	unlock()
+	unlock, err = l.LockAll(ctx, ImageKey("ceph", "volumes", "a"), ImageKey("ceph", "volumes", "c"))
+	if err != nil {
+		t.Fatalf("Expected the locks to be released, got %v", err)
+	}
+	unlock()
+}
+
+func TestNilLocker(t *testing.T) {
+	var l *Locker
+	unlock, err := l.Lock(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	unlock()
+}
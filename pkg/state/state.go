@@ -0,0 +1,279 @@
+// Package state records the volumes attached to this host so that a
+// restarted process can tell which attachments completed
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+)
+
+// Attachment records a volume attached to this host
+type Attachment struct {
+	// ID identifies the attachment, it is chosen by the connector
+	ID       string `json:"id"`
+	Protocol string `json:"protocol"`
+	VolumeID string `json:"volume_id,omitempty"`
+	// ConnInfo is the connection info the volume was attached with
+	ConnInfo   map[string]interface{} `json:"connection_info"`
+	DevicePath string                 `json:"device_path"`
+	Size       int64                  `json:"size,omitempty"`
+	// Details holds connector specific facts about the attachment
+	Details    map[string]string `json:"details,omitempty"`
+	AttachedAt time.Time         `json:"attached_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// Store persists attachments, implementations are safe for concurrent use
+type Store interface {
+	// Get Return the attachment with id, exception.ErrAttachmentNotFound when there is none
+	Get(id string) (*Attachment, error)
+	// Put Create or replace an attachment
+	Put(a *Attachment) error
+	// Delete Remove an attachment, removing a missing attachment is not an error
+	Delete(id string) error
+	// List Return all attachments sorted by id
+	List() ([]*Attachment, error)
+}
+
+// Save Create or replace the attachment in s, the attach time of an existing
+// record is kept. It does nothing when s is nil
+func Save(s Store, a *Attachment) error {
+	if s == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	if a.AttachedAt.IsZero() {
+		old, err := Lookup(s, a.ID)
+		if err != nil {
+			return err
+		}
+		a.AttachedAt = now
+		if old != nil {
+			a.AttachedAt = old.AttachedAt
+		}
+	}
+	a.UpdatedAt = now
+	return s.Put(a)
+}
+
+// Update Apply fn to the attachment with id and save it, it does nothing
+// when s is nil or has no such attachment
+func Update(s Store, id string, fn func(a *Attachment)) error {
+	a, err := Lookup(s, id)
+	if err != nil || a == nil {
+		return err
+	}
+	fn(a)
+	return Save(s, a)
+}
+
+// Lookup Return the attachment with id from s, nil when s is nil or has no such attachment
+func Lookup(s Store, id string) (*Attachment, error) {
+	if s == nil {
+		return nil, nil
+	}
+	a, err := s.Get(id)
+	if err != nil {
+		if errors.Is(err, exception.ErrAttachmentNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// Forget Remove the attachment with id from s, it does nothing when s is nil
+func Forget(s Store, id string) error {
+	if s == nil {
+		return nil
+	}
+	return s.Delete(id)
+}
+
+// FileStore stores one JSON file per attachment in a directory, files are
+// replaced atomically so a crash leaves either the old or the new record
+type FileStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// NewFileStore Build a FileStore in dir, the directory is created when missing
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "create state directory %s", dir)
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+// Get implements Store
+func (s *FileStore) Get(id string) (*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(s.path(id))
+}
+
+// Put implements Store
+func (s *FileStore) Put(a *Attachment) error {
+	if a.ID == "" {
+		return exception.Wrap(exception.ErrIO, nil, "attachment has no id")
+	}
+	content, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return exception.Wrap(exception.ErrIO, err, "encode attachment %s", a.ID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFileAtomic(s.Dir, s.path(a.ID), content)
+}
+
+// Delete implements Store
+func (s *FileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return exception.Wrap(exception.ErrIO, err, "remove attachment %s", id)
+	}
+	return syncDir(s.Dir)
+}
+
+// List implements Store
+func (s *FileStore) List() ([]*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "list attachments in %s", s.Dir)
+	}
+	var res []*Attachment
+	for _, path := range paths {
+		a, err := s.read(path)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// path Return the file of the attachment with id
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.Dir, url.PathEscape(id)+".json")
+}
+
+// read Decode the attachment stored in path
+func (s *FileStore) read(path string) (*Attachment, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			id, _ := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), ".json"))
+			return nil, exception.Wrap(exception.ErrAttachmentNotFound, nil, "%s", id)
+		}
+		return nil, exception.Wrap(exception.ErrIO, err, "read %s", path)
+	}
+	var a Attachment
+	if err := json.Unmarshal(content, &a); err != nil {
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "decode %s", path)
+	}
+	return &a, nil
+}
+
+// writeFileAtomic Write content to a temporary file in dir and rename it over path
+func writeFileAtomic(dir, path string, content []byte) error {
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return exception.Wrap(exception.ErrIO, err, "create temporary file in %s", dir)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return exception.Wrap(exception.ErrIO, err, "write %s", tmp)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return exception.Wrap(exception.ErrIO, err, "sync %s", tmp)
+	}
+	if err := f.Close(); err != nil {
+		return exception.Wrap(exception.ErrIO, err, "close %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return exception.Wrap(exception.ErrIO, err, "rename %s to %s", tmp, path)
+	}
+	return syncDir(dir)
+}
+
+// syncDir Flush a directory so that renames and removals in it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return exception.Wrap(exception.ErrIO, err, "open %s", dir)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return exception.Wrap(exception.ErrIO, err, "sync %s", dir)
+	}
+	return nil
+}
+
+// MemoryStore keeps attachments in memory, it is meant for tests
+type MemoryStore struct {
+	mu          sync.Mutex
+	attachments map[string]Attachment
+}
+
+// NewMemoryStore Build an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attachments: map[string]Attachment{}}
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(id string) (*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.attachments[id]
+	if !ok {
+		return nil, exception.Wrap(exception.ErrAttachmentNotFound, nil, "%s", id)
+	}
+	return &a, nil
+}
+
+// Put implements Store
+func (s *MemoryStore) Put(a *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attachments[a.ID] = *a
+	return nil
+}
+
+// Delete implements Store
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attachments, id)
+	return nil
+}
+
+// List implements Store
+func (s *MemoryStore) List() ([]*Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*Attachment
+	for _, a := range s.attachments {
+		a := a
+		res = append(res, &a)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+)
+
+func TestFileStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := store.Get("rbd:volumes/volume-1"); !errors.Is(err, exception.ErrAttachmentNotFound) {
+		t.Errorf("Expected ErrAttachmentNotFound, got %v", err)
+	}
+	a := &Attachment{
+		ID:         "rbd:volumes/volume-1",
+		Protocol:   "RBD",
+		ConnInfo:   map[string]interface{}{"data": map[string]interface{}{"name": "volumes/volume-1"}},
+		DevicePath: "/dev/rbd0",
+	}
+	if err := Save(store, a); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	attachedAt := a.AttachedAt
+	if err := Save(store, &Attachment{ID: a.ID, Protocol: "RBD", ConnInfo: a.ConnInfo, DevicePath: "/dev/rbd1"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	got, err := store.Get(a.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if got.DevicePath != "/dev/rbd1" || !got.AttachedAt.Equal(attachedAt) {
+		t.Errorf("Unexpected attachment %+v", got)
+	}
+	if err := Update(store, a.ID, func(a *Attachment) { a.Size = 1024 }); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := Save(store, &Attachment{ID: "local:volume-2", Protocol: "LOCAL"}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	list, err := reopened.List()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(list) != 2 || list[0].ID != "local:volume-2" || list[1].Size != 1024 {
+		t.Errorf("Unexpected attachments %+v", list)
+	}
+	if !reflect.DeepEqual(list[1].ConnInfo, a.ConnInfo) {
+		t.Errorf("Unexpected connection info %v", list[1].ConnInfo)
+	}
+
+	if err := reopened.Delete(a.ID); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := reopened.Delete(a.ID); err != nil {
+		t.Errorf("Deleting a missing attachment should not fail, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected a single file left in %s, got %v", dir, entries)
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	if err := Save(nil, &Attachment{ID: "x"}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if a, err := Lookup(nil, "x"); a != nil || err != nil {
+		t.Errorf("Unexpected lookup result %v %v", a, err)
+	}
+	if err := Forget(nil, "x"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+// Package sysfs resolves the sysfs, devfs and procfs paths of the host
+// through a configurable root, so that the connectors can run in a container
+// which mounts the host filesystem elsewhere and in tests against a fake tree
+package sysfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Root is the directory the host filesystem is mounted at. Paths handed to
+// and returned by a Root are logical paths such as /sys/block/sda, they are
+// what the host itself sees. The zero value is the root of the current host
+type Root string
+
+// HostRoot is the root of the host the process runs on
+const HostRoot Root = ""
+
+// Path Return the path a logical path has in the current mount namespace
+func (r Root) Path(logical string) string {
+	if r == "" || r == "/" {
+		return logical
+	}
+	return filepath.Join(string(r), logical)
+}
+
+// Logical Return the logical path of a path under the root, paths outside
+// the root are returned unchanged
+func (r Root) Logical(path string) string {
+	if r == "" || r == "/" {
+		return path
+	}
+	rel, err := filepath.Rel(string(r), path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return "/" + rel
+}
+
+// Glob Return the logical paths matching a logical pattern
+func (r Root) Glob(pattern string) ([]string, error) {
+	paths, err := filepath.Glob(r.Path(pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, path := range paths {
+		paths[i] = r.Logical(path)
+	}
+	return paths, nil
+}
+
+// ReadFile Read the file at a logical path
+func (r Root) ReadFile(logical string) ([]byte, error) {
+	return os.ReadFile(r.Path(logical))
+}
+
+// ReadString Read the file at a logical path without surrounding white space
+func (r Root) ReadString(logical string) (string, error) {
+	content, err := r.ReadFile(logical)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Stat Return the file info of a logical path, following symlinks
+func (r Root) Stat(logical string) (os.FileInfo, error) {
+	return os.Stat(r.Path(logical))
+}
+
+// Exists Check a logical path exists
+func (r Root) Exists(logical string) bool {
+	_, err := r.Stat(logical)
+	return err == nil
+}
+
+// EvalSymlinks Return the logical path a logical path resolves to
+func (r Root) EvalSymlinks(logical string) (string, error) {
+	path, err := filepath.EvalSymlinks(r.Path(logical))
+	if err != nil {
+		return "", err
+	}
+	return r.Logical(path), nil
+}
+
+// ReadDir Return the entries of the directory at a logical path
+func (r Root) ReadDir(logical string) ([]os.DirEntry, error) {
+	return os.ReadDir(r.Path(logical))
+}
+
+// Remove Remove the file at a logical path
+func (r Root) Remove(logical string) error {
+	return os.Remove(r.Path(logical))
+}
@@ -0,0 +1,44 @@
+package sysfs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	if HostRoot.Path("/sys/block/sda") != "/sys/block/sda" || Root("/").Logical("/dev/sda") != "/dev/sda" {
+		t.Error("The host root should not change paths")
+	}
+	root := Root("/host")
+	if p := root.Path("/sys/block/sda"); p != "/host/sys/block/sda" {
+		t.Errorf("Unexpected path %s", p)
+	}
+	if p := root.Logical("/host/dev/sda"); p != "/dev/sda" {
+		t.Errorf("Unexpected logical path %s", p)
+	}
+	if p := root.Logical("/hostile/dev/sda"); p != "/hostile/dev/sda" {
+		t.Errorf("Paths outside the root should not change, got %s", p)
+	}
+
+	root = Root(t.TempDir())
+	if err := os.MkdirAll(root.Path("/dev/disk/by-id"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(root.Path("/dev/sda"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../sda", root.Path("/dev/disk/by-id/scsi-1")); err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := root.Glob("/dev/disk/by-id/scsi-*"); err != nil || !reflect.DeepEqual(paths, []string{"/dev/disk/by-id/scsi-1"}) {
+		t.Errorf("Unexpected glob result %v %v", paths, err)
+	}
+	if p, err := root.EvalSymlinks("/dev/disk/by-id/scsi-1"); err != nil || p != "/dev/sda" {
+		t.Errorf("Unexpected link target %s %v", p, err)
+	}
+	if !root.Exists("/dev/sda") || root.Exists(filepath.Join("/dev", "sdb")) {
+		t.Error("Unexpected existence check")
+	}
+}
@@ -0,0 +1,398 @@
+// Package sysfstest builds fake sysfs and devfs trees from a declarative
+// description, for tests of the code resolving host paths through a sysfs.Root
+package sysfstest
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+)
+
+// sectorSize is the unit of the size files of /sys/block
+const sectorSize = 512
+
+// Layout declares the devices of a fake host
+type Layout struct {
+	Sessions  []Session
+	Multipath []Multipath
+	RBD       []RBDDevice
+	// Files are extra files by logical path
+	Files map[string]string
+}
+
+// Session is an iscsi session and the scsi disks it exposes
+type Session struct {
+	ID int
+	// Host, Channel and Target are the scsi address of the session
+	Host    int
+	Channel int
+	Target  int
+	// Portal is the ip:port of the session, it names the by-path links of the disks
+	Portal string
+	IQN    string
+	LUNs   []LUN
+}
+
+// LUN is a scsi disk of a session
+type LUN struct {
+	LUN int
+	// Device is the kernel name of the disk, such as sda
+	Device string
+	// Size is the size of the disk in bytes
+	Size int64
+	// WWID names the /dev/disk/by-id/scsi-<wwid> link of the disk when set
+	WWID string
+}
+
+// Multipath is a device mapper multipath device over scsi disks
+type Multipath struct {
+	// Name is the kernel name of the device, such as dm-0
+	Name string
+	// Alias is the /dev/mapper name of the device
+	Alias  string
+	Slaves []string
+	Size   int64
+}
+
+// RBDDevice is an rbd image mapped by the kernel
+type RBDDevice struct {
+	// ID is the rbd device id, the device is /dev/rbd<ID>
+	ID          int
+	Pool        string
+	Namespace   string
+	Image       string
+	Snap        string
+	Size        int64
+	ClientID    string
+	ClusterFSID string
+	// Monitors are the monitor addresses of the map request in config_info
+	Monitors string
+	// UdevLink creates the /dev/rbd/<pool>[/<namespace>]/<image>[@<snap>] link udev maintains
+	UdevLink bool
+}
+
+// Tree is a fake host tree
+type Tree struct {
+	Root sysfs.Root
+}
+
+// New Build the layout in a temporary directory removed when the test ends
+func New(t testing.TB, l Layout) *Tree {
+	t.Helper()
+	tree, err := Build(t.TempDir(), l)
+	if err != nil {
+		t.Fatalf("build fake sysfs: %v", err)
+	}
+	return tree
+}
+
+// Build Build the layout under dir
+func Build(dir string, l Layout) (*Tree, error) {
+	t := &Tree{Root: sysfs.Root(dir)}
+	for _, s := range l.Sessions {
+		if err := t.AddSession(s); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range l.Multipath {
+		if err := t.AddMultipath(m); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range l.RBD {
+		if err := t.AddRBD(d); err != nil {
+			return nil, err
+		}
+	}
+	for name, content := range l.Files {
+		if err := t.WriteFile(name, content); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// AddSession Create a session and its disks, adding a session which exists adds its new disks
+func (t *Tree) AddSession(s Session) error {
+	target := t.sessionTargetDir(s)
+	if err := t.mkdir(target); err != nil {
+		return err
+	}
+	session := fmt.Sprintf("/sys/class/iscsi_session/session%d", s.ID)
+	if err := t.WriteFile(session+"/targetname", s.IQN); err != nil {
+		return err
+	}
+	if s.Portal != "" {
+		address, port := splitPortal(s.Portal)
+		connection := fmt.Sprintf("/sys/class/iscsi_connection/connection%d:0", s.ID)
+		if err := t.WriteFile(connection+"/persistent_address", address); err != nil {
+			return err
+		}
+		if err := t.WriteFile(connection+"/persistent_port", port); err != nil {
+			return err
+		}
+	}
+	if err := t.WriteFile(fmt.Sprintf("/sys/class/scsi_host/host%d/scan", s.Host), ""); err != nil {
+		return err
+	}
+	for _, l := range s.LUNs {
+		if err := t.addLUN(s, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLUN Create a scsi disk of a session
+func (t *Tree) addLUN(s Session, l LUN) error {
+	lunDir := fmt.Sprintf("%s/%d:%d:%d:%d/block/%s", t.sessionTargetDir(s), s.Host, s.Channel, s.Target, l.LUN, l.Device)
+	if err := t.mkdir(lunDir); err != nil {
+		return err
+	}
+	if err := t.addBlockDevice(l.Device, l.Size); err != nil {
+		return err
+	}
+	block := "/sys/block/" + l.Device
+	for _, name := range []string{"device/delete", "device/rescan"} {
+		if err := t.WriteFile(block+"/"+name, ""); err != nil {
+			return err
+		}
+	}
+	if s.Portal != "" {
+		link := fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-%d", s.Portal, s.IQN, l.LUN)
+		if err := t.Symlink("/dev/"+l.Device, link); err != nil {
+			return err
+		}
+	}
+	if l.WWID != "" {
+		if err := t.Symlink("/dev/"+l.Device, "/dev/disk/by-id/scsi-"+l.WWID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveSession Remove a session, its disks are left alone
+func (t *Tree) RemoveSession(id int) error {
+	paths, err := t.Root.Glob(fmt.Sprintf("/sys/class/iscsi_host/host*/device/session%d", id))
+	if err != nil {
+		return err
+	}
+	paths = append(paths,
+		fmt.Sprintf("/sys/class/iscsi_session/session%d", id),
+		fmt.Sprintf("/sys/class/iscsi_connection/connection%d:0", id))
+	return t.removeAll(paths...)
+}
+
+// RemoveDisk Remove a scsi disk the way the kernel does after a write to its delete file
+func (t *Tree) RemoveDisk(device string) error {
+	paths, err := t.Root.Glob("/sys/class/iscsi_host/host*/device/session*/target*/*/block/" + device)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := t.removeAll(path.Dir(path.Dir(p))); err != nil {
+			return err
+		}
+	}
+	holders, _ := t.Root.Glob("/sys/block/dm-*/slaves/" + device)
+	if err := t.removeAll(holders...); err != nil {
+		return err
+	}
+	return t.removeBlockDevice(device)
+}
+
+// AddMultipath Create a multipath device over its slaves
+func (t *Tree) AddMultipath(m Multipath) error {
+	if err := t.addBlockDevice(m.Name, m.Size); err != nil {
+		return err
+	}
+	block := "/sys/block/" + m.Name
+	if err := t.WriteFile(block+"/dm/name", m.Alias); err != nil {
+		return err
+	}
+	if err := t.WriteFile(block+"/dm/uuid", "mpath-"+m.Alias); err != nil {
+		return err
+	}
+	for _, slave := range m.Slaves {
+		if err := t.mkdir(block + "/slaves/" + slave); err != nil {
+			return err
+		}
+		if err := t.mkdir("/sys/block/" + slave + "/holders/" + m.Name); err != nil {
+			return err
+		}
+	}
+	if m.Alias != "" {
+		return t.Symlink("/dev/"+m.Name, "/dev/mapper/"+m.Alias)
+	}
+	return nil
+}
+
+// RemoveMultipath Remove a multipath device, as multipath -f does
+func (t *Tree) RemoveMultipath(name string) error {
+	holders, _ := t.Root.Glob("/sys/block/*/holders/" + name)
+	if err := t.removeAll(holders...); err != nil {
+		return err
+	}
+	return t.removeBlockDevice(name)
+}
+
+// AddRBD Create a mapped rbd device
+func (t *Tree) AddRBD(d RBDDevice) error {
+	dir := fmt.Sprintf("/sys/devices/rbd/%d", d.ID)
+	snap := d.Snap
+	if snap == "" {
+		snap = "-"
+	}
+	attrs := map[string]string{
+		"pool":         d.Pool,
+		"pool_ns":      d.Namespace,
+		"name":         d.Image,
+		"current_snap": snap,
+		"size":         fmt.Sprint(d.Size),
+		"client_id":    d.ClientID,
+		"cluster_fsid": d.ClusterFSID,
+	}
+	if d.Monitors != "" {
+		attrs["config_info"] = fmt.Sprintf("%s name=admin %s %s %s", d.Monitors, d.Pool, d.Image, snap)
+	}
+	for name, value := range attrs {
+		if err := t.WriteFile(dir+"/"+name, value); err != nil {
+			return err
+		}
+	}
+	if err := t.Symlink(dir, fmt.Sprintf("/sys/bus/rbd/devices/%d", d.ID)); err != nil {
+		return err
+	}
+	device := fmt.Sprintf("rbd%d", d.ID)
+	if err := t.addBlockDevice(device, d.Size); err != nil {
+		return err
+	}
+	if d.UdevLink {
+		return t.Symlink("/dev/"+device, RBDUdevLink(d))
+	}
+	return nil
+}
+
+// RBDUdevLink Return the /dev/rbd link udev creates for a mapped rbd device
+func RBDUdevLink(d RBDDevice) string {
+	name := d.Image
+	if d.Snap != "" && d.Snap != "-" {
+		name += "@" + d.Snap
+	}
+	return path.Join("/dev/rbd", d.Pool, d.Namespace, name)
+}
+
+// RemoveRBD Remove a mapped rbd device, as rbd unmap does
+func (t *Tree) RemoveRBD(id int) error {
+	links, _ := t.Root.Glob("/dev/rbd/*/*")
+	nsLinks, _ := t.Root.Glob("/dev/rbd/*/*/*")
+	for _, link := range append(links, nsLinks...) {
+		if target, err := t.Root.EvalSymlinks(link); err == nil && target == fmt.Sprintf("/dev/rbd%d", id) {
+			if err := t.removeAll(link); err != nil {
+				return err
+			}
+		}
+	}
+	err := t.removeAll(fmt.Sprintf("/sys/devices/rbd/%d", id), fmt.Sprintf("/sys/bus/rbd/devices/%d", id))
+	if err != nil {
+		return err
+	}
+	return t.removeBlockDevice(fmt.Sprintf("rbd%d", id))
+}
+
+// SetSize Change the size in bytes of a block device, an rbd device id
+// given as rbd<ID> also gets its rbd size attribute updated
+func (t *Tree) SetSize(device string, size int64) error {
+	if err := t.WriteFile("/sys/block/"+device+"/size", fmt.Sprint(size/sectorSize)); err != nil {
+		return err
+	}
+	if id := strings.TrimPrefix(device, "rbd"); id != device {
+		return t.WriteFile("/sys/devices/rbd/"+id+"/size", fmt.Sprint(size))
+	}
+	return nil
+}
+
+// WriteFile Write a file at a logical path, creating its directory
+func (t *Tree) WriteFile(logical, content string) error {
+	if err := t.mkdir(path.Dir(logical)); err != nil {
+		return err
+	}
+	return os.WriteFile(t.Root.Path(logical), []byte(content), 0644)
+}
+
+// Symlink Create a link at a logical path to a logical target, the link is
+// relative so that it resolves inside the tree
+func (t *Tree) Symlink(target, link string) error {
+	if err := t.mkdir(path.Dir(link)); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(path.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	real := t.Root.Path(link)
+	if err := os.Remove(real); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(rel, real)
+}
+
+// addBlockDevice Create the /sys/block entry and the device node of a block device
+func (t *Tree) addBlockDevice(device string, size int64) error {
+	if err := t.mkdir("/sys/block/" + device + "/holders"); err != nil {
+		return err
+	}
+	if err := t.WriteFile("/sys/block/"+device+"/size", fmt.Sprint(size/sectorSize)); err != nil {
+		return err
+	}
+	return t.WriteFile("/dev/"+device, "")
+}
+
+// removeBlockDevice Remove a block device and the links to it
+func (t *Tree) removeBlockDevice(device string) error {
+	links, _ := t.Root.Glob("/dev/disk/*/*")
+	mapper, _ := t.Root.Glob("/dev/mapper/*")
+	for _, link := range append(links, mapper...) {
+		if target, err := t.Root.EvalSymlinks(link); err == nil && target == "/dev/"+device {
+			if err := t.removeAll(link); err != nil {
+				return err
+			}
+		}
+	}
+	return t.removeAll("/sys/block/"+device, "/dev/"+device)
+}
+
+// sessionTargetDir Return the sysfs target directory of a session
+func (t *Tree) sessionTargetDir(s Session) string {
+	return fmt.Sprintf("/sys/class/iscsi_host/host%d/device/session%d/target%d:%d:%d", s.Host, s.ID, s.Host, s.Channel, s.Target)
+}
+
+// mkdir Create a directory at a logical path
+func (t *Tree) mkdir(logical string) error {
+	return os.MkdirAll(t.Root.Path(logical), 0755)
+}
+
+// removeAll Remove logical paths and their content
+func (t *Tree) removeAll(logical ...string) error {
+	for _, p := range logical {
+		if err := os.RemoveAll(t.Root.Path(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitPortal Split an ip:port portal, the port defaults to 3260
+func splitPortal(portal string) (string, string) {
+	i := strings.LastIndex(portal, ":")
+	if i < 0 || strings.HasSuffix(portal, "]") {
+		return portal, "3260"
+	}
+	return portal[:i], portal[i+1:]
+}
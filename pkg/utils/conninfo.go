@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bool is a bool which also accepts the numbers and strings cinder drivers
+// sometimes send instead of a JSON boolean, null decodes to false
+type Bool bool
+
+// UnmarshalJSON implements json.Unmarshaler
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch res := v.(type) {
+	case nil:
+		*b = false
+	case bool:
+		*b = Bool(res)
+	case float64:
+		*b = res != 0
+	case string:
+		if res == "" {
+			*b = false
+			return nil
+		}
+		result, err := strconv.ParseBool(res)
+		if err != nil {
+			return fmt.Errorf("can not convert %q to bool", res)
+		}
+		*b = Bool(result)
+	default:
+		return fmt.Errorf("can not convert %s to bool", string(data))
+	}
+	return nil
+}
+
+// Int is an int which also accepts numeric strings, null decodes to 0
+type Int int
+
+// UnmarshalJSON implements json.Unmarshaler
+func (i *Int) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch res := v.(type) {
+	case nil:
+		*i = 0
+	case float64:
+		if res != float64(int(res)) {
+			return fmt.Errorf("can not convert %v to int", res)
+		}
+		*i = Int(res)
+	case string:
+		result, err := strconv.Atoi(strings.TrimSpace(res))
+		if err != nil {
+			return fmt.Errorf("can not convert %q to int", res)
+		}
+		*i = Int(result)
+	default:
+		return fmt.Errorf("can not convert %s to int", string(data))
+	}
+	return nil
+}
+
+// String is a string which accepts any JSON value, numbers and bools keep
+// their literal form, objects and arrays keep their JSON encoding and null
+// decodes to the empty string
+type String string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *String) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*s = ""
+	case len(data) > 0 && data[0] == '"':
+		var res string
+		if err := json.Unmarshal(data, &res); err != nil {
+			return err
+		}
+		*s = String(res)
+	default:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return err
+		}
+		*s = String(buf.String())
+	}
+	return nil
+}
+
+// Strings is a string list which accepts numbers as elements and a single
+// scalar in place of a list
+type Strings []string
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *Strings) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		return fmt.Errorf("can not convert %s to a string list", string(data))
+	}
+	if len(data) == 0 || data[0] != '[' {
+		var one String
+		if err := one.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		if one == "" {
+			*s = nil
+			return nil
+		}
+		*s = Strings{string(one)}
+		return nil
+	}
+	var items []String
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	result := make(Strings, len(items))
+	for i, v := range items {
+		result[i] = string(v)
+	}
+	*s = result
+	return nil
+}
+
+// Ints is an int list which accepts numeric strings as elements and a single
+// scalar in place of a list
+type Ints []int
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *Ints) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		*s = nil
+		return nil
+	}
+	if len(data) == 0 || data[0] != '[' {
+		var one Int
+		if err := one.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		*s = Ints{int(one)}
+		return nil
+	}
+	var items []Int
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	result := make(Ints, len(items))
+	for i, v := range items {
+		result[i] = int(v)
+	}
+	*s = result
+	return nil
+}
+
+// ParseConnInfoJSON Decode the JSON body of a cinder initialize_connection
+// call, both the full response and the bare connection_info object are accepted
+func ParseConnInfoJSON(b []byte) (map[string]interface{}, error) {
+	var connInfo map[string]interface{}
+	if err := json.Unmarshal(b, &connInfo); err != nil {
+		return nil, fmt.Errorf("failed to decode connection info: %v", err)
+	}
+	if connInfo == nil {
+		return nil, fmt.Errorf("connection info is empty")
+	}
+	if inner, ok := connInfo["connection_info"]; ok {
+		res, ok := inner.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("connection_info is %T, expected an object", inner)
+		}
+		return res, nil
+	}
+	return connInfo, nil
+}
+
+// DecodeConnInfoData Decode the data section of a connection info map into v
+func DecodeConnInfoData(connInfo map[string]interface{}, v interface{}) error {
+	raw, ok := connInfo["data"]
+	if !ok || raw == nil {
+		return fmt.Errorf("connection info has no data section")
+	}
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("connection info data is %T, expected an object", raw)
+	}
+	return DecodeValue(data, v)
+}
+
+// DecodeValue Decode a generic value, as found in a connection info map,
+// into the value pointed to by v through its json tags
+func DecodeValue(value interface{}, v interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode connection info: %v", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("failed to decode connection info: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/wonderivan/logger"
+)
+
+// Command is an external command to run
+type Command struct {
+	Name string
+	Args []string
+	// Env overrides or adds environment variables of the command
+	Env map[string]string
+	// Stdin is written to the standard input of the command
+	Stdin string
+}
+
+// Argv Return the command name followed by its arguments
+func (c Command) Argv() []string {
+	return append([]string{c.Name}, c.Args...)
+}
+
+// String Return the command line
+func (c Command) String() string {
+	return strings.Join(c.Argv(), " ")
+}
+
+// Result is the output of a command which ran to completion
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Executor runs external commands, a failed command is returned as an
+// *exception.CommandError together with the partial Result
+type Executor interface {
+	Run(ctx context.Context, cmd Command) (Result, error)
+}
+
+// DirectExecutor runs commands as the current user
+type DirectExecutor struct {
+	// Env is applied to every command before the per command overrides
+	Env map[string]string
+}
+
+// Run implements Executor
+func (e DirectExecutor) Run(ctx context.Context, cmd Command) (Result, error) {
+	c := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	if len(e.Env) > 0 || len(cmd.Env) > 0 {
+		c.Env = mergeEnv(os.Environ(), e.Env, cmd.Env)
+	}
+	if cmd.Stdin != "" {
+		c.Stdin = strings.NewReader(cmd.Stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	res := Result{
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+		ExitCode: c.ProcessState.ExitCode(),
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return res, exception.NewCommandError(cmd.Argv(), res.Stdout, res.Stderr, err)
+	}
+	return res, nil
+}
+
+// RootHelperExecutor runs commands through a privilege escalation prefix,
+// such as sudo or an oslo rootwrap command line
+type RootHelperExecutor struct {
+	// Helper is the prefix put in front of every command
+	Helper []string
+	// Env is applied to every command before the per command overrides,
+	// it is passed through env(1) after the helper so that sudo keeps it
+	Env map[string]string
+}
+
+// NewRootHelperExecutor Build an executor which prefixes every command with helper
+func NewRootHelperExecutor(helper ...string) *RootHelperExecutor {
+	return &RootHelperExecutor{Helper: helper}
+}
+
+// NewSudoExecutor Build an executor which runs every command with non interactive sudo
+func NewSudoExecutor() *RootHelperExecutor {
+	return NewRootHelperExecutor("sudo", "-n")
+}
+
+// Run implements Executor
+func (e *RootHelperExecutor) Run(ctx context.Context, cmd Command) (Result, error) {
+	if len(e.Helper) == 0 {
+		return DirectExecutor{Env: e.Env}.Run(ctx, cmd)
+	}
+	var args []string
+	args = append(args, e.Helper[1:]...)
+	if env := mergeEnv(nil, e.Env, cmd.Env); len(env) > 0 {
+		args = append(args, "env")
+		args = append(args, env...)
+	}
+	args = append(args, cmd.Argv()...)
+	wrapped := Command{Name: e.Helper[0], Args: args, Stdin: cmd.Stdin}
+	return DirectExecutor{}.Run(ctx, wrapped)
+}
+
+// RecordingExecutor runs commands through another executor and records them
+type RecordingExecutor struct {
+	Executor Executor
+
+	mu       sync.Mutex
+	commands []Command
+}
+
+// NewRecordingExecutor Build an executor recording the commands it passes to e
+func NewRecordingExecutor(e Executor) *RecordingExecutor {
+	return &RecordingExecutor{Executor: e}
+}
+
+// Run implements Executor
+func (r *RecordingExecutor) Run(ctx context.Context, cmd Command) (Result, error) {
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	return executorOrDefault(r.Executor).Run(ctx, cmd)
+}
+
+// Commands Return the commands run so far
+func (r *RecordingExecutor) Commands() []Command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Command(nil), r.commands...)
+}
+
+// CommandLines Return the commands run so far as command lines
+func (r *RecordingExecutor) CommandLines() []string {
+	var lines []string
+	for _, cmd := range r.Commands() {
+		lines = append(lines, cmd.String())
+	}
+	return lines
+}
+
+// Reset Forget the recorded commands
+func (r *RecordingExecutor) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = nil
+}
+
+// Exec Run a command through e and return its standard output, commands
+// run directly when e is nil
+func Exec(ctx context.Context, e Executor, name string, args ...string) (string, error) {
+	res, err := executorOrDefault(e).Run(ctx, Command{Name: name, Args: args})
+	return res.Stdout, err
+}
+
+// WriteFile Write content to a sysfs or device file. Files are written
+// directly when e is nil or a DirectExecutor, otherwise through tee run by e
+// so that root helpers and fakes see the write
+func WriteFile(ctx context.Context, e Executor, path, content string) error {
+	switch e.(type) {
+	case nil, DirectExecutor, *DirectExecutor:
+		return EchoScsiCommand(path, content)
+	}
+	logger.Debug("write file through executor [path: %s content: %s]", path, content)
+	_, err := e.Run(ctx, Command{Name: "tee", Args: []string{"-a", path}, Stdin: content})
+	return err
+}
+
+// executorOrDefault Return e or a DirectExecutor when e is nil
+func executorOrDefault(e Executor) Executor {
+	if e == nil {
+		return DirectExecutor{}
+	}
+	return e
+}
+
+// mergeEnv Apply the overrides in order to base, a list of KEY=VALUE entries
+func mergeEnv(base []string, overrides ...map[string]string) []string {
+	values := map[string]string{}
+	var keys []string
+	for _, kv := range base {
+		k := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			k = kv[:i]
+		}
+		if _, ok := values[k]; !ok {
+			keys = append(keys, k)
+		}
+		values[k] = kv
+	}
+	for _, o := range overrides {
+		var added []string
+		for k, v := range o {
+			if _, ok := values[k]; !ok {
+				added = append(added, k)
+			}
+			values[k] = k + "=" + v
+		}
+		sort.Strings(added)
+		keys = append(keys, added...)
+	}
+	env := make([]string, 0, len(keys))
+	for _, k := range keys {
+		env = append(env, values[k])
+	}
+	return env
+}
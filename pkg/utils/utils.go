@@ -1,30 +1,45 @@
 package utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"strconv"
+	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
 	"github.com/wonderivan/logger"
 )
 
-// Execute a shell command
-func Execute(command string, arg ...string) (string, error) {
-	cmd := exec.Command(command, arg...)
-	stdoutStderr, err := cmd.CombinedOutput()
-	return string(stdoutStderr), err
+// Execute a shell command as the current user and return its standard
+// output, the command is killed when ctx is done. A failure is returned as
+// an *exception.CommandError. Connectors run commands through their Executor
+func Execute(ctx context.Context, command string, arg ...string) (string, error) {
+	return Exec(ctx, DirectExecutor{}, command, arg...)
+}
+
+//Sleep Pause for the duration d, return early with the context error when ctx is done
+func Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
 }
 
 //ExecIscsiadm exec a iscsiadm shell command
-func ExecIscsiadm(portalIP string, iqn string, args []string) (string, error) {
+func ExecIscsiadm(ctx context.Context, e Executor, portalIP string, iqn string, args []string) (string, error) {
 	var cmd []string
 	baseArgs := []string{"-m", "node"}
 	cmd = append(baseArgs, []string{"-T", iqn}...)
 	cmd = append(cmd, []string{"-p", portalIP}...)
 	cmd = append(cmd, args...)
 
-	out, err := Execute("iscsiadm", cmd...)
+	out, err := RunIscsiadm(ctx, e, cmd...)
 	if err != nil {
 		logger.Error("failed to execute iscsiadm command", err)
 		return "", err
@@ -33,11 +48,50 @@ func ExecIscsiadm(portalIP string, iqn string, args []string) (string, error) {
 	return out, nil
 }
 
+//RunIscsiadm exec iscsiadm with args and classify its exit code
+func RunIscsiadm(ctx context.Context, e Executor, args ...string) (string, error) {
+	out, err := Exec(ctx, e, "iscsiadm", args...)
+	if err != nil {
+		return out, classifyIscsiadmError(err)
+	}
+	return out, nil
+}
+
+// iscsiadm exit codes, see include/iscsi_err.h in open-iscsi
+const (
+	iscsiErrSessNotFound  = 2
+	iscsiErrTrans         = 4
+	iscsiErrTransTimeout  = 8
+	iscsiErrPduTimeout    = 11
+	iscsiErrSessExists    = 15
+	iscsiErrNoObjsFound   = 21
+	iscsiErrLoginAuthFail = 24
+)
+
+//classifyIscsiadmError Set the reason of an iscsiadm command error from its exit code
+func classifyIscsiadmError(err error) error {
+	var cmdErr *exception.CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Reason != nil {
+		return err
+	}
+	switch cmdErr.ExitCode {
+	case iscsiErrSessNotFound, iscsiErrNoObjsFound:
+		cmdErr.Reason = exception.ErrSessionNotFound
+	case iscsiErrTrans, iscsiErrTransTimeout, iscsiErrPduTimeout:
+		cmdErr.Reason = exception.ErrTargetUnreachable
+	case iscsiErrSessExists:
+		cmdErr.Reason = exception.ErrSessionExists
+	case iscsiErrLoginAuthFail:
+		cmdErr.Reason = exception.ErrAuthFailed
+	}
+	return cmdErr
+}
+
 //UpdateIscsiadm update iscsiadm shell command
-func UpdateIscsiadm(portalIP, targetIQN, key, value string, args []string) (string, error) {
+func UpdateIscsiadm(ctx context.Context, e Executor, portalIP, targetIQN, key, value string, args []string) (string, error) {
 	a := []string{"--op", "update", "-n", key, "-v", value}
 	a = append(a, args...)
-	return ExecIscsiadm(portalIP, targetIQN, a)
+	return ExecIscsiadm(ctx, e, portalIP, targetIQN, a)
 }
 
 //EchoScsiCommand Used to echo strings to scsi subsystem
@@ -48,13 +102,16 @@ func EchoScsiCommand(path, content string) error {
 	f, err := os.OpenFile(path, os.O_WRONLY, 0400)
 	if err != nil {
 		logger.Error("failed to open file", err)
-		return err
+		if os.IsNotExist(err) {
+			return exception.Wrap(exception.ErrDeviceNotFound, err, "open %s", path)
+		}
+		return exception.Wrap(exception.ErrIO, err, "open %s", path)
 	}
 	defer f.Close()
 
 	if _, err := f.WriteString(content); err != nil {
 		logger.Error("failed to write file", err)
-		return err
+		return exception.Wrap(exception.ErrIO, err, "write %q to %s", content, path)
 	}
 	return nil
 }
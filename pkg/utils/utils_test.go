@@ -1,20 +1,83 @@
 package utils
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
 )
 
 func TestExecute(t *testing.T) {
 	t.Parallel()
-	res, _ := Execute("echo", "-n", "aaa")
+	res, _ := Execute(context.Background(), "echo", "-n", "aaa")
 	if res != "aaa" {
 		t.Error("Error echo value.")
 	}
-	_, err := Execute("err_cmd")
+	_, err := Execute(context.Background(), "err_cmd")
 	if err == nil {
 		t.Error("Error command expect get a error output.")
 	}
+	if !errors.Is(err, exception.ErrCommandNotFound) || !errors.Is(err, exception.ErrCommandFailed) {
+		t.Errorf("Expected a command not found error, got %v", err)
+	}
+	_, err = Execute(context.Background(), "sh", "-c", "echo oops >&2; exit 3")
+	var cmdErr *exception.CommandError
+	if !errors.As(err, &cmdErr) {
+		t.Fatalf("Expected a *exception.CommandError, got %v", err)
+	}
+	if cmdErr.ExitCode != 3 || cmdErr.Argv[0] != "sh" || !strings.Contains(cmdErr.Stderr, "oops") {
+		t.Errorf("Unexpected command error %+v", cmdErr)
+	}
+}
+
+func TestClassifyIscsiadmError(t *testing.T) {
+	t.Parallel()
+	cases := map[int]error{
+		24: exception.ErrAuthFailed,
+		8:  exception.ErrTargetUnreachable,
+		21: exception.ErrSessionNotFound,
+		15: exception.ErrSessionExists,
+	}
+	for code, expected := range cases {
+		_, err := Execute(context.Background(), "sh", "-c", fmt.Sprintf("exit %d", code))
+		err = classifyIscsiadmError(err)
+		if !errors.Is(err, expected) {
+			t.Errorf("Expected exit code %d to match %v, got %v", code, expected, err)
+		}
+	}
+}
+
+func TestExecuteCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Execute(ctx, "sleep", "10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Command was not killed when the context expired.")
+	}
+}
+
+func TestSleepCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Sleep(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+	if err := Sleep(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
 }
 
 func assertToBoolPanic(t *testing.T, f func(interface{}) bool, v interface{}) {
@@ -73,3 +136,108 @@ func TestToStringSlice(t *testing.T) {
 		t.Error("Error value!!!")
 	}
 }
+
+func TestConnInfoTypes(t *testing.T) {
+	t.Parallel()
+	var v struct {
+		B1 Bool    `json:"b1"`
+		B2 Bool    `json:"b2"`
+		B3 Bool    `json:"b3"`
+		I  Int     `json:"i"`
+		S  String  `json:"s"`
+		Q  String  `json:"q"`
+		SS Strings `json:"ss"`
+		IS Ints    `json:"is"`
+	}
+	body := `{"b1": "True", "b2": 1, "b3": null, "i": "3", "s": 6789, "q": {"a": 1},
+		"ss": ["a", 1], "is": ["1", 2]}`
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !v.B1 || !v.B2 || v.B3 || v.I != 3 || v.S != "6789" || v.Q != `{"a":1}` {
+		t.Errorf("Unexpected scalar values %+v", v)
+	}
+	if !reflect.DeepEqual(v.SS, Strings{"a", "1"}) || !reflect.DeepEqual(v.IS, Ints{1, 2}) {
+		t.Errorf("Unexpected list values %+v", v)
+	}
+	invalid := []string{`{"b1": "abc"}`, `{"b1": [1]}`, `{"i": "x"}`, `{"i": 1.5}`, `{"ss": {"a": 1}}`}
+	for _, body := range invalid {
+		if err := json.Unmarshal([]byte(body), &v); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+}
+
+func TestParseConnInfoJSON(t *testing.T) {
+	t.Parallel()
+	connInfo, err := ParseConnInfoJSON([]byte(`{"connection_info": {"driver_volume_type": "rbd", "data": {}}}`))
+	if err != nil || connInfo["driver_volume_type"] != "rbd" {
+		t.Errorf("Unexpected result %v %v", connInfo, err)
+	}
+	if _, err := ParseConnInfoJSON([]byte(`{"connection_info": 1}`)); err == nil {
+		t.Error("Expected an error for a non object connection_info")
+	}
+	if _, err := ParseConnInfoJSON([]byte(`null`)); err == nil {
+		t.Error("Expected an error for empty connection info")
+	}
+}
+
+func TestDirectExecutor(t *testing.T) {
+	t.Parallel()
+	e := DirectExecutor{Env: map[string]string{"BRICK_A": "a"}}
+	res, err := e.Run(context.Background(), Command{
+		Name:  "sh",
+		Args:  []string{"-c", "echo $BRICK_A $BRICK_B; cat; echo err >&2"},
+		Env:   map[string]string{"BRICK_B": "b"},
+		Stdin: "in\n",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if res.Stdout != "a b\nin\n" || res.Stderr != "err\n" || res.ExitCode != 0 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+}
+
+func TestRootHelperExecutor(t *testing.T) {
+	t.Parallel()
+	// env(1) stands in for sudo, it runs the rest of the command line
+	e := NewRootHelperExecutor("env")
+	e.Env = map[string]string{"BRICK_A": "a"}
+	recorder := NewRecordingExecutor(e)
+	out, err := Exec(context.Background(), recorder, "sh", "-c", "echo $BRICK_A")
+	if err != nil || out != "a\n" {
+		t.Errorf("Unexpected output %q %v", out, err)
+	}
+	expected := []string{"sh -c echo $BRICK_A"}
+	if !reflect.DeepEqual(recorder.CommandLines(), expected) {
+		t.Errorf("Unexpected recorded commands %v", recorder.CommandLines())
+	}
+	recorder.Reset()
+	if len(recorder.Commands()) != 0 {
+		t.Error("Expected no recorded command after reset")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := dir + "/scan"
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecordingExecutor(nil)
+	if err := WriteFile(context.Background(), recorder, path, "- - -"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if string(content) != "- - -" {
+		t.Errorf("Unexpected content %q", content)
+	}
+	if lines := recorder.CommandLines(); len(lines) != 1 || lines[0] != "tee -a "+path {
+		t.Errorf("Expected the write to go through tee, got %v", lines)
+	}
+	if err := WriteFile(context.Background(), nil, dir+"/missing", "1"); !errors.Is(err, exception.ErrDeviceNotFound) {
+		t.Errorf("Expected ErrDeviceNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package rbd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/wonderivan/logger"
+)
+
+// cephConfig is a temporary ceph.conf and keyring built from the connection
+// info, so that the rbd commands do not depend on the files in /etc/ceph
+type cephConfig struct {
+	dir     string
+	conf    string
+	keyring string
+	user    string
+	cluster string
+}
+
+// writeCephConfig Write the ceph.conf and keyring of the connection info into
+// a new private directory, the caller removes them with remove
+func (c *ConnRbd) writeCephConfig() (*cephConfig, error) {
+	dir, err := os.MkdirTemp("", "brick-rbd-")
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "create ceph config directory")
+	}
+	cluster := c.ClusterName
+	if cluster == "" {
+		cluster = "ceph"
+	}
+	conf := &cephConfig{dir: dir, conf: filepath.Join(dir, cluster+".conf"), cluster: c.ClusterName}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[global]\nmon_host = %s\n", c.generateMonitorHost())
+	if mode, ok := msModeClientModes[c.MsMode]; ok {
+		fmt.Fprintf(&b, "ms_client_mode = %s\nms_mon_client_mode = %s\n", mode, mode)
+	}
+	if !c.AuthEnabled {
+		b.WriteString("auth_cluster_required = none\nauth_service_required = none\nauth_client_required = none\n")
+	} else {
+		conf.user = c.AuthUserName
+		if c.Keyring != "" {
+			conf.keyring = filepath.Join(dir, fmt.Sprintf("%s.client.%s.keyring", cluster, c.AuthUserName))
+			fmt.Fprintf(&b, "\n[client.%s]\nkeyring = %s\n", c.AuthUserName, conf.keyring)
+			if err := writePrivate(conf.keyring, keyringContent(c.AuthUserName, c.Keyring)); err != nil {
+				conf.remove()
+				return nil, err
+			}
+		}
+	}
+	if err := writePrivate(conf.conf, b.String()); err != nil {
+		conf.remove()
+		return nil, err
+	}
+	return conf, nil
+}
+
+// keyringContent Return the keyring file of user, the connection info holds
+// either a whole keyring or only the cephx key
+func keyringContent(user, keyring string) string {
+	if strings.HasPrefix(strings.TrimSpace(keyring), "[") {
+		return keyring
+	}
+	return fmt.Sprintf("[client.%s]\n\tkey = %s\n", user, strings.TrimSpace(keyring))
+}
+
+// writePrivate Write a file only the current user can read
+func writePrivate(path, content string) error {
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return exception.Wrap(exception.ErrIO, err, "write %s", path)
+	}
+	return nil
+}
+
+// args Return the options making an rbd command use the config and the
+// cluster name, the user is only passed when cephx is enabled
+func (conf *cephConfig) args() []string {
+	args := []string{"--conf", conf.conf}
+	if conf.cluster != "" {
+		args = append(args, "--cluster", conf.cluster)
+	}
+	if conf.user != "" {
+		args = append(args, "--id", conf.user)
+	}
+	if conf.keyring != "" {
+		args = append(args, "--keyring", conf.keyring)
+	}
+	return args
+}
+
+// remove Delete the config files
+func (conf *cephConfig) remove() {
+	if err := os.RemoveAll(conf.dir); err != nil {
+		logger.Warn("Remove ceph config %s failed: %v", conf.dir, err)
+	}
+}
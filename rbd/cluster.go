@@ -0,0 +1,69 @@
+package rbd
+
+import (
+	"net"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+)
+
+// MsMode is the messenger v2 connection mode of the ceph clients
+type MsMode string
+
+const (
+	// MsModeLegacy uses the messenger v1 protocol, krbd only
+	MsModeLegacy MsMode = "legacy"
+	// MsModeCRC uses messenger v2 with crc integrity checks
+	MsModeCRC MsMode = "crc"
+	// MsModeSecure uses messenger v2 with encryption
+	MsModeSecure MsMode = "secure"
+	// MsModePreferCRC uses crc mode unless the cluster only allows secure mode
+	MsModePreferCRC MsMode = "prefer-crc"
+	// MsModePreferSecure uses secure mode unless the cluster only allows crc mode
+	MsModePreferSecure MsMode = "prefer-secure"
+)
+
+// msModeClientModes are the userspace ms_client_mode values of the modes
+var msModeClientModes = map[MsMode]string{
+	MsModeCRC:          "crc",
+	MsModeSecure:       "secure",
+	MsModePreferCRC:    "crc secure",
+	MsModePreferSecure: "secure crc",
+}
+
+// Validate Check the mode is known, empty keeps the defaults of the cluster
+func (m MsMode) Validate() error {
+	if m == "" || m == MsModeLegacy {
+		return nil
+	}
+	if _, ok := msModeClientModes[m]; !ok {
+		return exception.InvalidConnInfo("rbd", "unknown ms_mode %q, expected legacy, crc, secure, prefer-crc or prefer-secure", string(m))
+	}
+	return nil
+}
+
+// formatMonitor Return the mon_host entry of a monitor. host is an IPv4 or
+// IPv6 address or a hostname, with or without a port, optionally prefixed
+// with v1: or v2:, or a whole [v2:...,v1:...] address vector which is kept
+// as it is. port is used when host has none
+func formatMonitor(host, port string) string {
+	host = strings.TrimSpace(host)
+	if strings.HasPrefix(host, "[v1:") || strings.HasPrefix(host, "[v2:") {
+		return host
+	}
+	var protocol string
+	if strings.HasPrefix(host, "v1:") || strings.HasPrefix(host, "v2:") {
+		protocol, host = host[:3], host[3:]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == "" {
+		if strings.Contains(host, ":") {
+			return protocol + "[" + host + "]"
+		}
+		return protocol + host
+	}
+	return protocol + net.JoinHostPort(host, port)
+}
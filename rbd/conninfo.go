@@ -0,0 +1,185 @@
+package rbd
+
+import (
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+)
+
+// ConnInfo is the rbd connection info returned by cinder initialize_connection
+type ConnInfo struct {
+	Name         string
+	Hosts        []string
+	Ports        []string
+	ClusterName  string
+	AuthEnabled  bool
+	AuthUserName string
+	VolumeID     string
+	Discard      bool
+	QosSpecs     string
+	Keyring      string
+	AccessMode   string
+	Encrypted    bool
+	// DeviceType selects how the image is mapped, krbd when it is empty
+	DeviceType DeviceType
+	// SecretType and SecretUUID name the libvirt secret holding the cephx key
+	SecretType string
+	SecretUUID string
+	// DiscardSet tells the connection info has a discard value, images are
+	// only mapped with notrim when discard is explicitly false
+	DiscardSet bool
+}
+
+// DeviceType is the kernel interface an image is mapped through
+type DeviceType string
+
+const (
+	// DeviceTypeKRBD maps images with the rbd kernel module, rbd map
+	DeviceTypeKRBD DeviceType = "krbd"
+	// DeviceTypeNBD maps images with librbd through nbd, rbd-nbd map
+	DeviceTypeNBD DeviceType = "nbd"
+	// DeviceTypeAuto maps images with krbd and falls back to nbd when krbd refuses the image
+	DeviceTypeAuto DeviceType = "auto"
+)
+
+// rawConnInfo is the wire form of ConnInfo
+type rawConnInfo struct {
+	Name         utils.String  `json:"name"`
+	Hosts        utils.Strings `json:"hosts"`
+	Ports        utils.Strings `json:"ports"`
+	ClusterName  utils.String  `json:"cluster_name"`
+	AuthEnabled  utils.Bool    `json:"auth_enabled"`
+	AuthUserName utils.String  `json:"auth_username"`
+	VolumeID     utils.String  `json:"volume_id"`
+	Discard      *utils.Bool   `json:"discard"`
+	QosSpecs     utils.String  `json:"qos_specs"`
+	Keyring      utils.String  `json:"keyring"`
+	SecretType   utils.String  `json:"secret_type"`
+	SecretUUID   utils.String  `json:"secret_uuid"`
+	AccessMode   utils.String  `json:"access_mode"`
+	Encrypted    utils.Bool    `json:"encrypted"`
+	DeviceType   utils.String  `json:"device_type"`
+}
+
+// ParseConnInfo Build a validated ConnInfo from the data section of a connection info map
+func ParseConnInfo(connInfo map[string]interface{}) (*ConnInfo, error) {
+	var raw rawConnInfo
+	if err := utils.DecodeConnInfoData(connInfo, &raw); err != nil {
+		return nil, exception.InvalidConnInfo("rbd", "%v", err)
+	}
+	info := &ConnInfo{
+		Name:         string(raw.Name),
+		Hosts:        raw.Hosts,
+		Ports:        raw.Ports,
+		ClusterName:  string(raw.ClusterName),
+		AuthEnabled:  bool(raw.AuthEnabled),
+		AuthUserName: string(raw.AuthUserName),
+		VolumeID:     string(raw.VolumeID),
+		Discard:      raw.Discard != nil && bool(*raw.Discard),
+		QosSpecs:     string(raw.QosSpecs),
+		Keyring:      string(raw.Keyring),
+		SecretType:   string(raw.SecretType),
+		SecretUUID:   string(raw.SecretUUID),
+		AccessMode:   string(raw.AccessMode),
+		Encrypted:    bool(raw.Encrypted),
+		DeviceType:   DeviceType(raw.DeviceType),
+		DiscardSet:   raw.Discard != nil,
+	}
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// DecodeConnInfo Build a validated ConnInfo from the JSON of a cinder initialize_connection call
+func DecodeConnInfo(b []byte) (*ConnInfo, error) {
+	connInfo, err := utils.ParseConnInfoJSON(b)
+	if err != nil {
+		return nil, exception.InvalidConnInfo("rbd", "%v", err)
+	}
+	return ParseConnInfo(connInfo)
+}
+
+// Validate Check the connection info is complete and consistent
+func (i *ConnInfo) Validate() error {
+	if _, err := ParseImageSpec(i.Name); err != nil {
+		return err
+	}
+	if len(i.Hosts) != len(i.Ports) {
+		return exception.InvalidConnInfo("rbd", "connection info has %d hosts but %d ports", len(i.Hosts), len(i.Ports))
+	}
+	for n, host := range i.Hosts {
+		if host == "" {
+			return exception.InvalidConnInfo("rbd", "monitor host %d is empty", n)
+		}
+	}
+	if i.AccessMode != "" && i.AccessMode != "rw" && i.AccessMode != "ro" {
+		return exception.InvalidConnInfo("rbd", "unknown access_mode %q, expected rw or ro", i.AccessMode)
+	}
+	if err := i.DeviceType.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ImageSpec identifies an rbd image or one of its snapshots
+type ImageSpec struct {
+	Pool string
+	// Namespace is the rados namespace of the image, empty for the default one
+	Namespace string
+	Image     string
+	// Snap is the snapshot, empty for the image head
+	Snap string
+}
+
+// ParseImageSpec Split a cinder volume name of the form
+// pool[/namespace]/image[@snap]
+func ParseImageSpec(name string) (ImageSpec, error) {
+	var spec ImageSpec
+	imagePath := name
+	if i := strings.Index(name, "@"); i >= 0 {
+		imagePath, spec.Snap = name[:i], name[i+1:]
+		if spec.Snap == "" || strings.ContainsAny(spec.Snap, "@/") {
+			return ImageSpec{}, exception.InvalidConnInfo("rbd", "volume name %q has an invalid snapshot", name)
+		}
+	}
+	parts := strings.Split(imagePath, "/")
+	switch len(parts) {
+	case 2:
+		spec.Pool, spec.Image = parts[0], parts[1]
+	case 3:
+		spec.Pool, spec.Namespace, spec.Image = parts[0], parts[1], parts[2]
+		if spec.Namespace == "" {
+			return ImageSpec{}, exception.InvalidConnInfo("rbd", "volume name %q has an empty namespace", name)
+		}
+	default:
+		return ImageSpec{}, exception.InvalidConnInfo("rbd", "volume name %q is not of the form pool[/namespace]/image[@snap]", name)
+	}
+	if spec.Pool == "" || spec.Image == "" {
+		return ImageSpec{}, exception.InvalidConnInfo("rbd", "volume name %q has an empty pool or image", name)
+	}
+	return spec, nil
+}
+
+// String Return the pool[/namespace]/image[@snap] form of the spec
+func (s ImageSpec) String() string {
+	name := s.Pool + "/"
+	if s.Namespace != "" {
+		name += s.Namespace + "/"
+	}
+	name += s.Image
+	if s.Snap != "" {
+		name += "@" + s.Snap
+	}
+	return name
+}
+
+// Validate Check the device type is known, empty is the default krbd
+func (t DeviceType) Validate() error {
+	switch t {
+	case "", DeviceTypeKRBD, DeviceTypeNBD, DeviceTypeAuto:
+		return nil
+	}
+	return exception.InvalidConnInfo("rbd", "unknown device_type %q, expected krbd, nbd or auto", string(t))
+}
@@ -0,0 +1,170 @@
+package rbd
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/wonderivan/logger"
+)
+
+// DefaultUdevTimeout is how long connect waits for udev to link a krbd device
+const DefaultUdevTimeout = 10 * time.Second
+
+// udevPollInterval is how often the udev link is checked while waiting for it
+const udevPollInterval = 100 * time.Millisecond
+
+// udevLink Return the /dev/rbd/<pool>[/<namespace>]/<image>[@<snap>] link
+// the ceph udev rules create for a krbd mapping of spec
+func udevLink(spec ImageSpec) string {
+	name := spec.Image
+	if spec.Snap != "" {
+		name += "@" + spec.Snap
+	}
+	return path.Join("/dev/rbd", spec.Pool, spec.Namespace, name)
+}
+
+// krbdPath Wait until udev links a krbd device and return the link. The
+// link only names the image, when the image of the same name is mapped from
+// another cluster too the link moves between the devices and the device
+// itself is returned instead
+func (c *ConnRbd) krbdPath(ctx context.Context, spec ImageSpec, device string) (string, error) {
+	shared, err := c.udevLinkShared(spec, device)
+	if err != nil {
+		return "", err
+	}
+	if shared {
+		logger.Warn("%s is mapped from several clusters, use %s instead of its udev link", spec, device)
+		return device, nil
+	}
+	return c.waitUdevLink(ctx, spec, device)
+}
+
+// udevLinkShared Check another krbd device than device maps the image of spec,
+// the udev link of spec then names either of them
+func (c *ConnRbd) udevLinkShared(spec ImageSpec, device string) (bool, error) {
+	mappings, err := ListMappings(c.Root)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mappings {
+		if m.Device != device && m.Matches(spec, nil) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitUdevLink Wait until the udev link of spec resolves to device and return
+// the link. The wait ends with an exception.ErrTimeout error after
+// UdevTimeout, or with the context error when ctx is done first
+func (c *ConnRbd) waitUdevLink(ctx context.Context, spec ImageSpec, device string) (string, error) {
+	link := udevLink(spec)
+	if c.UdevTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.UdevTimeout)
+		defer cancel()
+	}
+	for {
+		target, err := c.Root.EvalSymlinks(link)
+		if err == nil && target == device {
+			return link, nil
+		}
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				logger.Error("udev did not link %s to %s", link, device)
+				return "", exception.Wrap(exception.ErrTimeout, ctx.Err(), "wait for udev to link %s to %s", link, device)
+			}
+			return "", ctx.Err()
+		case <-time.After(udevPollInterval):
+		}
+	}
+}
+
+// stablePath Return the udev link of a krbd mapping when it resolves to the
+// device and no other device maps the image, and the device itself otherwise
+func (c *ConnRbd) stablePath(spec ImageSpec, m *Mapping, backend DeviceType) string {
+	if backend == DeviceTypeNBD {
+		return m.Device
+	}
+	if shared, err := c.udevLinkShared(spec, m.Device); err != nil || shared {
+		return m.Device
+	}
+	link := udevLink(spec)
+	if target, err := c.Root.EvalSymlinks(link); err == nil && target == m.Device {
+		return link
+	}
+	return m.Device
+}
+
+// findNbdDevice Return the nbd device of the image in the cluster of the
+// monitors from sysfs and procfs, the way rbd-nbd list-mapped finds it,
+// empty when it is not mapped
+func findNbdDevice(root sysfs.Root, spec ImageSpec, monitors []string) string {
+	pids, err := root.Glob("/sys/block/nbd*/pid")
+	if err != nil {
+		return ""
+	}
+	for _, pidFile := range pids {
+		device := "/dev/" + path.Base(path.Dir(pidFile))
+		cmdline, err := nbdCmdline(root, device)
+		if err != nil {
+			continue
+		}
+		mapped, err := ParseImageSpec(nbdMapSpec(cmdline))
+		if err == nil && mapped == spec && sameCluster(monitorHosts(nbdMonHost(cmdline)), monitors) {
+			return device
+		}
+	}
+	return ""
+}
+
+// nbdCmdline Return the command line of the rbd-nbd process serving an nbd device
+func nbdCmdline(root sysfs.Root, device string) ([]byte, error) {
+	pid, err := root.ReadString("/sys/block/" + path.Base(device) + "/pid")
+	if err != nil {
+		return nil, err
+	}
+	return root.ReadFile("/proc/" + pid + "/cmdline")
+}
+
+// nbdMonHost Return the monitors an rbd-nbd command line was given, empty
+// when it takes them from a config file
+func nbdMonHost(cmdline []byte) string {
+	args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+	for i, arg := range args {
+		for _, flag := range []string{"--mon_host", "--mon-host", "-m"} {
+			if arg == flag && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, flag+"=") {
+				return strings.TrimPrefix(arg, flag+"=")
+			}
+		}
+	}
+	return ""
+}
+
+// nbdMapSpec Return the image spec of an rbd-nbd map command line, the first
+// argument after map which is not an option
+func nbdMapSpec(cmdline []byte) string {
+	args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+	if path.Base(args[0]) != "rbd-nbd" {
+		return ""
+	}
+	mapping := false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "map":
+			mapping = true
+		case mapping && !strings.HasPrefix(arg, "-"):
+			return arg
+		}
+	}
+	return ""
+}
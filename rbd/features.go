@@ -0,0 +1,175 @@
+package rbd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/wonderivan/logger"
+)
+
+// supportedFeaturesFile is the feature mask of the rbd kernel module, it
+// exists since linux 4.11
+const supportedFeaturesFile = "/sys/bus/rbd/supported_features"
+
+// featureBits are the bits of the image features in the rbd feature masks
+var featureBits = map[string]uint64{
+	"layering":       1 << 0,
+	"striping":       1 << 1,
+	"exclusive-lock": 1 << 2,
+	"object-map":     1 << 3,
+	"fast-diff":      1 << 4,
+	"deep-flatten":   1 << 5,
+	"journaling":     1 << 6,
+	"data-pool":      1 << 7,
+	"operations":     1 << 8,
+	"migrating":      1 << 9,
+	"non-primary":    1 << 10,
+}
+
+// disableOrder are the features an image can be attached without, in the
+// order rbd feature disable accepts them
+var disableOrder = []string{"journaling", "fast-diff", "object-map", "deep-flatten"}
+
+// FeatureRemediation is what the connector does when the kernel does not
+// support features of an image it maps with krbd
+type FeatureRemediation string
+
+const (
+	// FeatureRemediationNone fails the attach with an *UnsupportedFeaturesError
+	FeatureRemediationNone FeatureRemediation = ""
+	// FeatureRemediationDisable disables the features the attach does not
+	// need with rbd feature disable, the change applies to every client of the image
+	FeatureRemediationDisable FeatureRemediation = "disable"
+	// FeatureRemediationNBD maps the image with rbd-nbd instead
+	FeatureRemediationNBD FeatureRemediation = "nbd"
+)
+
+// Validate Check the remediation is known
+func (r FeatureRemediation) Validate() error {
+	switch r {
+	case FeatureRemediationNone, FeatureRemediationDisable, FeatureRemediationNBD:
+		return nil
+	}
+	return exception.InvalidConnInfo("rbd", "unknown feature remediation %q, expected disable or nbd", string(r))
+}
+
+// UnsupportedFeaturesError is returned when the kernel can not map an image
+// because it does not support some of its features
+type UnsupportedFeaturesError struct {
+	Image string
+	// Features are the features of the image the kernel does not support
+	Features []string
+}
+
+func (e *UnsupportedFeaturesError) Error() string {
+	return fmt.Sprintf("the kernel rbd client does not support the features %s of image %s, disable them with rbd feature disable or map the image with rbd-nbd",
+		strings.Join(e.Features, ", "), e.Image)
+}
+
+// Is makes an UnsupportedFeaturesError match ErrUnsupportedFeature
+func (e *UnsupportedFeaturesError) Is(target error) bool {
+	return target == exception.ErrUnsupportedFeature
+}
+
+// readSupportedFeatures Read the feature mask of the rbd kernel module,
+// ok is false when the kernel does not report it
+func readSupportedFeatures(root sysfs.Root) (mask uint64, ok bool, err error) {
+	value, err := root.ReadString(supportedFeaturesFile)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, exception.Wrap(exception.ErrIO, err, "read %s", supportedFeaturesFile)
+	}
+	mask, err = strconv.ParseUint(value, 0, 64)
+	if err != nil {
+		return 0, false, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse %s", supportedFeaturesFile)
+	}
+	return mask, true, nil
+}
+
+// unsupportedFeatures Return the features missing from mask, the features
+// of unknown names are unsupported as well
+func unsupportedFeatures(features []string, mask uint64) []string {
+	var unsupported []string
+	for _, f := range features {
+		if bit, ok := featureBits[f]; !ok || mask&bit == 0 {
+			unsupported = append(unsupported, f)
+		}
+	}
+	return unsupported
+}
+
+// checkKrbdFeatures Compare the features of the image with the ones the
+// kernel supports before mapping it with krbd, and return the backend the
+// image has to be mapped with. Images the kernel can not map go to rbd-nbd
+// in auto mode, otherwise FeatureRemediation decides
+func (c *ConnRbd) checkKrbdFeatures(ctx context.Context, conf *cephConfig, spec ImageSpec, backend DeviceType) (DeviceType, error) {
+	mask, ok, err := readSupportedFeatures(c.Root)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		logger.Debug("%s does not exist, the features of %s are not checked", supportedFeaturesFile, spec)
+		return backend, nil
+	}
+	info, err := c.imageInfo(ctx, conf)
+	if err != nil {
+		return "", err
+	}
+	unsupported := unsupportedFeatures(info.Features, mask)
+	if len(unsupported) == 0 {
+		return backend, nil
+	}
+	logger.Warn("The kernel does not support the features %v of volume %s", unsupported, spec)
+	if backend == DeviceTypeAuto || c.FeatureRemediation == FeatureRemediationNBD {
+		logger.Info("Mapping volume %s with rbd-nbd", spec)
+		return DeviceTypeNBD, nil
+	}
+	featureErr := &UnsupportedFeaturesError{Image: spec.String(), Features: unsupported}
+	if c.FeatureRemediation != FeatureRemediationDisable {
+		return "", featureErr
+	}
+	var disable []string
+	for _, f := range disableOrder {
+		if contains(unsupported, f) {
+			disable = append(disable, f)
+		}
+	}
+	if len(disable) != len(unsupported) {
+		return "", featureErr
+	}
+	if err := c.disableFeatures(ctx, conf, spec, disable); err != nil {
+		return "", err
+	}
+	return backend, nil
+}
+
+// disableFeatures Disable features of the image, snapshots share them with the image
+func (c *ConnRbd) disableFeatures(ctx context.Context, conf *cephConfig, spec ImageSpec, features []string) error {
+	spec.Snap = ""
+	logger.Warn("Disabling the features %v of volume %s", features, spec)
+	cmd := append([]string{"feature", "disable", spec.String()}, features...)
+	cmd = append(cmd, "--mon_host", c.generateMonitorHost())
+	cmd = append(cmd, conf.args()...)
+	if _, err := c.execute(ctx, "rbd", cmd...); err != nil {
+		logger.Error("Exec rbd feature disable failed", err)
+		return classifyRbdError(err)
+	}
+	return nil
+}
+
+// contains Check s holds v
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
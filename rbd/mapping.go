@@ -0,0 +1,209 @@
+package rbd
+
+import (
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+)
+
+// rbdDevicesDir holds a directory per image mapped by the rbd kernel module
+const rbdDevicesDir = "/sys/bus/rbd/devices"
+
+// optionalAttrs are the rbd device attributes older kernels do not have
+var optionalAttrs = map[string]bool{"pool_ns": true, "current_snap": true, "client_id": true, "cluster_fsid": true, "config_info": true}
+
+// Mapping is an image mapped on the host
+type Mapping struct {
+	// ID is the kernel device id, /dev/rbd<ID>, it is empty for nbd mappings
+	ID        string
+	Pool      string
+	Namespace string
+	Image     string
+	// Snap is the mapped snapshot, empty when the image head is mapped
+	Snap string
+	// Device is the block device of the mapping
+	Device string
+	// Size is the size of the device in bytes
+	Size        int64
+	ClientID    string
+	ClusterFSID string
+
+	// Monitors are the monitor hosts the image was mapped with, empty when
+	// they are not known
+	Monitors []string
+}
+
+// ListMappings Read the images mapped by the rbd kernel module from
+// /sys/bus/rbd/devices, sorted by device id
+func ListMappings(root sysfs.Root) ([]Mapping, error) {
+	entries, err := root.ReadDir(rbdDevicesDir)
+	if os.IsNotExist(err) {
+		// The rbd module is not loaded, nothing is mapped
+		return nil, nil
+	}
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "read %s", rbdDevicesDir)
+	}
+	var mappings []Mapping
+	for _, entry := range entries {
+		m, err := readMapping(root, entry.Name())
+		if os.IsNotExist(err) {
+			// The device was unmapped while we were reading it
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, *m)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		a, _ := strconv.Atoi(mappings[i].ID)
+		b, _ := strconv.Atoi(mappings[j].ID)
+		return a < b
+	})
+	return mappings, nil
+}
+
+// readMapping Read the sysfs attributes of the rbd device id
+func readMapping(root sysfs.Root, id string) (*Mapping, error) {
+	dir := path.Join(rbdDevicesDir, id)
+	attrs := map[string]string{}
+	for _, name := range []string{"pool", "name", "pool_ns", "current_snap", "size", "client_id", "cluster_fsid", "config_info"} {
+		value, err := root.ReadString(path.Join(dir, name))
+		if unknownAttr(name, err) {
+			continue
+		}
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, exception.Wrap(exception.ErrIO, err, "read %s/%s", dir, name)
+		}
+		attrs[name] = value
+	}
+	size, err := strconv.ParseInt(attrs["size"], 10, 64)
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse %s/size", dir)
+	}
+	m := &Mapping{
+		ID:          id,
+		Pool:        attrs["pool"],
+		Namespace:   attrs["pool_ns"],
+		Image:       attrs["name"],
+		Snap:        normalizeSnap(attrs["current_snap"]),
+		Device:      "/dev/rbd" + id,
+		Size:        size,
+		ClientID:    attrs["client_id"],
+		ClusterFSID: attrs["cluster_fsid"],
+	}
+	// config_info is the rbd map request: monitors, options, pool, image and snapshot
+	if fields := strings.Fields(attrs["config_info"]); len(fields) > 0 {
+		m.Monitors = monitorHosts(fields[0])
+	}
+	return m, nil
+}
+
+// unknownAttr Check err leaves an optional attribute unknown: older kernels
+// do not have it, and config_info can only be read with CAP_SYS_ADMIN, which
+// a process running its commands through sudo does not have. The monitors of
+// the mapping are then unknown and it is matched by its image alone
+func unknownAttr(name string, err error) bool {
+	if !optionalAttrs[name] {
+		return false
+	}
+	return os.IsNotExist(err) || (name == "config_info" && os.IsPermission(err))
+}
+
+// Matches Check the mapping is of the image, namespace and snapshot of spec
+// in the cluster of the monitors, see sameCluster
+func (m Mapping) Matches(spec ImageSpec, monitors []string) bool {
+	return m.Pool == spec.Pool && m.Namespace == spec.Namespace && m.Image == spec.Image &&
+		normalizeSnap(m.Snap) == spec.Snap && sameCluster(m.Monitors, monitors)
+}
+
+// monitorHosts Return the hosts of a mon_host list such as
+// 10.0.0.1:6789,[v2:10.0.0.2:3300,v1:10.0.0.2:6789],[fd00::1]:3300
+func monitorHosts(monHost string) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, addr := range strings.FieldsFunc(monHost, func(r rune) bool { return r == ',' || r == ' ' || r == ';' }) {
+		// An address vector is bracketed as a whole
+		if strings.HasPrefix(addr, "[v") {
+			addr = addr[1:]
+		}
+		addr = strings.TrimPrefix(strings.TrimPrefix(addr, "v1:"), "v2:")
+		if !strings.HasPrefix(addr, "[") {
+			addr = strings.TrimSuffix(addr, "]")
+		}
+		if i := strings.Index(addr, "/"); i >= 0 {
+			// The nonce of an entity address
+			addr = addr[:i]
+		}
+		host := addr
+		if strings.HasPrefix(addr, "[") {
+			host = strings.SplitN(addr[1:], "]", 2)[0]
+		} else if strings.Count(addr, ":") == 1 {
+			host = strings.SplitN(addr, ":", 2)[0]
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// sameCluster Check two lists of monitor hosts may be of the same cluster,
+// they share a host or one of them is unknown. Host names are not resolved,
+// a list with a host name is assumed to be of the same cluster
+func sameCluster(hosts, others []string) bool {
+	if len(hosts) == 0 || len(others) == 0 {
+		return true
+	}
+	for _, host := range append(append([]string{}, hosts...), others...) {
+		if net.ParseIP(host) == nil {
+			return true
+		}
+	}
+	for _, host := range hosts {
+		for _, other := range others {
+			if host == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeSnap Return the snapshot name tools report, where - means no snapshot
+func normalizeSnap(snap string) string {
+	snap = strings.TrimSpace(snap)
+	if snap == "-" {
+		return ""
+	}
+	return snap
+}
+
+// findKrbdMapping Return the kernel mapping of spec in the cluster of the
+// monitors, nil when it is not mapped
+func findKrbdMapping(root sysfs.Root, spec ImageSpec, monitors []string) (*Mapping, error) {
+	mappings, err := ListMappings(root)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mappings {
+		if mappings[i].Matches(spec, monitors) {
+			return &mappings[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/wonderivan/logger"
+)
+
+// mappedImage is an image mapping listed by rbd showmapped or rbd-nbd list-mapped
+type mappedImage struct {
+	Pool      string `json:"pool"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Image     string `json:"image"`
+	Snap      string `json:"snap"`
+	Device    string `json:"device"`
+}
+
+// image Return the image name, rbd showmapped calls it name and rbd-nbd image
+func (m mappedImage) image() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Image
+}
+
+// parseMappedImages Parse the json output of rbd showmapped or rbd-nbd
+// list-mapped, or the plain table older rbd-nbd versions print
+func parseMappedImages(out string) ([]mappedImage, error) {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return nil, nil
+	}
+	var list []mappedImage
+	switch out[0] {
+	case '[':
+		if err := json.Unmarshal([]byte(out), &list); err != nil {
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse mapped images")
+		}
+		return list, nil
+	case '{':
+		// Luminous prints an object keyed by device id
+		var byID map[string]mappedImage
+		if err := json.Unmarshal([]byte(out), &byID); err != nil {
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse mapped images")
+		}
+		for _, m := range byID {
+			list = append(list, m)
+		}
+		return list, nil
+	}
+	lines := strings.Split(out, "\n")
+	header := strings.Fields(lines[0])
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != len(header) {
+			return nil, exception.Wrap(exception.ErrUnexpectedOutput, nil, "mapped image line %q does not match header %q", line, lines[0])
+		}
+		var m mappedImage
+		for i, column := range header {
+			switch column {
+			case "pool":
+				m.Pool = fields[i]
+			case "namespace":
+				m.Namespace = fields[i]
+			case "image", "name":
+				m.Image = fields[i]
+			case "snap":
+				m.Snap = fields[i]
+			case "device":
+				m.Device = fields[i]
+			}
+		}
+		list = append(list, m)
+	}
+	return list, nil
+}
+
+// deviceType Return the device type the connector maps images with
+func (c *ConnRbd) deviceType() DeviceType {
+	if c.DeviceType == "" {
+		return DeviceTypeKRBD
+	}
+	return c.DeviceType
+}
+
+// findNbdMapping Return the nbd mapping of the image, nil when it is not mapped
+func (c *ConnRbd) findNbdMapping(ctx context.Context, spec ImageSpec) (*Mapping, error) {
+	out, err := c.execute(ctx, "rbd-nbd", "list-mapped", "--format", "json")
+	if err != nil {
+		// rbd-nbd is optional unless the connector always maps with it
+		if c.deviceType() != DeviceTypeNBD && errors.Is(err, exception.ErrCommandNotFound) {
+			return nil, nil
+		}
+		logger.Error("Exec rbd-nbd list-mapped failed", err)
+		return nil, classifyRbdError(err)
+	}
+	return findMapping(c.Root, out, spec, c.monitors())
+}
+
+// findMapping Return the mapping of the image in the cluster of the monitors
+// in a list of mapped images, the monitors of a mapping are read from the
+// command line of its rbd-nbd process
+func findMapping(root sysfs.Root, out string, spec ImageSpec, monitors []string) (*Mapping, error) {
+	list, err := parseMappedImages(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range list {
+		m := Mapping{
+			Pool:      image.Pool,
+			Namespace: image.Namespace,
+			Image:     image.image(),
+			Snap:      normalizeSnap(image.Snap),
+			Device:    image.Device,
+		}
+		if cmdline, err := nbdCmdline(root, m.Device); err == nil {
+			m.Monitors = monitorHosts(nbdMonHost(cmdline))
+		}
+		if m.Matches(spec, monitors) {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// mapNbd Map the image with rbd-nbd and return its device
+func (c *ConnRbd) mapNbd(ctx context.Context, conf *cephConfig, spec ImageSpec) (string, error) {
+	if _, err := c.execute(ctx, "which", "rbd-nbd"); err != nil {
+		logger.Error("Exec which rbd-nbd command failed", err)
+		return "", exception.Wrap(exception.ErrCommandNotFound, err, "rbd-nbd")
+	}
+	opts, err := c.nbdMapArgs()
+	if err != nil {
+		return "", err
+	}
+	cmd := []string{"map", spec.String(), "--mon_host", c.generateMonitorHost()}
+	cmd = append(cmd, opts...)
+	cmd = append(cmd, conf.args()...)
+	out, err := c.execute(ctx, "rbd-nbd", cmd...)
+	if err != nil {
+		logger.Error("rbd-nbd map command exec failed", err)
+		return "", classifyRbdError(err)
+	}
+	device := strings.TrimSpace(out)
+	logger.Info("command succeeded: rbd-nbd map path is %s", device)
+	return device, nil
+}
+
+// krbdRefused Check rbd map failed because the kernel does not support the image
+func krbdRefused(err error) bool {
+	var cmdErr *exception.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	return cmdErr.ExitCode == int(syscall.ENXIO) || strings.Contains(cmdErr.Stderr, "feature set mismatch")
+}
@@ -0,0 +1,234 @@
+package rbd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
+	"github.com/wonderivan/logger"
+)
+
+// kernelReleaseFile holds the release of the running kernel
+const kernelReleaseFile = "/proc/sys/kernel/osrelease"
+
+// MapOption is a krbd map option, key or key=value
+type MapOption struct {
+	Name  string
+	Value string
+}
+
+// String Return the key or key=value form of the option
+func (o MapOption) String() string {
+	if o.Value == "" {
+		return o.Name
+	}
+	return o.Name + "=" + o.Value
+}
+
+// kernelVersion is the major and minor version of a kernel release
+type kernelVersion struct {
+	major int
+	minor int
+}
+
+// krbdOptionKernels are the first kernel releases supporting the krbd map
+// options, options missing here are passed to the kernel as they are
+var krbdOptionKernels = map[string]kernelVersion{
+	"ro":                  {3, 0},
+	"read_only":           {3, 0},
+	"queue_depth":         {4, 2},
+	"lock_on_read":        {4, 9},
+	"exclusive":           {4, 12},
+	"osd_request_timeout": {4, 13},
+	"notrim":              {4, 17},
+	"lock_timeout":        {4, 17},
+	"alloc_size":          {5, 1},
+	"ms_mode":             {5, 11},
+}
+
+// nbdOptionFlags are the rbd-nbd flags of the map options it supports
+var nbdOptionFlags = map[string]string{
+	"ro":         "--read-only",
+	"read_only":  "--read-only",
+	"exclusive":  "--exclusive",
+	"io_timeout": "--io-timeout",
+}
+
+// ParseMapOptions Parse a comma separated list of map options such as
+// queue_depth=128,exclusive
+func ParseMapOptions(s string) ([]MapOption, error) {
+	var opts []MapOption
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		opt := MapOption{Name: strings.TrimSpace(kv[0])}
+		if len(kv) == 2 {
+			opt.Value = strings.TrimSpace(kv[1])
+			if opt.Value == "" {
+				return nil, exception.InvalidConnInfo("rbd", "map option %q has an empty value", field)
+			}
+		}
+		if opt.Name == "" {
+			return nil, exception.InvalidConnInfo("rbd", "map option %q has no name", field)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// mapOptions Merge the default map options of the connector with the ones
+// the connection info asks for, the connection info wins
+func (c *ConnRbd) mapOptions() ([]MapOption, error) {
+	opts, err := ParseMapOptions(c.MapOptions)
+	if err != nil {
+		return nil, err
+	}
+	if c.readOnly() {
+		opts = setMapOption(opts, MapOption{Name: "ro"})
+	} else if c.AccessMode == "rw" {
+		// A deployment wide read-only default does not apply to rw volumes
+		opts = removeMapOption(removeMapOption(opts, "ro"), "read_only")
+	}
+	if c.DiscardSet && !c.Discard {
+		opts = setMapOption(opts, MapOption{Name: "notrim"})
+	}
+	if c.MsMode != "" {
+		opts = setMapOption(opts, MapOption{Name: "ms_mode", Value: string(c.MsMode)})
+	}
+	return opts, nil
+}
+
+// readOnly Check the image has to be mapped read-only, snapshots always are
+func (c *ConnRbd) readOnly() bool {
+	if spec, err := ParseImageSpec(c.Name); err == nil && spec.Snap != "" {
+		return true
+	}
+	return c.AccessMode == "ro"
+}
+
+// setMapOption Replace the option of the same name or append it
+func setMapOption(opts []MapOption, opt MapOption) []MapOption {
+	for i := range opts {
+		if opts[i].Name == opt.Name {
+			opts[i] = opt
+			return opts
+		}
+	}
+	return append(opts, opt)
+}
+
+// removeMapOption Drop the options named name
+func removeMapOption(opts []MapOption, name string) []MapOption {
+	var kept []MapOption
+	for _, opt := range opts {
+		if opt.Name != name {
+			kept = append(kept, opt)
+		}
+	}
+	return kept
+}
+
+// krbdMapArgs Return the -o argument of rbd map, the options the running
+// kernel does not support are dropped with a warning
+func (c *ConnRbd) krbdMapArgs() ([]string, error) {
+	opts, err := c.mapOptions()
+	if err != nil {
+		return nil, err
+	}
+	release, releaseErr := readKernelVersion(c.Root)
+	if releaseErr != nil {
+		logger.Warn("Read kernel release failed, map options are not checked: %v", releaseErr)
+	}
+	var supported []string
+	for _, opt := range opts {
+		if min, ok := krbdOptionKernels[opt.Name]; ok && releaseErr == nil && release.before(min) {
+			logger.Warn("Kernel %s does not support rbd map option %s, it needs %s", release, opt, min)
+			continue
+		}
+		supported = append(supported, opt.String())
+	}
+	logger.Info("Mapping volume %s with krbd options %q", c.Name, strings.Join(supported, ","))
+	if len(supported) == 0 {
+		return nil, nil
+	}
+	return []string{"-o", strings.Join(supported, ",")}, nil
+}
+
+// nbdMapArgs Return the rbd-nbd map flags of the options, rbd-nbd does not
+// support the other krbd options and they are dropped with a warning
+func (c *ConnRbd) nbdMapArgs() ([]string, error) {
+	opts, err := c.mapOptions()
+	if err != nil {
+		return nil, err
+	}
+	var args, effective []string
+	for _, opt := range opts {
+		if opt.Name == "ms_mode" {
+			// librbd reads the mode from the ceph config
+			continue
+		}
+		flag, ok := nbdOptionFlags[opt.Name]
+		if !ok {
+			logger.Warn("rbd-nbd does not support map option %s", opt)
+			continue
+		}
+		args = append(args, flag)
+		if opt.Value != "" {
+			args = append(args, opt.Value)
+		}
+		effective = append(effective, opt.String())
+	}
+	logger.Info("Mapping volume %s with rbd-nbd options %q", c.Name, strings.Join(effective, ","))
+	return args, nil
+}
+
+// readKernelVersion Read the version of the running kernel
+func readKernelVersion(root sysfs.Root) (kernelVersion, error) {
+	release, err := root.ReadString(kernelReleaseFile)
+	if err != nil {
+		return kernelVersion{}, err
+	}
+	return parseKernelVersion(release)
+}
+
+// parseKernelVersion Parse the major and minor version of a release such as 5.15.0-91-generic
+func parseKernelVersion(release string) (kernelVersion, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return kernelVersion{}, exception.Wrap(exception.ErrUnexpectedOutput, nil, "kernel release %q", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return kernelVersion{}, exception.Wrap(exception.ErrUnexpectedOutput, err, "kernel release %q", release)
+	}
+	minor, err := strconv.Atoi(leadingDigits(parts[1]))
+	if err != nil {
+		return kernelVersion{}, exception.Wrap(exception.ErrUnexpectedOutput, err, "kernel release %q", release)
+	}
+	return kernelVersion{major: major, minor: minor}, nil
+}
+
+// leadingDigits Return the digits s starts with
+func leadingDigits(s string) string {
+	for i, r := range s {
+		if r < '0' || r > '9' {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// before Check the version is older than min
+func (v kernelVersion) before(min kernelVersion) bool {
+	return v.major < min.major || (v.major == min.major && v.minor < min.minor)
+}
+
+// String Return the major.minor form of the version
+func (v kernelVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
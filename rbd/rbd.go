@@ -1,191 +1,455 @@
 package rbd
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/lock"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 	"github.com/wonderivan/logger"
 )
 
-var utilsExecute = utils.Execute
-
 // ConnRbd contains rbd volume info
 type ConnRbd struct {
-	Name          string
-	Hosts         []string
-	Ports         []string
-	ClusterName   string
-	AuthEnabled   bool
-	AuthUserName  string
-	VolumeID      string
-	Discard       bool
-	QosSpecs      string
-	Keyring       string
-	AccessMode    string
-	Encrypted     bool
+	ConnInfo
 	DoLocalAttach bool
+	// Executor runs the rbd commands, they run directly when it is nil
+	Executor utils.Executor
+	// Store records the attachment, nothing is recorded when it is nil
+	Store state.Store
+	// Locker serializes the operations on the image between processes, there is no locking when it is nil
+	Locker *lock.Locker
+	// Root is where the host sysfs and devfs are mounted, device paths stay
+	// relative to the host
+	Root sysfs.Root
+	// MapOptions are the default map options of the deployment, for example
+	// queue_depth=128,exclusive, the access mode and discard of the
+	// connection info are added to them
+	MapOptions string
+	// MsMode is the messenger v2 mode of the clients, the defaults of the
+	// cluster are used when it is empty
+	MsMode MsMode
+	// UnmapRetries is how many times an unmap failing with EBUSY is retried,
+	// waiting UnmapRetryInterval before the first retry and twice as long
+	// before every next one
+	UnmapRetries       int
+	UnmapRetryInterval time.Duration
+	// ForceUnmap unmaps devices which are still held or mounted, and
+	// escalates to rbd unmap -o force when the retries are exhausted
+	ForceUnmap bool
+	// FeatureRemediation is what is done when the kernel does not support
+	// features of an image mapped with krbd, the attach fails when it is empty
+	FeatureRemediation FeatureRemediation
+	// UdevTimeout is how long connect waits for udev to create the
+	// /dev/rbd/<pool>[/<namespace>]/<image> link of a krbd device
+	UdevTimeout time.Duration
+
+	connInfo map[string]interface{}
 }
 
 // NewRBDConnector Return ConnRbd Pointer to the object
-func NewRBDConnector(connInfo map[string]interface{}) *ConnRbd {
-	data := connInfo["data"].(map[string]interface{})
-	conn := &ConnRbd{}
-	conn.Name = utils.ToString(data["name"])
-	conn.Hosts = utils.ToStringSlice(data["hosts"])
-	conn.Ports = utils.ToStringSlice(data["ports"])
-	conn.ClusterName = utils.ToString(data["cluster_name"])
-	conn.AuthEnabled = utils.ToBool(data["auth_enabled"])
-	conn.AuthUserName = utils.ToString(data["auth_username"])
-	conn.VolumeID = utils.ToString(data["volume_id"])
-	conn.Discard = utils.ToBool(data["discard"])
-	conn.QosSpecs = utils.ToString(data["qos_specs"])
-	conn.AccessMode = utils.ToString(data["access_mode"])
-	conn.Encrypted = utils.ToBool(data["encrypted"])
-	conn.DoLocalAttach = utils.ToBool(connInfo["do_local_attach"])
-	return conn
-}
-
-// ConnectVolume Connect to a volume
-func (c *ConnRbd) ConnectVolume() (map[string]string, error) {
-	var err error
-	if c.DoLocalAttach {
-		result, err := c.localAttachVolume()
+func NewRBDConnector(connInfo map[string]interface{}) (*ConnRbd, error) {
+	info, err := ParseConnInfo(connInfo)
+	if err != nil {
+		return nil, err
+	}
+	var doLocalAttach utils.Bool
+	if err := utils.DecodeValue(connInfo["do_local_attach"], &doLocalAttach); err != nil {
+		return nil, exception.InvalidConnInfo("rbd", "do_local_attach: %v", err)
+	}
+	conn := &ConnRbd{
+		ConnInfo:           *info,
+		DoLocalAttach:      bool(doLocalAttach),
+		UnmapRetries:       DefaultUnmapRetries,
+		UnmapRetryInterval: DefaultUnmapRetryInterval,
+		UdevTimeout:        DefaultUdevTimeout,
+		connInfo:           connInfo,
+	}
+	return conn, nil
+}
+
+// ConnectVolume Connect to a volume, without local attach nothing is mapped
+// and the result describes the image for librbd
+func (c *ConnRbd) ConnectVolume(ctx context.Context) (map[string]string, error) {
+	if !c.DoLocalAttach {
+		res, err := c.remoteDescriptor()
 		if err != nil {
-			logger.Error("Do local attach volume failed", err)
 			return nil, err
 		}
-		logger.Info("RBD Connect Success, Map Path is %s", result["path"])
-		return result, nil
+		logger.Info("RBD volume %s is attached through librbd", c.Name)
+		return res, nil
 	}
-	return nil, err
+	unlock, err := c.lockImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	result, backend, err := c.localAttachVolume(ctx)
+	if err != nil {
+		logger.Error("Do local attach volume failed", err)
+		return nil, err
+	}
+	logger.Info("RBD Connect Success, Map Path is %s", result["path"])
+	err = state.Save(c.Store, &state.Attachment{
+		ID:         c.AttachmentID(),
+		Protocol:   "RBD",
+		VolumeID:   c.VolumeID,
+		ConnInfo:   c.connInfo,
+		DevicePath: result["path"],
+		Details:    map[string]string{"device_type": string(backend)},
+	})
+	if err != nil {
+		logger.Error("Record rbd attachment failed", err)
+		return nil, err
+	}
+	return result, nil
 }
 
-// DisConnectVolume Disconnect a volume
-func (c *ConnRbd) DisConnectVolume() error {
+// DisConnectVolume Disconnect a volume, there is nothing to release on the
+// host without local attach
+func (c *ConnRbd) DisConnectVolume(ctx context.Context) error {
 	if c.DoLocalAttach {
-		rootDevice := c.findRootDevice()
-		if rootDevice != "" {
-			cmd := []string{"unmap", rootDevice}
-			res, err := utilsExecute("rbd", cmd...)
-			if err != nil {
-				logger.Error("Exec rbd unmap failed", err)
+		unlock, err := c.lockImage(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		m, backend, err := c.findRootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if err := c.unmap(ctx, m, backend); err != nil {
 				return err
 			}
-			logger.Debug("Exec rbd unmap command success", res)
+		}
+		if err := state.Forget(c.Store, c.AttachmentID()); err != nil {
+			logger.Error("Remove rbd attachment record failed", err)
+			return err
 		}
 	}
 	return nil
 }
 
-// ExtendVolume Refresh local volume view and return current size in bytes
-// Nothing to do, RBD attached volumes are automatically refreshed, but
-// we need to return the new size for compatibility
-func (c *ConnRbd) ExtendVolume() (int64, error) {
+// ExtendVolume Return the current size of the volume in bytes. A locally
+// attached volume needs no refresh, the kernel and rbd-nbd follow the image
+// size, so the size of its device is returned and recorded. Without local
+// attach the size is read from the cluster with rbd info
+func (c *ConnRbd) ExtendVolume(ctx context.Context) (int64, error) {
 	if c.DoLocalAttach {
-		device := c.findRootDevice()
-		if device == "" {
+		unlock, err := c.lockImage(ctx)
+		if err != nil {
+			return -1, err
+		}
+		defer unlock()
+		m, backend, err := c.findRootDevice(ctx)
+		if err != nil {
+			return -1, err
+		}
+		if m == nil {
 			logger.Error("device is not exist.")
-			return -1, errors.New("device is not exist")
+			return -1, exception.Wrap(exception.ErrDeviceNotFound, nil, "volume %s is not mapped", c.Name)
+		}
+		iSize, err := c.deviceSize(m, backend)
+		if err != nil {
+			return -1, err
+		}
+		logger.Info("extend volume to %d is success", iSize)
+		spec, err := ParseImageSpec(c.Name)
+		if err != nil {
+			return -1, err
 		}
-		deviceName := path.Base(device)
-		deviceNumber := deviceName[3:]
-		size, err := ioutil.ReadFile("/sys/devices/rbd/" + deviceNumber + "/size")
+		err = state.Update(c.Store, c.AttachmentID(), func(a *state.Attachment) {
+			a.DevicePath = c.stablePath(spec, m, backend)
+			a.Size = iSize
+		})
 		if err != nil {
-			logger.Error("Read /sys/devices/rbd/?/size failed", err)
+			logger.Error("Record rbd attachment failed", err)
 			return -1, err
 		}
-		strSize := string(size)
-		vSize := strings.Replace(strSize, "'", "", -1)
-		iSize, _ := strconv.ParseInt(vSize, 10, 64)
-		logger.Info("extend volume to %s is success", iSize)
 		return iSize, nil
 	}
-	return -1, nil
+	conf, err := c.writeCephConfig()
+	if err != nil {
+		return -1, err
+	}
+	defer conf.remove()
+	info, err := c.imageInfo(ctx, conf)
+	if err != nil {
+		return -1, err
+	}
+	logger.Info("volume %s size is %d", c.Name, info.Size)
+	return info.Size, nil
 }
 
-// findRootDevice Find the underlying /dev/rbd* device for a mapping
-// Use the showmapped command to list all acive mappings and find the
-// underlying /dev/rbd* device that corresponds to our pool and volume
-func (c *ConnRbd) findRootDevice() string {
-	volume := strings.Split(c.Name, "/")
-	poolVolume := volume[1]
-	cmd := []string{"showmapped", "--format=json"}
-	cmd = append(cmd, "--id")
-	cmd = append(cmd, c.AuthUserName)
-	res, err := utilsExecute("rbd", cmd...)
-	logger.Debug("Exec rbd showmapped command success", res)
+// deviceSize Return the size in bytes of a mapped device, krbd mappings
+// carry the size of their sysfs entry and nbd devices report it in sectors in /sys/block
+func (c *ConnRbd) deviceSize(m *Mapping, backend DeviceType) (int64, error) {
+	if backend != DeviceTypeNBD {
+		return m.Size, nil
+	}
+	sizePath := "/sys/block/" + path.Base(m.Device) + "/size"
+	size, err := c.Root.ReadFile(sizePath)
 	if err != nil {
-		logger.Error("Exec rbd showmapped failed", err)
-		return ""
+		logger.Error("Read %s failed", sizePath, err)
+		if os.IsNotExist(err) {
+			return -1, exception.Wrap(exception.ErrDeviceNotFound, err, "read %s", sizePath)
+		}
+		return -1, exception.Wrap(exception.ErrIO, err, "read %s", sizePath)
 	}
-	var result []map[string]string
-	err = json.Unmarshal([]byte(res), &result)
+	iSize, err := strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64)
 	if err != nil {
-		logger.Error("conversion json failed")
-		return ""
+		return -1, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse %s", sizePath)
 	}
-	for _, mapping := range result {
-		if mapping["name"] == poolVolume {
-			return mapping["device"]
+	return iSize * 512, nil
+}
+
+// findRootDevice Find the underlying /dev/rbd* or /dev/nbd* device for a mapping
+// Read the kernel mappings from sysfs and the rbd-nbd ones with list-mapped,
+// depending on the backends the image may be mapped with, and find the mapping
+// of our pool, namespace, image and snapshot. A nil mapping and a nil error
+// are returned when the volume is not mapped
+func (c *ConnRbd) findRootDevice(ctx context.Context) (*Mapping, DeviceType, error) {
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		logger.Error("Parse rbd volume name failed", err)
+		return nil, "", err
+	}
+	if c.deviceType() != DeviceTypeNBD {
+		m, err := findKrbdMapping(c.Root, spec, c.monitors())
+		if err != nil || m != nil {
+			return m, DeviceTypeKRBD, err
 		}
 	}
-	return ""
+	if c.mayUseNbd() {
+		m, err := c.findNbdMapping(ctx, spec)
+		if err != nil || m != nil {
+			return m, DeviceTypeNBD, err
+		}
+	}
+	return nil, "", nil
 }
 
-// localAttachVolume Exec local attach volume process
-func (c *ConnRbd) localAttachVolume() (map[string]string, error) {
+// localAttachVolume Exec local attach volume process, it returns the backend which mapped the image
+func (c *ConnRbd) localAttachVolume(ctx context.Context) (map[string]string, DeviceType, error) {
 	res := map[string]string{}
-	_, err := utilsExecute("which", "rbd")
+	tool := "rbd"
+	if c.deviceType() == DeviceTypeNBD {
+		tool = "rbd-nbd"
+	}
+	_, err := c.execute(ctx, "which", tool)
 	if err != nil {
-		logger.Error("Exec which rbd command failed", err)
-		return nil, err
+		logger.Error("Exec which %s command failed", tool, err)
+		return nil, "", exception.Wrap(exception.ErrCommandNotFound, err, "%s", tool)
 	}
 
-	volume := strings.Split(c.Name, "/")
-	poolName := volume[0]
-	poolVolume := volume[1]
-	rbdDevPath := c.GetDevicePath()
-	_, err = os.Readlink(rbdDevPath)
-	monHost := c.generateMonitorHost()
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		return nil, "", err
+	}
+	m, backend, err := c.findRootDevice(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if m != nil {
+		logger.Info("Volume %s is already mapped to local device %s", spec, m.Device)
+		devicePath := m.Device
+		if backend != DeviceTypeNBD {
+			if devicePath, err = c.krbdPath(ctx, spec, m.Device); err != nil {
+				return nil, "", err
+			}
+		}
+		res["path"] = devicePath
+		res["type"] = "block"
+		return res, backend, nil
+	}
+	conf, err := c.writeCephConfig()
 	if err != nil {
-		cmd := []string{"map", poolVolume, "--pool", poolName, "--id", c.AuthUserName,
-			"--mon_host", monHost}
-		result, err := utilsExecute("rbd", cmd...)
+		return nil, "", err
+	}
+	defer conf.remove()
+	var rbdDevPath string
+	backend = c.deviceType()
+	if backend != DeviceTypeNBD {
+		backend, err = c.checkKrbdFeatures(ctx, conf, spec, backend)
 		if err != nil {
-			logger.Error("rbd map command exec failed", err)
-			return nil, err
+			return nil, "", err
 		}
-		logger.Info("command succeeded: rbd map path is %s", result)
-	} else {
-		logger.Info("Volume %s is already mapped to local device %s", poolVolume, rbdDevPath)
-		return nil, err
 	}
-
+	switch backend {
+	case DeviceTypeNBD:
+		rbdDevPath, err = c.mapNbd(ctx, conf, spec)
+	case DeviceTypeAuto:
+		backend = DeviceTypeKRBD
+		rbdDevPath, err = c.mapKrbd(ctx, conf, spec)
+		if krbdRefused(err) {
+			logger.Warn("krbd refused volume %s, mapping it with rbd-nbd: %v", c.Name, err)
+			backend = DeviceTypeNBD
+			rbdDevPath, err = c.mapNbd(ctx, conf, spec)
+		}
+	default:
+		rbdDevPath, err = c.mapKrbd(ctx, conf, spec)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if backend != DeviceTypeNBD {
+		devicePath, err := c.krbdPath(ctx, spec, rbdDevPath)
+		if err != nil {
+			// Do not leave behind a mapping the caller never got a path to
+			if unmapErr := c.runUnmap(ctx, &Mapping{Device: rbdDevPath}, backend, false); unmapErr != nil {
+				logger.Error("Unmap %s after the udev link wait failed", rbdDevPath, unmapErr)
+			}
+			return nil, "", err
+		}
+		rbdDevPath = devicePath
+	}
 	res["path"] = rbdDevPath
 	res["type"] = "block"
-	return res, nil
+	return res, backend, nil
 }
 
-// GetDevicePath Return device name which will be generated by RBD kernel module
-func (c *ConnRbd) GetDevicePath() string {
-	rootDevice := c.findRootDevice()
-	return rootDevice
+// mapKrbd Map the image with the rbd kernel module and return its device
+func (c *ConnRbd) mapKrbd(ctx context.Context, conf *cephConfig, spec ImageSpec) (string, error) {
+	monHost := c.generateMonitorHost()
+	opts, err := c.krbdMapArgs()
+	if err != nil {
+		return "", err
+	}
+	cmd := []string{"map", spec.Image, "--pool", spec.Pool}
+	if spec.Namespace != "" {
+		cmd = append(cmd, "--namespace", spec.Namespace)
+	}
+	if spec.Snap != "" {
+		cmd = append(cmd, "--snap", spec.Snap)
+	}
+	cmd = append(cmd, "--mon_host", monHost)
+	cmd = append(cmd, opts...)
+	cmd = append(cmd, conf.args()...)
+	result, err := c.execute(ctx, "rbd", cmd...)
+	if err != nil {
+		logger.Error("rbd map command exec failed", err)
+		return "", classifyRbdError(err)
+	}
+	rbdDevPath := strings.TrimSpace(result)
+	logger.Info("command succeeded: rbd map path is %s", rbdDevPath)
+	return rbdDevPath, nil
+}
+
+// GetDevicePath Return the /dev/rbd/<pool>[/<namespace>]/<image> link of a
+// krbd mapping, or the /dev/nbd* device of an rbd-nbd one. It only reads
+// sysfs and procfs, and it is empty without local attach
+func (c *ConnRbd) GetDevicePath(ctx context.Context) string {
+	if !c.DoLocalAttach {
+		return ""
+	}
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		return ""
+	}
+	if c.deviceType() != DeviceTypeNBD {
+		if m, err := findKrbdMapping(c.Root, spec, c.monitors()); err == nil && m != nil {
+			return c.stablePath(spec, m, DeviceTypeKRBD)
+		}
+	}
+	if c.mayUseNbd() {
+		return findNbdDevice(c.Root, spec, c.monitors())
+	}
+	return ""
+}
+
+// mayUseNbd Check the image may be mapped with rbd-nbd: the connector maps
+// with it, the feature remediation switches krbd attaches to it, or the
+// attachment record says the image was mapped with it
+func (c *ConnRbd) mayUseNbd() bool {
+	if c.deviceType() != DeviceTypeKRBD || c.FeatureRemediation == FeatureRemediationNBD {
+		return true
+	}
+	recorded, err := state.Lookup(c.Store, c.AttachmentID())
+	if err != nil {
+		logger.Warn("Read rbd attachment record failed: %v", err)
+		return false
+	}
+	return recorded != nil && recorded.Details["device_type"] == string(DeviceTypeNBD)
+}
+
+// AttachmentID Return the id the attachment of the image is recorded under,
+// the image name is qualified with the cluster key like the image lock
+func (c *ConnRbd) AttachmentID() string {
+	return "rbd:" + c.clusterKey() + ":" + c.Name
+}
+
+// lockImage Take the lock of the image
+func (c *ConnRbd) lockImage(ctx context.Context) (lock.Unlock, error) {
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	// The head and the snapshots of an image share a lock
+	return c.Locker.Lock(ctx, lock.ImageKey(c.clusterKey(), spec.Pool, path.Join(spec.Namespace, spec.Image)))
+}
+
+// monitors Return the monitor hosts of the cluster of the volume
+func (c *ConnRbd) monitors() []string {
+	return monitorHosts(c.generateMonitorHost())
+}
+
+// clusterKey Return the cluster name qualified with a digest of the monitor
+// hosts, clusters sharing a name but not their monitors get different keys
+func (c *ConnRbd) clusterKey() string {
+	hosts := c.monitors()
+	sort.Strings(hosts)
+	sum := sha256.Sum256([]byte(strings.Join(hosts, ",")))
+	name := c.ClusterName
+	if name == "" {
+		name = "ceph"
+	}
+	return fmt.Sprintf("%s-%x", name, sum[:4])
+}
+
+// execute Run a command through the connector executor and return its standard output
+func (c *ConnRbd) execute(ctx context.Context, name string, args ...string) (string, error) {
+	return utils.Exec(ctx, c.Executor, name, args...)
 }
 
 // generateMonitorHost generate monitor host
 func (c *ConnRbd) generateMonitorHost() string {
 	var monHosts []string
 	for i := range c.Hosts {
-		host := fmt.Sprintf("%s:%s", c.Hosts[i], c.Ports[i])
-		monHosts = append(monHosts, host)
+		monHosts = append(monHosts, formatMonitor(c.Hosts[i], c.Ports[i]))
 	}
 	monHost := strings.Join(monHosts, ",")
 	return monHost
 }
+
+// classifyRbdError Set the reason of an rbd command error from its exit
+// code, rbd exits with the errno of the failed operation
+func classifyRbdError(err error) error {
+	var cmdErr *exception.CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Reason != nil {
+		return err
+	}
+	switch cmdErr.ExitCode {
+	case int(syscall.EBUSY):
+		cmdErr.Reason = exception.ErrVolumeBusy
+	case int(syscall.ENOENT), int(syscall.ENXIO):
+		cmdErr.Reason = exception.ErrDeviceNotFound
+	case int(syscall.EACCES), int(syscall.EPERM):
+		cmdErr.Reason = exception.ErrAuthFailed
+	case int(syscall.ETIMEDOUT), int(syscall.EHOSTUNREACH), int(syscall.ECONNREFUSED):
+		cmdErr.Reason = exception.ErrTargetUnreachable
+	}
+	return cmdErr
+}
@@ -1,16 +1,24 @@
 package rbd
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/state"
+	"github.com/fightdou/os-brick-rbd/pkg/sysfs/sysfstest"
 	"github.com/fightdou/os-brick-rbd/pkg/utils"
 )
 
-var callRecords []string
 var (
 	fakePool     = "fake_pool"
 	fakeVolume   = "fake_volume"
@@ -22,9 +30,10 @@ var (
 	fakeHost2    = "host2"
 	fakePort2    = "2"
 	fakeDevice   = "/dev/rbd1"
+	fakeLink     = "/dev/rbd/fake_pool/fake_volume"
 )
 
-var rbdConnector = NewRBDConnector(map[string]interface{}{
+var fakeConnInfo = map[string]interface{}{
 	"data": map[string]interface{}{
 		"name":          fmt.Sprintf("%s/%s", fakePool, fakeVolume),
 		"hosts":         []interface{}{fakeHost1, fakeHost2},
@@ -39,77 +48,790 @@ var rbdConnector = NewRBDConnector(map[string]interface{}{
 		"encrypted":     1,
 	},
 	"do_local_attach": true,
-})
+}
+
+// confDir matches the temporary ceph config directory in a command line
+var confDir = regexp.MustCompile(`\S*/brick-rbd-[0-9]+`)
 
-func fakeExecute(command string, arg ...string) (string, error) {
-	cmdArg := strings.Join(arg, " ")
-	callRecords = append(callRecords, strings.Join([]string{command, cmdArg}, " "))
-	switch command {
+// fakeDeviceInfo is the sysfs entry of the image mapped on fakeDevice
+var fakeDeviceInfo = sysfstest.RBDDevice{ID: 1, Pool: fakePool, Image: fakeVolume, Size: 1 << 30, UdevLink: true}
+
+// fakeExecutor simulates the rbd cli for a single image, mapping it in a sysfs tree
+type fakeExecutor struct {
+	tree        *sysfstest.Tree
+	callRecords []string
+	// busy is how many more unmaps fail with EBUSY, forced unmaps always succeed
+	busy int
+	// noUdev maps the image without the udev link
+	noUdev bool
+	// confDirs are the ceph config directories the commands were given,
+	// confFiles the content of their files and confModes their modes
+	confDirs  []string
+	confFiles map[string]string
+	confModes map[string]os.FileMode
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, cmd utils.Command) (utils.Result, error) {
+	cmdArg := strings.Join(cmd.Args, " ")
+	if dir := confDir.FindString(cmdArg); dir != "" {
+		f.readConf(dir)
+	}
+	f.callRecords = append(f.callRecords, confDir.ReplaceAllString(cmd.String(), "$$CONF"))
+	switch cmd.Name {
 	case "which":
-		return fmt.Sprintf("/usr/bin/%s\n", cmdArg), nil
+		return utils.Result{Stdout: fmt.Sprintf("/usr/bin/%s\n", cmdArg)}, nil
+	case "blockdev":
+		return utils.Result{}, nil
 	case "rbd":
 		if strings.HasPrefix(cmdArg, "map") {
-			return fakeDevice, nil
+			info := fakeDeviceInfo
+			info.UdevLink = !f.noUdev
+			if err := f.tree.AddRBD(info); err != nil {
+				return utils.Result{}, err
+			}
+			return utils.Result{Stdout: fakeDevice + "\n"}, nil
 		} else if strings.HasPrefix(cmdArg, "unmap") {
-			return "", nil
-		} else if strings.HasPrefix(cmdArg, "showmapped") {
-			fakeRes := fmt.Sprintf("[{\"name\": \"%s\", \"device\": \"%s\"}]", fakeVolume, fakeDevice)
-			return fakeRes, nil
+			if f.busy > 0 && !strings.Contains(cmdArg, "-o force") {
+				f.busy--
+				err := exception.NewCommandError(cmd.Argv(), "", "rbd: unmap failed: (16) Device or resource busy", errors.New("exit status 16"))
+				err.ExitCode = 16
+				return utils.Result{ExitCode: 16}, err
+			}
+			return utils.Result{}, f.tree.RemoveRBD(fakeDeviceInfo.ID)
+		} else if strings.HasPrefix(cmdArg, "info") {
+			return utils.Result{Stdout: fmt.Sprintf("{\"name\": \"%s\", \"size\": %d}", fakeVolume, 1<<30)}, nil
 		}
-		return "", errors.New("Unexpected arg  for ceph")
+		return utils.Result{}, errors.New("Unexpected arg  for ceph")
 	default:
-		return "Unexpected command", errors.New("Unexpected command")
+		return utils.Result{Stdout: "Unexpected command"}, errors.New("Unexpected command")
+	}
+}
+
+// readConf Keep the content of the ceph config files in dir
+func (f *fakeExecutor) readConf(dir string) {
+	if f.confFiles == nil {
+		f.confFiles = map[string]string{}
+		f.confModes = map[string]os.FileMode{}
+	}
+	f.confDirs = append(f.confDirs, dir)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		b, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		info, _ := entry.Info()
+		f.confFiles[entry.Name()] = strings.ReplaceAll(string(b), dir, "$CONF")
+		f.confModes[entry.Name()] = info.Mode().Perm()
+	}
+}
+
+// newFakeConnector Build a connector for the fake connection info running commands on a fake executor
+func newFakeConnector(t *testing.T, mapped bool) (*ConnRbd, *fakeExecutor) {
+	conn, err := NewRBDConnector(fakeConnInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var layout sysfstest.Layout
+	if mapped {
+		layout.RBD = []sysfstest.RBDDevice{fakeDeviceInfo}
 	}
+	executor := &fakeExecutor{tree: sysfstest.New(t, layout)}
+	conn.Executor = executor
+	conn.Root = executor.tree.Root
+	return conn, executor
 }
 
 func TestConnectVolume(t *testing.T) {
-	utilsExecute = fakeExecute
-	defer func() {
-		utilsExecute = utils.Execute
-		callRecords = []string{}
-	}()
-	_, err := rbdConnector.ConnectVolume()
+	t.Parallel()
+	rbdConnector, executor := newFakeConnector(t, false)
+	res, err := rbdConnector.ConnectVolume(context.Background())
 	if err != nil {
 		t.Error("Volume connection encounter error.")
 	}
+	if res["path"] != fakeLink {
+		t.Errorf("Expected path %s, got %s", fakeLink, res["path"])
+	}
 	expected_cmds := []string{
 		"which rbd",
-		"rbd showmapped --format=json --id fake_user",
-		fmt.Sprintf("rbd map %s --pool %s --id %s --mon_host %s:%s,%s:%s", fakeVolume, fakePool, fakeUser, fakeHost1, fakePort1, fakeHost2, fakePort2),
+		fmt.Sprintf("rbd map %s --pool %s --mon_host %s:%s,%s:%s -o notrim --conf $CONF/fake_cluster.conf --cluster fake_cluster --id %s", fakeVolume, fakePool, fakeHost1, fakePort1, fakeHost2, fakePort2, fakeUser),
 	}
-	if !reflect.DeepEqual(expected_cmds, callRecords) {
-		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected_cmds, "\n"), strings.Join(callRecords, "\n"))
+	if !reflect.DeepEqual(expected_cmds, executor.callRecords) {
+		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected_cmds, "\n"), strings.Join(executor.callRecords, "\n"))
 	}
 }
 
 func TestDisConnectVolume(t *testing.T) {
-	utilsExecute = fakeExecute
-	defer func() {
-		utilsExecute = utils.Execute
-		callRecords = []string{}
-	}()
-	err := rbdConnector.DisConnectVolume()
+	t.Parallel()
+	rbdConnector, executor := newFakeConnector(t, true)
+	err := rbdConnector.DisConnectVolume(context.Background())
 	if err != nil {
 		t.Error("Volume disconnection encounter error.")
 	}
 	expected_cmds := []string{
-		"rbd showmapped --format=json --id fake_user",
-		fmt.Sprintf("rbd unmap %s", fakeDevice),
+		fmt.Sprintf("blockdev --flushbufs %s", fakeDevice),
+		fmt.Sprintf("rbd unmap %s --conf $CONF/fake_cluster.conf --cluster fake_cluster --id fake_user", fakeDevice),
 	}
-	if !reflect.DeepEqual(expected_cmds, callRecords) {
-		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected_cmds, "\n"), strings.Join(callRecords, "\n"))
+	if !reflect.DeepEqual(expected_cmds, executor.callRecords) {
+		t.Errorf("\nExpected calls:\n%s\nActual calls:\n%s", strings.Join(expected_cmds, "\n"), strings.Join(executor.callRecords, "\n"))
 	}
 }
 
 func TestGetDevicePath(t *testing.T) {
-	utilsExecute = fakeExecute
-	defer func() {
-		utilsExecute = utils.Execute
-		callRecords = []string{}
-	}()
-	expected_path := fakeDevice
-	path := rbdConnector.GetDevicePath()
+	t.Parallel()
+	rbdConnector, _ := newFakeConnector(t, true)
+	expected_path := fakeLink
+	path := rbdConnector.GetDevicePath(context.Background())
 	if path != expected_path {
 		t.Errorf("\nExpected path:\n%s\nActula path:\n%s", expected_path, path)
 	}
 }
+
+func TestNewRBDConnector(t *testing.T) {
+	t.Parallel()
+	rbdConnector, _ := newFakeConnector(t, false)
+	if !rbdConnector.AuthEnabled || !rbdConnector.Encrypted || rbdConnector.Discard || !rbdConnector.DiscardSet {
+		t.Errorf("Unexpected bool conversion: %+v", rbdConnector.ConnInfo)
+	}
+	if !rbdConnector.DoLocalAttach {
+		t.Error("Expected do_local_attach to be set.")
+	}
+}
+
+func TestParseImageSpec(t *testing.T) {
+	valid := map[string]ImageSpec{
+		"volumes/volume-1":               {Pool: "volumes", Image: "volume-1"},
+		"volumes/tenant/volume-1":        {Pool: "volumes", Namespace: "tenant", Image: "volume-1"},
+		"volumes/volume-1@backup":        {Pool: "volumes", Image: "volume-1", Snap: "backup"},
+		"volumes/tenant/volume-1@backup": {Pool: "volumes", Namespace: "tenant", Image: "volume-1", Snap: "backup"},
+	}
+	for name, expected := range valid {
+		spec, err := ParseImageSpec(name)
+		if err != nil || spec != expected {
+			t.Errorf("%s: expected %+v, got %+v %v", name, expected, spec, err)
+		}
+		if spec.String() != name {
+			t.Errorf("Expected %s to format back to itself, got %s", name, spec)
+		}
+	}
+	for _, name := range []string{"volume-1", "volumes/", "/volume-1", "volumes//volume-1", "a/b/c/d", "volumes/volume-1@", "volumes/volume-1@a@b"} {
+		if _, err := ParseImageSpec(name); !errors.Is(err, exception.ErrInvalidConnInfo) {
+			t.Errorf("Expected an error for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestDecodeConnInfo(t *testing.T) {
+	body := `{"connection_info": {"driver_volume_type": "rbd", "data": {
+		"name": "volumes/volume-1", "hosts": ["10.0.0.1", "10.0.0.2"], "ports": ["6789", 6789],
+		"auth_enabled": true, "auth_username": "cinder", "qos_specs": null, "discard": true}}}`
+	info, err := DecodeConnInfo([]byte(body))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(info.Ports, []string{"6789", "6789"}) || info.QosSpecs != "" || !info.Discard {
+		t.Errorf("Unexpected connection info %+v", info)
+	}
+
+	invalid := []string{
+		`{"data": {"name": "volume-1"}}`,
+		`{"data": {"name": "/volume-1"}}`,
+		`{"data": {"name": "volumes/volume-1", "hosts": ["10.0.0.1"], "ports": ["6789", "6789"]}}`,
+		`{"data": {"name": "volumes/volume-1", "access_mode": "rwx"}}`,
+		`{"data": {"name": "volumes/volume-1", "hosts": {"a": 1}}}`,
+		`{"driver_volume_type": "rbd"}`,
+		`[]`,
+	}
+	for _, body := range invalid {
+		if _, err := DecodeConnInfo([]byte(body)); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+}
+
+func TestConnectVolumeAlreadyMapped(t *testing.T) {
+	t.Parallel()
+	rbdConnector, executor := newFakeConnector(t, true)
+	res, err := rbdConnector.ConnectVolume(context.Background())
+	if err != nil || res["path"] != fakeLink {
+		t.Errorf("Expected the link of the mapped device %s, got %v %v", fakeLink, res, err)
+	}
+	for _, call := range executor.callRecords {
+		if strings.HasPrefix(call, "rbd map") {
+			t.Errorf("Unexpected call %s", call)
+		}
+	}
+}
+
+func TestAttachmentRecord(t *testing.T) {
+	t.Parallel()
+	rbdConnector, _ := newFakeConnector(t, false)
+	store := state.NewMemoryStore()
+	rbdConnector.Store = store
+	ctx := context.Background()
+	if _, err := rbdConnector.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	a, err := store.Get(rbdConnector.AttachmentID())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if a.Protocol != "RBD" || a.DevicePath != fakeLink || a.VolumeID != fakeVolumeId || a.AttachedAt.IsZero() {
+		t.Errorf("Unexpected attachment %+v", a)
+	}
+	if err := rbdConnector.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := store.Get(rbdConnector.AttachmentID()); !errors.Is(err, exception.ErrAttachmentNotFound) {
+		t.Errorf("Expected the record to be removed, got %v", err)
+	}
+}
+
+func TestClassifyRbdError(t *testing.T) {
+	busy := exception.NewCommandError([]string{"rbd", "unmap", fakeDevice}, "", "rbd: unmap failed: (16) Device or resource busy", nil)
+	busy.ExitCode = 16
+	err := classifyRbdError(busy)
+	if !errors.Is(err, exception.ErrVolumeBusy) || !errors.Is(err, exception.ErrCommandFailed) {
+		t.Errorf("Expected a busy command error, got %v", err)
+	}
+	if err := classifyRbdError(errors.New("other")); errors.Is(err, exception.ErrCommandFailed) {
+		t.Errorf("Unexpected classification of %v", err)
+	}
+}
+
+func TestExtendVolume(t *testing.T) {
+	t.Parallel()
+	rbdConnector, executor := newFakeConnector(t, true)
+	if err := executor.tree.SetSize("rbd1", 2<<30); err != nil {
+		t.Fatal(err)
+	}
+	size, err := rbdConnector.ExtendVolume(context.Background())
+	if err != nil || size != 2<<30 {
+		t.Errorf("Expected size %d, got %d %v", 2<<30, size, err)
+	}
+}
+
+func TestParseMappedImages(t *testing.T) {
+	spec := ImageSpec{Pool: fakePool, Image: fakeVolume}
+	outputs := map[string]string{
+		"showmapped":  `[{"id":"0","pool":"fake_pool","namespace":"","name":"fake_volume","snap":"-","device":"/dev/rbd0"}]`,
+		"list-mapped": `[{"id":"1234","pool":"fake_pool","namespace":"","image":"fake_volume","snap":"-","device":"/dev/nbd0"}]`,
+		"luminous":    `{"0":{"pool":"fake_pool","name":"fake_volume","snap":"-","device":"/dev/rbd0"}}`,
+		"table":       "pid  pool      image        snap device\n1234 fake_pool fake_volume -    /dev/nbd0\n",
+	}
+	root := sysfstest.New(t, sysfstest.Layout{}).Root
+	for name, out := range outputs {
+		m, err := findMapping(root, out, spec, nil)
+		if err != nil || m == nil || !strings.HasPrefix(m.Device, "/dev/") {
+			t.Errorf("%s: expected a device, got %+v %v", name, m, err)
+		}
+	}
+	snap := `[{"pool":"fake_pool","image":"fake_volume","snap":"snap1","device":"/dev/nbd1"}]`
+	if m, err := findMapping(root, snap, spec, nil); err != nil || m != nil {
+		t.Errorf("Expected snapshot mappings to be ignored, got %+v %v", m, err)
+	}
+	if _, err := parseMappedImages("pid pool\n1 2 3\n"); !errors.Is(err, exception.ErrUnexpectedOutput) {
+		t.Errorf("Expected ErrUnexpectedOutput, got %v", err)
+	}
+}
+
+func TestDeviceTypeValidate(t *testing.T) {
+	for _, dt := range []DeviceType{"", DeviceTypeKRBD, DeviceTypeNBD, DeviceTypeAuto} {
+		if err := dt.Validate(); err != nil {
+			t.Errorf("Unexpected error for %q: %v", dt, err)
+		}
+	}
+	if err := DeviceType("vhost").Validate(); !errors.Is(err, exception.ErrInvalidConnInfo) {
+		t.Errorf("Expected ErrInvalidConnInfo, got %v", err)
+	}
+}
+
+func TestRemoteAttach(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	connInfo := map[string]interface{}{
+		"data": map[string]interface{}{
+			"name":          fmt.Sprintf("%s/%s", fakePool, fakeVolume),
+			"hosts":         []interface{}{fakeHost1, fakeHost2},
+			"ports":         []interface{}{fakePort1, fakePort2},
+			"cluster_name":  fakeCluster,
+			"auth_enabled":  true,
+			"auth_username": fakeUser,
+			"secret_type":   "ceph",
+			"secret_uuid":   "457eb676-33da-42ec-9a8c-9293d545c337",
+		},
+		"do_local_attach": false,
+	}
+	rbdConnector, err := NewRBDConnector(connInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	executor := &fakeExecutor{}
+	rbdConnector.Executor = executor
+	rbdConnector.Store = state.NewMemoryStore()
+	res, err := rbdConnector.ConnectVolume(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[string]string{
+		"type":          "rbd",
+		"name":          "fake_pool/fake_volume",
+		"pool":          fakePool,
+		"namespace":     "",
+		"image":         fakeVolume,
+		"snap":          "",
+		"hosts":         "host1,host2",
+		"ports":         "1,2",
+		"cluster_name":  fakeCluster,
+		"auth_enabled":  "true",
+		"auth_username": fakeUser,
+		"secret_type":   "ceph",
+		"secret_uuid":   "457eb676-33da-42ec-9a8c-9293d545c337",
+		"access_mode":   "",
+		"discard":       "false",
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("Unexpected descriptor %v", res)
+	}
+	if path := rbdConnector.GetDevicePath(ctx); path != "" {
+		t.Errorf("Expected no device path, got %q", path)
+	}
+	size, err := rbdConnector.ExtendVolume(ctx)
+	if err != nil || size != 1<<30 {
+		t.Errorf("Expected size %d, got %d %v", 1<<30, size, err)
+	}
+	if err := rbdConnector.DisConnectVolume(ctx); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	expectedCalls := []string{"rbd info --format=json fake_pool/fake_volume --mon_host host1:1,host2:2 --conf $CONF/fake_cluster.conf --cluster fake_cluster --id fake_user"}
+	if !reflect.DeepEqual(executor.callRecords, expectedCalls) {
+		t.Errorf("Expected only rbd info to run, got %v", executor.callRecords)
+	}
+	if records, _ := rbdConnector.Store.List(); len(records) != 0 {
+		t.Errorf("Expected nothing to be recorded, got %v", records)
+	}
+}
+
+func TestCephConfig(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	connInfo := map[string]interface{}{
+		"data": map[string]interface{}{
+			"name":          fmt.Sprintf("%s/%s", fakePool, fakeVolume),
+			"hosts":         []interface{}{fakeHost1, fakeHost2},
+			"ports":         []interface{}{fakePort1, fakePort2},
+			"cluster_name":  fakeCluster,
+			"auth_enabled":  true,
+			"auth_username": fakeUser,
+			"keyring":       "AQBrZ3pjAAAAABAAVDaRuEwbSvBsmRRKwS4nDg==",
+		},
+		"do_local_attach": true,
+	}
+	rbdConnector, err := NewRBDConnector(connInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	executor := &fakeExecutor{tree: sysfstest.New(t, sysfstest.Layout{})}
+	rbdConnector.Executor = executor
+	rbdConnector.Root = executor.tree.Root
+	if _, err := rbdConnector.ConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	mapCmd := executor.callRecords[len(executor.callRecords)-1]
+	if !strings.HasSuffix(mapCmd, "--conf $CONF/fake_cluster.conf --cluster fake_cluster --id fake_user --keyring $CONF/fake_cluster.client.fake_user.keyring") {
+		t.Errorf("Expected the config and keyring options, got %s", mapCmd)
+	}
+	expected := map[string]string{
+		"fake_cluster.conf":                     "[global]\nmon_host = host1:1,host2:2\n\n[client.fake_user]\nkeyring = $CONF/fake_cluster.client.fake_user.keyring\n",
+		"fake_cluster.client.fake_user.keyring": "[client.fake_user]\n\tkey = AQBrZ3pjAAAAABAAVDaRuEwbSvBsmRRKwS4nDg==\n",
+	}
+	if !reflect.DeepEqual(executor.confFiles, expected) {
+		t.Errorf("Unexpected config files %q", executor.confFiles)
+	}
+	for name, mode := range executor.confModes {
+		if mode != 0600 {
+			t.Errorf("Expected %s to be private, got %v", name, mode)
+		}
+	}
+	for _, dir := range executor.confDirs {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", dir, err)
+		}
+	}
+
+	data := connInfo["data"].(map[string]interface{})
+	data["auth_enabled"] = false
+	rbdConnector, err = NewRBDConnector(connInfo)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	executor = &fakeExecutor{tree: executor.tree}
+	rbdConnector.Executor = executor
+	rbdConnector.Root = executor.tree.Root
+	if err := rbdConnector.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(executor.callRecords, []string{"blockdev --flushbufs /dev/rbd1", "rbd unmap /dev/rbd1 --conf $CONF/fake_cluster.conf --cluster fake_cluster"}) {
+		t.Errorf("Expected no cephx options, got %v", executor.callRecords)
+	}
+	if conf := executor.confFiles["fake_cluster.conf"]; !strings.Contains(conf, "auth_client_required = none") || len(executor.confFiles) != 1 {
+		t.Errorf("Expected cephx to be disabled, got %q", executor.confFiles)
+	}
+}
+
+func TestListMappings(t *testing.T) {
+	t.Parallel()
+	tree := sysfstest.New(t, sysfstest.Layout{
+		RBD: []sysfstest.RBDDevice{
+			{ID: 10, Pool: "other_pool", Image: fakeVolume, Size: 1 << 20},
+			{ID: 2, Pool: fakePool, Namespace: "tenant", Image: fakeVolume, Size: 2 << 20},
+			{ID: 3, Pool: fakePool, Image: fakeVolume, Snap: "backup", Size: 3 << 20},
+			{ID: 4, Pool: fakePool, Image: fakeVolume, Size: 4 << 20, ClientID: "client4100", ClusterFSID: "fsid", Monitors: "10.0.0.1:6789"},
+		},
+	})
+	mappings, err := ListMappings(tree.Root)
+	if err != nil || len(mappings) != 4 {
+		t.Fatalf("Expected 4 mappings, got %+v %v", mappings, err)
+	}
+	if mappings[0].ID != "2" || mappings[3].ID != "10" {
+		t.Errorf("Expected the mappings sorted by id, got %+v", mappings)
+	}
+	expected := Mapping{
+		ID: "4", Pool: fakePool, Image: fakeVolume, Device: "/dev/rbd4", Size: 4 << 20,
+		ClientID: "client4100", ClusterFSID: "fsid", Monitors: []string{"10.0.0.1"},
+	}
+	specs := map[ImageSpec]string{
+		{Pool: fakePool, Image: fakeVolume}:                      "/dev/rbd4",
+		{Pool: fakePool, Namespace: "tenant", Image: fakeVolume}: "/dev/rbd2",
+		{Pool: fakePool, Image: fakeVolume, Snap: "backup"}:      "/dev/rbd3",
+		{Pool: "other_pool", Image: fakeVolume}:                  "/dev/rbd10",
+		{Pool: "missing_pool", Image: fakeVolume}:                "",
+	}
+	for spec, device := range specs {
+		m, err := findKrbdMapping(tree.Root, spec, nil)
+		if err != nil || (m == nil) != (device == "") || (m != nil && m.Device != device) {
+			t.Errorf("Expected %s to be mapped on %q, got %+v %v", spec, device, m, err)
+		}
+		if device == "/dev/rbd4" && !reflect.DeepEqual(*m, expected) {
+			t.Errorf("Unexpected mapping %+v", *m)
+		}
+	}
+	if m, err := findKrbdMapping(tree.Root, ImageSpec{Pool: fakePool, Image: fakeVolume}, []string{"10.0.1.1"}); err != nil || m != nil {
+		t.Errorf("Expected the mapping of another cluster to be ignored, got %+v %v", m, err)
+	}
+	if mappings, err := ListMappings(sysfstest.New(t, sysfstest.Layout{}).Root); err != nil || len(mappings) != 0 {
+		t.Errorf("Expected no mappings without the rbd module, got %v %v", mappings, err)
+	}
+
+	// config_info needs CAP_SYS_ADMIN, the monitors are then unknown
+	for _, errno := range []syscall.Errno{syscall.EACCES, syscall.EPERM} {
+		err := &os.PathError{Op: "open", Path: "/sys/bus/rbd/devices/4/config_info", Err: errno}
+		if !unknownAttr("config_info", err) {
+			t.Errorf("Expected config_info to be unknown on %v", errno)
+		}
+		if unknownAttr("pool", err) {
+			t.Errorf("Expected pool to be required on %v", errno)
+		}
+	}
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(tree.Root.Path("/sys/bus/rbd/devices/4/config_info"), 0); err != nil {
+			t.Fatal(err)
+		}
+		m, err := findKrbdMapping(tree.Root, ImageSpec{Pool: fakePool, Image: fakeVolume}, []string{"10.0.1.1"})
+		if err != nil || m == nil || m.Device != "/dev/rbd4" || len(m.Monitors) != 0 {
+			t.Errorf("Expected /dev/rbd4 with unknown monitors, got %+v %v", m, err)
+		}
+	}
+}
+
+func TestMapOptions(t *testing.T) {
+	t.Parallel()
+	rbdConnector, _ := newFakeConnector(t, false)
+	rbdConnector.MapOptions = "queue_depth=128, exclusive,alloc_size=65536,lock_on_read,notrim"
+	rbdConnector.AccessMode = "ro"
+	rbdConnector.Discard = true
+	releases := map[string][]string{
+		"4.9.0-19-amd64":             {"-o", "queue_depth=128,lock_on_read,ro"},
+		"5.15.0-91-generic":          {"-o", "queue_depth=128,exclusive,alloc_size=65536,lock_on_read,notrim,ro"},
+		"4.18.0-513.el8.x86_64":      {"-o", "queue_depth=128,exclusive,lock_on_read,notrim,ro"},
+		"not a release, not checked": {"-o", "queue_depth=128,exclusive,alloc_size=65536,lock_on_read,notrim,ro"},
+	}
+	for release, expected := range releases {
+		rbdConnector.Root = sysfstest.New(t, sysfstest.Layout{Files: map[string]string{kernelReleaseFile: release}}).Root
+		args, err := rbdConnector.krbdMapArgs()
+		if err != nil || !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: expected %v, got %v %v", release, expected, args, err)
+		}
+	}
+	args, err := rbdConnector.nbdMapArgs()
+	if err != nil || !reflect.DeepEqual(args, []string{"--exclusive", "--read-only"}) {
+		t.Errorf("Unexpected rbd-nbd options %v %v", args, err)
+	}
+	rbdConnector.MapOptions = ""
+	rbdConnector.AccessMode = "rw"
+	if args, err := rbdConnector.krbdMapArgs(); err != nil || args != nil {
+		t.Errorf("Expected no options, got %v %v", args, err)
+	}
+	// notrim is only added for an explicit discard false, and rw volumes
+	// are not mapped with a read-only default
+	rbdConnector.Root = sysfstest.New(t, sysfstest.Layout{Files: map[string]string{kernelReleaseFile: "5.15.0-91-generic"}}).Root
+	rbdConnector.MapOptions = "ro,queue_depth=128,read_only"
+	rbdConnector.Discard, rbdConnector.DiscardSet = false, false
+	if args, err := rbdConnector.krbdMapArgs(); err != nil || !reflect.DeepEqual(args, []string{"-o", "queue_depth=128"}) {
+		t.Errorf("Expected only queue_depth without discard, got %v %v", args, err)
+	}
+	rbdConnector.DiscardSet = true
+	if args, err := rbdConnector.krbdMapArgs(); err != nil || !reflect.DeepEqual(args, []string{"-o", "queue_depth=128,notrim"}) {
+		t.Errorf("Expected notrim with discard false, got %v %v", args, err)
+	}
+	for _, invalid := range []string{"queue_depth=", "=128"} {
+		if _, err := ParseMapOptions(invalid); !errors.Is(err, exception.ErrInvalidConnInfo) {
+			t.Errorf("Expected an error for %q, got %v", invalid, err)
+		}
+	}
+}
+
+func TestFormatMonitor(t *testing.T) {
+	cases := []struct {
+		host, port, expected string
+	}{
+		{"10.0.0.1", "6789", "10.0.0.1:6789"},
+		{"mon1.example.com", "6789", "mon1.example.com:6789"},
+		{"fd00::1", "6789", "[fd00::1]:6789"},
+		{"[fd00::1]", "3300", "[fd00::1]:3300"},
+		{"[fd00::1]:3300", "", "[fd00::1]:3300"},
+		{"fd00::1", "", "[fd00::1]"},
+		{"10.0.0.1:3300", "6789", "10.0.0.1:3300"},
+		{"v2:10.0.0.1", "3300", "v2:10.0.0.1:3300"},
+		{"v2:fd00::1", "3300", "v2:[fd00::1]:3300"},
+		{"[v2:10.0.0.1:3300,v1:10.0.0.1:6789]", "", "[v2:10.0.0.1:3300,v1:10.0.0.1:6789]"},
+		{"[v2:10.0.0.1:3300,v1:10.0.0.1:6789]", "6789", "[v2:10.0.0.1:3300,v1:10.0.0.1:6789]"},
+	}
+	for _, c := range cases {
+		if res := formatMonitor(c.host, c.port); res != c.expected {
+			t.Errorf("formatMonitor(%q, %q): expected %s, got %s", c.host, c.port, c.expected, res)
+		}
+	}
+}
+
+func TestMonitorHosts(t *testing.T) {
+	cases := map[string][]string{
+		"10.0.0.1:6789,10.0.0.2:6789":                        {"10.0.0.1", "10.0.0.2"},
+		"[v2:10.0.0.1:3300,v1:10.0.0.1:6789],[fd00::2]:3300": {"10.0.0.1", "fd00::2"},
+		"v2:[fd00:0::1]:3300 mon1.example.com":               {"fd00::1", "mon1.example.com"},
+		"10.0.0.1:6789/0":                                    {"10.0.0.1"},
+		"":                                                   nil,
+	}
+	for monHost, expected := range cases {
+		if hosts := monitorHosts(monHost); !reflect.DeepEqual(hosts, expected) {
+			t.Errorf("%q: expected %v, got %v", monHost, expected, hosts)
+		}
+	}
+	if !sameCluster([]string{"10.0.0.1", "10.0.0.2"}, []string{"10.0.0.2"}) || !sameCluster(nil, []string{"10.0.0.2"}) {
+		t.Error("Expected monitor lists sharing a host or unknown to be of the same cluster")
+	}
+	if sameCluster([]string{"10.0.0.1"}, []string{"10.0.1.1"}) || !sameCluster([]string{"10.0.0.1"}, []string{"mon1"}) {
+		t.Error("Expected only disjoint addresses to be of other clusters")
+	}
+
+	rbdConnector, _ := newFakeConnector(t, false)
+	key := rbdConnector.clusterKey()
+	rbdConnector.Hosts = []string{"10.0.0.2", "10.0.0.1"}
+	rbdConnector.Ports = []string{"6789", "6789"}
+	reordered := rbdConnector.clusterKey()
+	rbdConnector.Hosts = []string{"10.0.0.1", "10.0.0.2"}
+	if rbdConnector.clusterKey() != reordered || !strings.HasPrefix(key, "fake_cluster-") {
+		t.Errorf("Expected the key to name the cluster and not depend on the monitor order, got %s %s", key, reordered)
+	}
+	rbdConnector.Hosts = []string{"10.0.1.1", "10.0.1.2"}
+	if rbdConnector.clusterKey() == reordered {
+		t.Error("Expected clusters on other monitors to get another key")
+	}
+}
+
+func TestMsMode(t *testing.T) {
+	t.Parallel()
+	rbdConnector, executor := newFakeConnector(t, false)
+	rbdConnector.MsMode = MsModePreferSecure
+	rbdConnector.Hosts = []string{"[v2:10.0.0.1:3300,v1:10.0.0.1:6789]", "fd00::2"}
+	rbdConnector.Ports = []string{"", "3300"}
+	if err := executor.tree.WriteFile(kernelReleaseFile, "5.15.0-91-generic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rbdConnector.ConnectVolume(context.Background()); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	mapCmd := executor.callRecords[len(executor.callRecords)-1]
+	if !strings.Contains(mapCmd, "--mon_host [v2:10.0.0.1:3300,v1:10.0.0.1:6789],[fd00::2]:3300 -o notrim,ms_mode=prefer-secure ") {
+		t.Errorf("Unexpected map command %s", mapCmd)
+	}
+	expected := "[global]\nmon_host = [v2:10.0.0.1:3300,v1:10.0.0.1:6789],[fd00::2]:3300\n" +
+		"ms_client_mode = secure crc\nms_mon_client_mode = secure crc\n"
+	if conf := executor.confFiles["fake_cluster.conf"]; conf != expected {
+		t.Errorf("Unexpected config %q", conf)
+	}
+	if args, err := rbdConnector.nbdMapArgs(); err != nil || len(args) != 0 {
+		t.Errorf("Expected rbd-nbd to take the mode from the config, got %v %v", args, err)
+	}
+	if err := MsMode("fast").Validate(); !errors.Is(err, exception.ErrInvalidConnInfo) {
+		t.Errorf("Expected ErrInvalidConnInfo, got %v", err)
+	}
+}
+
+func TestUnmapBusy(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	newConnector := func(busy, retries int, force bool) (*ConnRbd, *fakeExecutor) {
+		conn, executor := newFakeConnector(t, true)
+		executor.busy = busy
+		conn.UnmapRetries = retries
+		conn.UnmapRetryInterval = time.Millisecond
+		conn.ForceUnmap = force
+		return conn, executor
+	}
+	unmaps := func(executor *fakeExecutor) []string {
+		var cmds []string
+		for _, cmd := range executor.callRecords {
+			if strings.HasPrefix(cmd, "rbd unmap") {
+				cmds = append(cmds, strings.SplitN(cmd, " --conf", 2)[0])
+			}
+		}
+		return cmds
+	}
+
+	conn, executor := newConnector(0, 0, false)
+	tree := executor.tree
+	if err := tree.Symlink("/sys/block/dm-3", "/sys/block/rbd1/holders/dm-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Symlink("/sys/block/dm-4", "/sys/block/rbd1/rbd1p1/holders/dm-4"); err != nil {
+		t.Fatal(err)
+	}
+	mounts := "proc /proc proc rw 0 0\n" +
+		"/dev/rbd/fake_pool/fake_volume /mnt/data\\040disk ext4 rw 0 0\n" +
+		"/dev/rbd1p1 /mnt/part xfs rw 0 0\n" +
+		"/dev/rbd10 /mnt/other ext4 rw 0 0\n"
+	if err := tree.WriteFile("/proc/1/mounts", mounts); err != nil {
+		t.Fatal(err)
+	}
+	err := conn.DisConnectVolume(ctx)
+	var busyErr *exception.BusyError
+	if !errors.As(err, &busyErr) || !errors.Is(err, exception.ErrVolumeBusy) {
+		t.Fatalf("Expected a BusyError, got %v", err)
+	}
+	if !reflect.DeepEqual(busyErr.Holders, []string{"dm-3", "dm-4"}) || !reflect.DeepEqual(busyErr.Mounts, []string{"/mnt/data disk", "/mnt/part"}) {
+		t.Errorf("Expected the holders and mount points of /dev/rbd1, got %+v", busyErr)
+	}
+	if len(executor.callRecords) != 0 {
+		t.Errorf("Expected a device in use not to be unmapped, got %v", executor.callRecords)
+	}
+
+	conn, executor = newConnector(2, 4, false)
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cmds := unmaps(executor); len(cmds) != 3 {
+		t.Errorf("Expected the unmap to succeed on the third attempt, got %v", cmds)
+	}
+
+	conn, executor = newConnector(10, 2, false)
+	err = conn.DisConnectVolume(ctx)
+	var cmdErr *exception.CommandError
+	if !errors.As(err, &busyErr) || !errors.As(err, &cmdErr) || cmdErr.ExitCode != 16 {
+		t.Errorf("Expected a BusyError from the last unmap, got %v", err)
+	}
+	if cmds := unmaps(executor); len(cmds) != 3 {
+		t.Errorf("Expected 3 unmaps, got %v", cmds)
+	}
+
+	conn, executor = newConnector(10, 1, true)
+	if err := conn.DisConnectVolume(ctx); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []string{"rbd unmap /dev/rbd1", "rbd unmap /dev/rbd1", "rbd unmap /dev/rbd1 -o force"}
+	if cmds := unmaps(executor); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("Expected %v, got %v", expected, cmds)
+	}
+}
+
+func TestUnsupportedFeatures(t *testing.T) {
+	features := []string{"layering", "exclusive-lock", "object-map", "fast-diff", "journaling", "future-feature"}
+	expected := []string{"object-map", "fast-diff", "journaling", "future-feature"}
+	// layering, striping and exclusive-lock, as linux 4.9 reports
+	if unsupported := unsupportedFeatures(features, 0x7); !reflect.DeepEqual(unsupported, expected) {
+		t.Errorf("Expected %v, got %v", expected, unsupported)
+	}
+	tree := sysfstest.New(t, sysfstest.Layout{Files: map[string]string{supportedFeaturesFile: "0x3d\n"}})
+	if mask, ok, err := readSupportedFeatures(tree.Root); err != nil || !ok || mask != 0x3d {
+		t.Errorf("Expected mask 0x3d, got %#x %v %v", mask, ok, err)
+	}
+	if _, ok, err := readSupportedFeatures(sysfstest.New(t, sysfstest.Layout{}).Root); err != nil || ok {
+		t.Errorf("Expected a kernel without supported_features not to be checked, got %v %v", ok, err)
+	}
+}
+
+func TestUdevLink(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	rbdConnector, executor := newFakeConnector(t, false)
+	executor.noUdev = true
+	rbdConnector.UdevTimeout = 50 * time.Millisecond
+	if _, err := rbdConnector.ConnectVolume(ctx); !errors.Is(err, exception.ErrTimeout) {
+		t.Fatalf("Expected the wait for udev to time out, got %v", err)
+	}
+	if path := rbdConnector.GetDevicePath(ctx); path != "" {
+		t.Errorf("Expected the device to be unmapped after the timeout, got %q", path)
+	}
+	if last := executor.callRecords[len(executor.callRecords)-1]; !strings.HasPrefix(last, "rbd unmap "+fakeDevice) {
+		t.Errorf("Expected %s to be unmapped, got %q", fakeDevice, last)
+	}
+	// A device mapped earlier without the link is still handed out
+	info := fakeDeviceInfo
+	info.UdevLink = false
+	if err := executor.tree.AddRBD(info); err != nil {
+		t.Fatal(err)
+	}
+	if path := rbdConnector.GetDevicePath(ctx); path != fakeDevice {
+		t.Errorf("Expected %s without the udev link, got %q", fakeDevice, path)
+	}
+	if err := executor.tree.RemoveRBD(fakeDeviceInfo.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// udev creates the link while connect waits for it
+	rbdConnector.UdevTimeout = 10 * time.Second
+	go func() {
+		time.Sleep(3 * udevPollInterval)
+		executor.tree.Symlink(fakeDevice, fakeLink)
+	}()
+	res, err := rbdConnector.ConnectVolume(ctx)
+	if err != nil || res["path"] != fakeLink {
+		t.Fatalf("Expected %s, got %v %v", fakeLink, res, err)
+	}
+	calls := len(executor.callRecords)
+	if path := rbdConnector.GetDevicePath(ctx); path != fakeLink {
+		t.Errorf("Expected %s, got %q", fakeLink, path)
+	}
+	if len(executor.callRecords) != calls {
+		t.Errorf("Expected GetDevicePath not to run commands, got %v", executor.callRecords[calls:])
+	}
+
+	// A stale link to another device is not handed out
+	if err := executor.tree.Symlink("/dev/rbd7", fakeLink); err != nil {
+		t.Fatal(err)
+	}
+	if path := rbdConnector.GetDevicePath(ctx); path != fakeDevice {
+		t.Errorf("Expected %s with a stale link, got %q", fakeDevice, path)
+	}
+}
+
+func TestNbdMapSpec(t *testing.T) {
+	cmdlines := map[string]string{
+		"rbd-nbd\x00map\x00volumes/tenant/volume-1@backup\x00--mon_host\x00m1\x00": "volumes/tenant/volume-1@backup",
+		"/usr/bin/rbd-nbd\x00--read-only\x00map\x00volumes/volume-1\x00":           "volumes/volume-1",
+		"rbd\x00map\x00volumes/volume-1\x00":                                       "",
+		"rbd-nbd\x00list-mapped\x00":                                               "",
+	}
+	for cmdline, expected := range cmdlines {
+		if spec := nbdMapSpec([]byte(cmdline)); spec != expected {
+			t.Errorf("%q: expected %q, got %q", cmdline, expected, spec)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package rbd
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/wonderivan/logger"
+)
+
+// imageInfo is the part of rbd info --format=json the connector uses
+type imageInfo struct {
+	Name     string   `json:"name"`
+	Size     int64    `json:"size"`
+	Features []string `json:"features"`
+}
+
+// remoteDescriptor Describe the image for a hypervisor which opens it with
+// librbd, nothing is mapped on the host. Hosts and ports are comma separated
+// in the same order
+func (c *ConnRbd) remoteDescriptor() (map[string]string, error) {
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"type":          "rbd",
+		"name":          spec.String(),
+		"pool":          spec.Pool,
+		"namespace":     spec.Namespace,
+		"image":         spec.Image,
+		"snap":          spec.Snap,
+		"hosts":         strings.Join(c.Hosts, ","),
+		"ports":         strings.Join(c.Ports, ","),
+		"cluster_name":  c.ClusterName,
+		"auth_enabled":  strconv.FormatBool(c.AuthEnabled),
+		"auth_username": c.AuthUserName,
+		"secret_type":   c.SecretType,
+		"secret_uuid":   c.SecretUUID,
+		"access_mode":   c.AccessMode,
+		"discard":       strconv.FormatBool(c.Discard),
+	}, nil
+}
+
+// imageInfo Query the cluster for the image with rbd info
+func (c *ConnRbd) imageInfo(ctx context.Context, conf *cephConfig) (*imageInfo, error) {
+	spec, err := ParseImageSpec(c.Name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := []string{"info", "--format=json", spec.String(), "--mon_host", c.generateMonitorHost()}
+	cmd = append(cmd, conf.args()...)
+	out, err := c.execute(ctx, "rbd", cmd...)
+	if err != nil {
+		logger.Error("Exec rbd info failed", err)
+		return nil, classifyRbdError(err)
+	}
+	var info imageInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return nil, exception.Wrap(exception.ErrUnexpectedOutput, err, "parse rbd info of %s", spec)
+	}
+	return &info, nil
+}
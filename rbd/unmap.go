@@ -0,0 +1,175 @@
+package rbd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fightdou/os-brick-rbd/pkg/exception"
+	"github.com/fightdou/os-brick-rbd/pkg/utils"
+	"github.com/wonderivan/logger"
+)
+
+const (
+	// DefaultUnmapRetries is how many times a busy device is unmapped again
+	DefaultUnmapRetries = 4
+	// DefaultUnmapRetryInterval is the wait before the first retry, it
+	// doubles on every retry
+	DefaultUnmapRetryInterval = 500 * time.Millisecond
+)
+
+// mountsFile is the mount table of the host. The table of init is read
+// rather than /proc/self/mounts, which would be the one of our container
+const mountsFile = "/proc/1/mounts"
+
+// unmap Unmap the device of a mapping with the backend which mapped it.
+// The buffers are flushed first and an unmap failing with EBUSY is retried
+// with a growing interval, a device still held or mounted is only unmapped
+// when ForceUnmap is set, krbd devices then with rbd unmap -o force
+func (c *ConnRbd) unmap(ctx context.Context, m *Mapping, backend DeviceType) error {
+	holders, mounts, err := c.deviceUsers(m.Device)
+	if err != nil {
+		return err
+	}
+	if len(holders) > 0 || len(mounts) > 0 {
+		if !c.ForceUnmap {
+			return &exception.BusyError{Device: m.Device, Holders: holders, Mounts: mounts}
+		}
+		logger.Warn("Device %s is still in use, held by %v and mounted on %v, unmapping it anyway", m.Device, holders, mounts)
+	}
+	if _, err := c.execute(ctx, "blockdev", "--flushbufs", m.Device); err != nil {
+		logger.Warn("Flush the buffers of %s failed: %v", m.Device, err)
+	}
+	interval := c.UnmapRetryInterval
+	for attempt := 0; ; attempt++ {
+		err = c.runUnmap(ctx, m, backend, false)
+		if !errors.Is(err, exception.ErrVolumeBusy) || attempt >= c.UnmapRetries {
+			break
+		}
+		logger.Warn("Device %s is busy, unmapping it again in %s", m.Device, interval)
+		if err := utils.Sleep(ctx, interval); err != nil {
+			return err
+		}
+		interval *= 2
+	}
+	if errors.Is(err, exception.ErrVolumeBusy) && c.ForceUnmap {
+		if backend == DeviceTypeNBD {
+			logger.Warn("rbd-nbd can not force the unmap of %s", m.Device)
+		} else {
+			logger.Warn("Device %s is still busy, forcing the unmap", m.Device)
+			err = c.runUnmap(ctx, m, backend, true)
+		}
+	}
+	if errors.Is(err, exception.ErrVolumeBusy) {
+		holders, mounts, _ := c.deviceUsers(m.Device)
+		return &exception.BusyError{Device: m.Device, Holders: holders, Mounts: mounts, Err: err}
+	}
+	return err
+}
+
+// runUnmap Run the unmap command of the backend once
+func (c *ConnRbd) runUnmap(ctx context.Context, m *Mapping, backend DeviceType, force bool) error {
+	tool, args := "rbd-nbd", []string{"unmap", m.Device}
+	if backend != DeviceTypeNBD {
+		conf, err := c.writeCephConfig()
+		if err != nil {
+			return err
+		}
+		defer conf.remove()
+		tool = "rbd"
+		if force {
+			args = append(args, "-o", "force")
+		}
+		args = append(args, conf.args()...)
+	}
+	res, err := c.execute(ctx, tool, args...)
+	if err != nil {
+		logger.Error("Exec %s unmap failed", tool, err)
+		return classifyRbdError(err)
+	}
+	logger.Debug("Exec %s unmap command success", tool, res)
+	return nil
+}
+
+// deviceUsers Return the devices stacked on a device or its partitions and
+// the mount points of them
+func (c *ConnRbd) deviceUsers(device string) ([]string, []string, error) {
+	name := path.Base(device)
+	names := map[string]bool{name: true}
+	partitions, err := c.Root.Glob("/sys/block/" + name + "/" + name + "p*")
+	if err != nil {
+		return nil, nil, exception.Wrap(exception.ErrIO, err, "list the partitions of %s", device)
+	}
+	for _, p := range partitions {
+		names[path.Base(p)] = true
+	}
+	var holders []string
+	for _, dir := range append([]string{"/sys/block/" + name}, partitions...) {
+		paths, err := c.Root.Glob(dir + "/holders/*")
+		if err != nil {
+			return nil, nil, exception.Wrap(exception.ErrIO, err, "list the holders of %s", device)
+		}
+		for _, p := range paths {
+			holders = append(holders, path.Base(p))
+		}
+	}
+	mounts, err := c.mountPoints(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	return holders, mounts, nil
+}
+
+// mountPoints Return the mount points of the block devices names, mount
+// sources which are symlinks such as /dev/rbd/<pool>/<image> are resolved
+func (c *ConnRbd) mountPoints(names map[string]bool) ([]string, error) {
+	content, err := c.Root.ReadFile(mountsFile)
+	if os.IsNotExist(err) {
+		logger.Warn("%s does not exist, the mounts of the device are not checked", mountsFile)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, exception.Wrap(exception.ErrIO, err, "read %s", mountsFile)
+	}
+	var mounts []string
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		source := unescapeMountField(fields[0])
+		if resolved, err := c.Root.EvalSymlinks(source); err == nil {
+			source = resolved
+		}
+		if names[path.Base(source)] && path.Dir(source) == "/dev" {
+			mounts = append(mounts, unescapeMountField(fields[1]))
+		}
+	}
+	return mounts, nil
+}
+
+// unescapeMountField Decode the octal escapes of white space and
+// backslashes in a mount table field
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}